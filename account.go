@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// accountKeyNextName is the cache entry holding the new account key during a
+// rollover, so it isn't lost if storing it fails after the CA has switched.
+const accountKeyNextName = accountKeyName + "+next"
+
+// acmeDirectory is the part of an ACME directory that accountClient uses.
+// RFC 8555 and ACME v1, which the Let's Encrypt v01 endpoints speak, name
+// the resources differently.
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	KeyChange  string `json:"keyChange"`
+
+	NewReg      string `json:"new-reg"`
+	KeyChangeV1 string `json:"key-change"`
+}
+
+// rfc8555 reports whether the directory is for RFC 8555 rather than ACME v1.
+func (d acmeDirectory) rfc8555() bool {
+	return d.NewAccount != ""
+}
+
+// accountDetails is what the CA says about an account.
+type accountDetails struct {
+	URI       string   `json:"-"`
+	Status    string   `json:"status"`
+	Contact   []string `json:"contact"`
+	CreatedAt string   `json:"createdAt"`
+	// Agreement is the terms of service URL agreed to, in ACME v1.
+	Agreement string `json:"agreement"`
+	// TermsOfServiceAgreed is set once the terms are agreed to, in RFC 8555.
+	TermsOfServiceAgreed bool `json:"termsOfServiceAgreed"`
+}
+
+// accountClient manages the ACME account of a key. acme.Client registers
+// accounts and updates their contacts, but can't look up an account's status,
+// roll its key over or deactivate it, so accountClient signs those requests
+// itself.
+type accountClient struct {
+	DirectoryURL string
+	Key          crypto.Signer
+	HTTPClient   *http.Client
+
+	dir acmeDirectory
+	// The account URL, once lookup has found it.
+	uri string
+}
+
+func (a *accountClient) discover(ctx context.Context) error {
+	if a.dir.NewAccount != "" || a.dir.NewReg != "" {
+		return nil
+	}
+	req, err := http.NewRequest("GET", a.DirectoryURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := a.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return acmeResponseError(res)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&a.dir); err != nil {
+		return fmt.Errorf("invalid directory %s: %v", a.DirectoryURL, err)
+	}
+	if a.dir.NewAccount == "" && a.dir.NewReg == "" {
+		return fmt.Errorf("%s is not an ACME directory", a.DirectoryURL)
+	}
+	return nil
+}
+
+func (a *accountClient) nonce(ctx context.Context) (string, error) {
+	url := a.dir.NewNonce
+	if url == "" {
+		url = a.dir.NewReg
+	}
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := a.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if nonce := res.Header.Get("Replay-Nonce"); nonce != "" {
+		return nonce, nil
+	}
+	return "", fmt.Errorf("no nonce from %s (%s)", url, res.Status)
+}
+
+// post signs payload with the account key and posts it to url. Once the
+// account URL is known, RFC 8555 requests identify the account by it rather
+// than by the key.
+func (a *accountClient) post(ctx context.Context, url string, payload interface{}) (*http.Response, error) {
+	nonce, err := a.nonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	header := map[string]interface{}{"nonce": nonce, "url": url}
+	if a.dir.rfc8555() && a.uri != "" {
+		header["kid"] = a.uri
+	} else if header["jwk"], err = jwkEncode(a.Key.Public()); err != nil {
+		return nil, err
+	}
+	var data []byte
+	if raw, ok := payload.(json.RawMessage); ok {
+		data = raw
+	} else if data, err = json.Marshal(payload); err != nil {
+		return nil, err
+	}
+	body, err := jwsEncode(a.Key, header, data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	return a.HTTPClient.Do(req.WithContext(ctx))
+}
+
+// postAccount posts payload to url and returns the account in the response.
+func (a *accountClient) postAccount(ctx context.Context, url string, payload interface{}, ok ...int) (*accountDetails, *http.Response, error) {
+	res, err := a.post(ctx, url, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	for _, code := range ok {
+		if res.StatusCode == code {
+			d := &accountDetails{URI: a.uri}
+			if err := json.NewDecoder(res.Body).Decode(d); err != nil {
+				return nil, nil, fmt.Errorf("invalid account: %v", err)
+			}
+			return d, res, nil
+		}
+	}
+	return nil, res, acmeResponseError(res)
+}
+
+// lookup finds the account for the key. ACME v1 has no way to look an
+// account up without registering it, so on ACME v1 directories a key that
+// has no account is registered, without contacts.
+func (a *accountClient) lookup(ctx context.Context) (*accountDetails, error) {
+	if err := a.discover(ctx); err != nil {
+		return nil, err
+	}
+	if a.dir.rfc8555() {
+		a.uri = ""
+		d, res, err := a.postAccount(ctx, a.dir.NewAccount, map[string]interface{}{"onlyReturnExisting": true}, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		a.uri = res.Header.Get("Location")
+		d.URI = a.uri
+		return d, nil
+	}
+	res, err := a.post(ctx, a.dir.NewReg, map[string]string{"resource": "new-reg"})
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusConflict, http.StatusCreated:
+		a.uri = res.Header.Get("Location")
+	default:
+		return nil, acmeResponseError(res)
+	}
+	if a.uri == "" {
+		return nil, errors.New("the CA didn't say where the account is")
+	}
+	return a.details(ctx)
+}
+
+// details fetches the account found by lookup.
+func (a *accountClient) details(ctx context.Context) (*accountDetails, error) {
+	var payload interface{} = map[string]string{"resource": "reg"}
+	if a.dir.rfc8555() {
+		payload = struct{}{}
+	}
+	d, _, err := a.postAccount(ctx, a.uri, payload, http.StatusOK, http.StatusAccepted)
+	return d, err
+}
+
+// updateContact replaces the account's contacts, e.g. ["mailto:ops@example.com"].
+func (a *accountClient) updateContact(ctx context.Context, contact []string) (*accountDetails, error) {
+	if !a.dir.rfc8555() {
+		if len(contact) == 0 {
+			// UpdateReg leaves the contacts alone if there are none.
+			return nil, errors.New("ACME v1 can't remove every contact")
+		}
+		// acme.Client speaks ACME v1.
+		c := &acme.Client{Key: a.Key, DirectoryURL: a.DirectoryURL, HTTPClient: a.HTTPClient}
+		if _, err := c.UpdateReg(ctx, &acme.Account{URI: a.uri, Contact: contact}); err != nil {
+			return nil, err
+		}
+		return a.details(ctx)
+	}
+	if contact == nil {
+		contact = []string{}
+	}
+	d, _, err := a.postAccount(ctx, a.uri, map[string]interface{}{"contact": contact}, http.StatusOK)
+	return d, err
+}
+
+// rollover replaces the account key with newKey, as described in RFC 8555
+// section 7.3.5, or with the key-change resource of ACME v1. a.Key is newKey
+// afterwards.
+func (a *accountClient) rollover(ctx context.Context, newKey crypto.Signer) error {
+	url := a.dir.KeyChange
+	if !a.dir.rfc8555() {
+		url = a.dir.KeyChangeV1
+	}
+	if url == "" {
+		return fmt.Errorf("%s doesn't support key rollover", a.DirectoryURL)
+	}
+	newJWK, err := jwkEncode(newKey.Public())
+	if err != nil {
+		return err
+	}
+	// The new key signs the inner request. RFC 8555 has it name the old key,
+	// ACME v1 the new one.
+	request := map[string]interface{}{"account": a.uri, "newKey": newJWK}
+	if a.dir.rfc8555() {
+		oldJWK, err := jwkEncode(a.Key.Public())
+		if err != nil {
+			return err
+		}
+		request = map[string]interface{}{"account": a.uri, "oldKey": oldJWK}
+	}
+	inner, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	signed, err := jwsEncode(newKey, map[string]interface{}{"jwk": newJWK, "url": url}, inner)
+	if err != nil {
+		return err
+	}
+	var payload interface{} = json.RawMessage(signed)
+	if !a.dir.rfc8555() {
+		// ACME v1 requests name their resource, so add it next to the inner
+		// JWS's members.
+		var jws map[string]interface{}
+		if err := json.Unmarshal(signed, &jws); err != nil {
+			return err
+		}
+		jws["resource"] = "key-change"
+		payload = jws
+	}
+	res, err := a.post(ctx, url, payload)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return acmeResponseError(res)
+	}
+	a.Key = newKey
+	return nil
+}
+
+// deactivate deactivates the account. The CA won't accept any more requests
+// signed by its key.
+func (a *accountClient) deactivate(ctx context.Context) (*accountDetails, error) {
+	payload := map[string]string{"status": "deactivated"}
+	if !a.dir.rfc8555() {
+		payload["resource"] = "reg"
+	}
+	d, _, err := a.postAccount(ctx, a.uri, payload, http.StatusOK, http.StatusAccepted)
+	return d, err
+}
+
+// acmeResponseError returns the problem in an error response from the CA.
+func acmeResponseError(res *http.Response) error {
+	var problem struct {
+		Type   string `json:"type"`
+		Detail string `json:"detail"`
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if json.Unmarshal(data, &problem) != nil || problem.Detail == "" {
+		problem.Detail = strings.TrimSpace(string(data))
+		if problem.Detail == "" {
+			problem.Detail = res.Status
+		}
+	}
+	return &acme.Error{StatusCode: res.StatusCode, ProblemType: problem.Type, Detail: problem.Detail, Header: res.Header}
+}
+
+// jwkEncode returns the JSON Web Key for pub, with the members in the order
+// RFC 7638 thumbprints use.
+func jwkEncode(pub crypto.PublicKey) (json.RawMessage, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		e := big.NewInt(int64(pub.E)).Bytes()
+		return json.RawMessage(fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, b64(e), b64(pub.N.Bytes()))), nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		x, y := padBytes(pub.X.Bytes(), size), padBytes(pub.Y.Bytes(), size)
+		return json.RawMessage(fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, pub.Curve.Params().Name, b64(x), b64(y))), nil
+	}
+	return nil, fmt.Errorf("unsupported account key type %T", pub)
+}
+
+// padBytes left pads b with zeros to size bytes.
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// jwsEncode signs payload with key and returns the JWS in the flattened JSON
+// serialization. header is the protected header, without alg.
+func jwsEncode(key crypto.Signer, header map[string]interface{}, payload []byte) ([]byte, error) {
+	var alg string
+	var hash crypto.Hash
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		alg, hash = "RS256", crypto.SHA256
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			alg, hash = "ES256", crypto.SHA256
+		case elliptic.P384():
+			alg, hash = "ES384", crypto.SHA384
+		default:
+			return nil, fmt.Errorf("unsupported account key curve %s", pub.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported account key type %T", pub)
+	}
+	protected := map[string]interface{}{"alg": alg}
+	for k, v := range header {
+		protected[k] = v
+	}
+	ph, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(ph) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	var sig []byte
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		// JWS wants r and s, not the ASN.1 signature.
+		r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = append(padBytes(r.Bytes(), size), padBytes(s.Bytes(), size)...)
+	default:
+		if sig, err = key.Sign(rand.Reader, h.Sum(nil), hash); err != nil {
+			return nil, err
+		}
+	}
+	parts := strings.SplitN(signingInput, ".", 2)
+	return json.Marshal(map[string]string{
+		"protected": parts[0],
+		"payload":   parts[1],
+		"signature": base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// encodeAccountKey returns key PEM encoded the way autocert stores account
+// keys.
+func encodeAccountKey(key crypto.Signer) ([]byte, error) {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	}
+	return nil, fmt.Errorf("unsupported account key type %T", key)
+}
+
+// parseAccountKey parses a PEM encoded account key.
+func parseAccountKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || !strings.Contains(block.Type, "PRIVATE KEY") {
+		return nil, errors.New("no PEM encoded private key")
+	}
+	return parsePrivateKey(block.Bytes)
+}
+
+// cachedAccountKey returns the ACME account key autocert keeps in k.
+func cachedAccountKey(ctx context.Context, k *kubernetesCache) (crypto.Signer, error) {
+	data, err := k.Get(ctx, accountKeyName)
+	if err == autocert.ErrCacheMiss {
+		return nil, errors.New("the cache has no account key for this directory")
+	} else if err != nil {
+		return nil, err
+	}
+	return parseAccountKey(data)
+}
+
+// emailContact returns the account contacts for email.
+func emailContact(email string) []string {
+	if email == "" {
+		return nil
+	}
+	return []string{"mailto:" + email}
+}
+
+// syncAccountContact updates the contacts of the account autocert uses for
+// k's directory to email, if they differ. autocert only sends the email when
+// it registers, so changing it wouldn't otherwise reach the CA. Nothing is
+// done if there's no account yet.
+func syncAccountContact(ctx context.Context, k *kubernetesCache, email string) error {
+	data, err := k.Get(ctx, accountKeyName)
+	if err == autocert.ErrCacheMiss {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	key, err := parseAccountKey(data)
+	if err != nil {
+		return err
+	}
+	a := &accountClient{DirectoryURL: k.directoryURL, Key: key, HTTPClient: newACMEHTTPClient()}
+	d, err := a.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	want := emailContact(email)
+	if sameStrings(d.Contact, want) {
+		return nil
+	}
+	if _, err := a.updateContact(ctx, want); err != nil {
+		return err
+	}
+	logger.Info("updated account contact", "directory", k.directoryURL, "account", a.uri, "from", strings.Join(d.Contact, ","), "to", strings.Join(want, ","))
+	return nil
+}
+
+// printAccount writes d to out.
+func printAccount(out io.Writer, d *accountDetails, key crypto.Signer) {
+	status := d.Status
+	if status == "" {
+		status = "(not reported)"
+	}
+	contact := strings.Join(d.Contact, ", ")
+	if contact == "" {
+		contact = "(none)"
+	}
+	fmt.Fprintf(out, "  account:     %s\n  status:      %s\n  contact:     %s\n", d.URI, status, contact)
+	if d.CreatedAt != "" {
+		fmt.Fprintf(out, "  created:     %s\n", d.CreatedAt)
+	}
+	if d.Agreement != "" {
+		fmt.Fprintf(out, "  agreed to:   %s\n", d.Agreement)
+	}
+	if thumbprint, err := acme.JWKThumbprint(key.Public()); err == nil {
+		fmt.Fprintf(out, "  thumbprint:  %s\n", thumbprint)
+	}
+}
+
+// runAccount implements the account subcommand.
+func runAccount(args []string, out io.Writer) error {
+	const usage = "usage: account show|update|import-key|rollover|deactivate [flags]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("account "+action, flag.ContinueOnError)
+	fs.SetOutput(out)
+	kubeconfigPath := fs.String("kubeconfig", defaultKubeconfigPath(), "Path to the kubeconfig file")
+	ns := fs.String("namespace", "", "Namespace of the cache secret. Defaults to the kubeconfig context's namespace")
+	cacheSecret := fs.String("secret", "acme.secret", "Name of the cache secret")
+	accountSecret := fs.String("account-secret", "", "Name of the secret holding the account key, if it isn't the cache secret")
+	useStaging := fs.Bool("staging", false, "Use the account for the letsencrypt staging server")
+	directoryURL := fs.String("directory", "", "ACME directory of the account, if not Let's Encrypt")
+	email := fs.String("email", "", "update: contact email for the account; empty removes it")
+	keyFile := fs.String("key", "", "import-key: PEM file holding the account key")
+	force := fs.Bool("force", false, "import-key: replace an existing account key")
+	yes := fs.Bool("yes", false, "deactivate: confirm; deactivation can't be undone")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	switch action {
+	case "show", "update", "import-key", "rollover", "deactivate":
+	default:
+		return fmt.Errorf("unknown action %q; %s", action, usage)
+	}
+	if action == "import-key" && *keyFile == "" {
+		return errors.New("-key is required")
+	}
+	if action == "deactivate" && !*yes {
+		return errors.New("deactivating an account can't be undone; pass -yes to confirm")
+	}
+
+	client, contextNamespace, err := commandClient(*kubeconfigPath)
+	if err != nil {
+		return err
+	}
+	if *ns == "" {
+		*ns = contextNamespace
+	}
+	*ns = defaultNamespace(*ns)
+	if *directoryURL == "" {
+		*directoryURL = acme.LetsEncryptURL
+		if *useStaging {
+			*directoryURL = letsEncryptStagingURL
+		}
+	}
+	k := newKubernetesCache(*cacheSecret, "", *ns, "", *directoryURL, client, 1, outputOptions{}, false)
+	k.AccountSecretName = *accountSecret
+	where := fmt.Sprintf("%s in %s/%s", k.secretKey(accountKeyName), *ns, k.secretFor(accountKeyName))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if action == "import-key" {
+		data, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		key, err := parseAccountKey(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *keyFile, err)
+		}
+		if _, err := k.Get(ctx, accountKeyName); err == nil && !*force {
+			return fmt.Errorf("there is already an account key at %s; pass -force to replace it", where)
+		} else if err != nil && err != autocert.ErrCacheMiss {
+			return err
+		}
+		encoded, err := encodeAccountKey(key)
+		if err != nil {
+			return err
+		}
+		if err := k.Put(ctx, accountKeyName, encoded); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Imported account key as %s\nRestart the generator to use it.\n", where)
+		return nil
+	}
+
+	key, err := cachedAccountKey(ctx, k)
+	if err != nil {
+		return err
+	}
+	a := &accountClient{DirectoryURL: *directoryURL, Key: key, HTTPClient: newACMEHTTPClient()}
+	d, err := a.lookup(ctx)
+	if err != nil {
+		return fmt.Errorf("could not look up the account: %v", err)
+	}
+
+	switch action {
+	case "show":
+		fmt.Fprintf(out, "ACME account for %s, key %s\n", *directoryURL, where)
+		printAccount(out, d, key)
+
+	case "update":
+		if d, err = a.updateContact(ctx, emailContact(*email)); err != nil {
+			return fmt.Errorf("could not update the account: %v", err)
+		}
+		fmt.Fprintf(out, "Updated ACME account contact\n")
+		printAccount(out, d, key)
+
+	case "rollover":
+		newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		encoded, err := encodeAccountKey(newKey)
+		if err != nil {
+			return err
+		}
+		if err := k.Put(ctx, accountKeyNextName, encoded); err != nil {
+			return fmt.Errorf("could not save the new key: %v", err)
+		}
+		if err := a.rollover(ctx, newKey); err != nil {
+			k.Delete(ctx, accountKeyNextName)
+			return fmt.Errorf("key rollover failed; the old key is still in use: %v", err)
+		}
+		if err := k.Put(ctx, accountKeyName, encoded); err != nil {
+			return fmt.Errorf("the CA switched to the new key, but it couldn't be stored; copy %s over %s: %v",
+				k.secretKey(accountKeyNextName), where, err)
+		}
+		k.Delete(ctx, accountKeyNextName)
+		fmt.Fprintf(out, "Rolled over the account key for %s\n", d.URI)
+		printAccount(out, d, newKey)
+		fmt.Fprintf(out, "Restart the generator to use the new key.\n")
+
+	case "deactivate":
+		if d, err = a.deactivate(ctx); err != nil {
+			return fmt.Errorf("could not deactivate the account: %v", err)
+		}
+		if err := k.Delete(ctx, accountKeyName); err != nil {
+			return fmt.Errorf("the account is deactivated, but its key couldn't be removed from %s: %v", where, err)
+		}
+		fmt.Fprintf(out, "Deactivated ACME account and removed its key from %s\n", where)
+		printAccount(out, d, key)
+		fmt.Fprintf(out, "The generator will register a new account the next time it orders a certificate.\n")
+	}
+	return nil
+}
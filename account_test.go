@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// decodeJWS returns the protected header and payload of a flattened JWS,
+// after checking its ES256 signature against the jwk in the header or pub.
+func decodeJWS(t *testing.T, data []byte, pub *ecdsa.PublicKey) (map[string]interface{}, []byte) {
+	t.Helper()
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.Unmarshal(data, &jws); err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding
+	ph, _ := b64.DecodeString(jws.Protected)
+	payload, _ := b64.DecodeString(jws.Payload)
+	sig, _ := b64.DecodeString(jws.Signature)
+	var header map[string]interface{}
+	if err := json.Unmarshal(ph, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header["alg"] != "ES256" {
+		t.Errorf("got alg %v", header["alg"])
+	}
+	if key := jwkKey(header); key != nil {
+		pub = key
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if len(sig) != 64 || !ecdsa.Verify(pub, digest[:], r, s) {
+		t.Error("bad signature")
+	}
+	return header, payload
+}
+
+// jwkKey returns the public key in the jwk of a JWS header, or nil.
+func jwkKey(header map[string]interface{}) *ecdsa.PublicKey {
+	jwk, ok := header["jwk"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwk["x"].(string))
+	y, _ := base64.RawURLEncoding.DecodeString(jwk["y"].(string))
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+}
+
+func TestAccountKeyRoundTrip(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	data, err := encodeAccountKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseAccountKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKeysEqual(parsed.Public(), key.Public()) {
+		t.Error("parsed key differs")
+	}
+	if _, err := parseAccountKey([]byte("not a key")); err == nil {
+		t.Error("expected an error for a file without a key")
+	}
+}
+
+// fakeACME is an RFC 8555 server that only knows about accounts. It also
+// takes the revocation requests of the older protocol autocert speaks, and
+// with ca set issues certificates over it, without challenges.
+type fakeACME struct {
+	t *testing.T
+	// v1 makes the directory an ACME v1 one.
+	v1      bool
+	url     string
+	key     *ecdsa.PublicKey
+	account accountDetails
+	// The key the account has after a rollover.
+	rolledTo *ecdsa.PublicKey
+	revoked  []fakeRevocation
+
+	ca    *x509.Certificate
+	caKey crypto.Signer
+}
+
+// fakeRevocation is a revocation request received by fakeACME.
+type fakeRevocation struct {
+	// The key that signed the request.
+	key    *ecdsa.PublicKey
+	cert   []byte
+	reason int
+}
+
+func (f *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce")
+	if r.URL.Path == "/directory" {
+		dir := map[string]string{
+			"newNonce":    f.url + "/nonce",
+			"newAccount":  f.url + "/new-account",
+			"keyChange":   f.url + "/key-change",
+			"revoke-cert": f.url + "/revoke-cert",
+			"new-reg":     f.url + "/new-reg",
+			"new-authz":   f.url + "/new-authz",
+			"new-cert":    f.url + "/new-cert",
+		}
+		if f.v1 {
+			delete(dir, "newNonce")
+			delete(dir, "newAccount")
+			delete(dir, "keyChange")
+			dir["key-change"] = f.url + "/key-change"
+		}
+		json.NewEncoder(w).Encode(dir)
+		return
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	if r.URL.Path == "/ca" {
+		w.Write(f.ca.Raw)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	header, payload := decodeJWS(f.t, body, f.key)
+	switch r.URL.Path {
+	case "/revoke-cert":
+		var req struct {
+			Certificate string
+			Reason      int
+		}
+		json.Unmarshal(payload, &req)
+		cert, _ := base64.RawURLEncoding.DecodeString(req.Certificate)
+		f.revoked = append(f.revoked, fakeRevocation{key: jwkKey(header), cert: cert, reason: req.Reason})
+		return
+	case "/new-reg":
+		w.Header().Set("Location", f.url+"/reg/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+		return
+	case "/new-authz":
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status": "valid"}`))
+		return
+	case "/new-cert":
+		f.issue(w, payload)
+		return
+	}
+	if header["url"] != f.url+r.URL.Path {
+		f.t.Errorf("%s: url header %v", r.URL.Path, header["url"])
+	}
+	switch r.URL.Path {
+	case "/new-account":
+		if _, ok := header["jwk"]; !ok {
+			f.t.Error("new-account: no jwk")
+		}
+		w.Header().Set("Location", f.url+"/account/1")
+	case "/account/1":
+		if header["kid"] != f.url+"/account/1" {
+			f.t.Errorf("account: kid %v", header["kid"])
+		}
+		json.Unmarshal(payload, &f.account)
+	case "/key-change":
+		var inner struct {
+			Account        string
+			OldKey, NewKey json.RawMessage
+		}
+		innerHeader, innerPayload := decodeJWS(f.t, payload, nil)
+		json.Unmarshal(innerPayload, &inner)
+		account, named := f.url+"/account/1", inner.OldKey
+		if f.v1 {
+			var outer struct{ Resource string }
+			json.Unmarshal(payload, &outer)
+			if outer.Resource != "key-change" {
+				f.t.Errorf("key-change: got resource %q", outer.Resource)
+			}
+			account, named = f.url+"/reg/1", inner.NewKey
+		}
+		if inner.Account != account || named == nil || innerHeader["url"] != f.url+"/key-change" {
+			f.t.Errorf("key-change: got %s, %v", innerPayload, innerHeader)
+		}
+		jwk := innerHeader["jwk"].(map[string]interface{})
+		x, _ := base64.RawURLEncoding.DecodeString(jwk["x"].(string))
+		f.rolledTo = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x)}
+		return
+	}
+	json.NewEncoder(w).Encode(f.account)
+}
+
+// issue answers a new-cert request with a certificate signed by f.ca.
+func (f *fakeACME) issue(w http.ResponseWriter, payload []byte) {
+	var req struct{ CSR string }
+	json.Unmarshal(payload, &req)
+	der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		f.t.Errorf("new-cert: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Like CAs do, include the common name autocert puts the domain in.
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		DNSNames:     append(csr.DNSNames, csr.Subject.CommonName),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, f.ca, csr.PublicKey, f.caKey)
+	if err != nil {
+		f.t.Errorf("new-cert: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Link", "<"+f.url+"/ca>;rel=\"up\"")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(cert)
+}
+
+func TestAccountClient(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f := &fakeACME{t: t, key: &key.PublicKey, account: accountDetails{Status: "valid", Contact: []string{"mailto:old@example.com"}}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	f.url = srv.URL
+
+	a := &accountClient{DirectoryURL: srv.URL + "/directory", Key: key, HTTPClient: srv.Client()}
+	d, err := a.lookup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.URI != srv.URL+"/account/1" || d.Status != "valid" {
+		t.Errorf("got account %+v", d)
+	}
+
+	want := emailContact("new@example.com")
+	if d, err = a.updateContact(context.Background(), want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.Contact, want) {
+		t.Errorf("got contact %v, want %v", d.Contact, want)
+	}
+
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := a.rollover(context.Background(), newKey); err != nil {
+		t.Fatal(err)
+	}
+	if f.rolledTo == nil || f.rolledTo.X.Cmp(newKey.X) != 0 || a.Key != newKey {
+		t.Error("key wasn't rolled over to the new key")
+	}
+
+	f.key = &newKey.PublicKey
+	if d, err = a.deactivate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != "deactivated" {
+		t.Errorf("got status %q", d.Status)
+	}
+}
+
+func TestAccountClientV1Rollover(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f := &fakeACME{t: t, v1: true, key: &key.PublicKey, account: accountDetails{Status: "valid"}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	f.url = srv.URL
+
+	a := &accountClient{DirectoryURL: srv.URL + "/directory", Key: key, HTTPClient: srv.Client()}
+	d, err := a.lookup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.URI != srv.URL+"/reg/1" {
+		t.Errorf("got account %+v", d)
+	}
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := a.rollover(context.Background(), newKey); err != nil {
+		t.Fatal(err)
+	}
+	if f.rolledTo == nil || f.rolledTo.X.Cmp(newKey.X) != 0 || a.Key != newKey {
+		t.Error("key wasn't rolled over to the new key")
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// backoffSecretKey is the key in the cache secret holding issuance
+	// history and backoff state, so it survives restarts. It's prefixed with
+	// the directory, since rate limits are per CA.
+	backoffSecretKey = "k8s-cert-generator.backoff"
+
+	// After a failed attempt we wait minBackoff, doubling for each further
+	// consecutive failure up to maxBackoff. Let's Encrypt allows 5 failed
+	// validations per hostname per hour; starting at 5 minutes keeps us under
+	// that.
+	minBackoff = 5 * time.Minute
+	maxBackoff = 24 * time.Hour
+
+	// rateLimitBackoff is how long to wait after a rate limit error that
+	// didn't say when to retry.
+	rateLimitBackoff = time.Hour
+
+	// Let's Encrypt issues at most duplicateCertificateLimit certificates for
+	// the same set of names per duplicateCertificateWindow.
+	duplicateCertificateLimit  = 5
+	duplicateCertificateWindow = 7 * 24 * time.Hour
+
+	// maxAttemptHistory is the number of attempts we remember per domain.
+	maxAttemptHistory = 20
+)
+
+// issuanceAttempt is one entry in a domain's attempt history.
+type issuanceAttempt struct {
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"` // "success" or "failure"
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// domainBackoff is the persisted issuance state for one domain.
+type domainBackoff struct {
+	Attempts            []issuanceAttempt `json:"attempts,omitempty"`
+	ConsecutiveFailures int               `json:"consecutiveFailures,omitempty"`
+	RetryAfter          time.Time         `json:"retryAfter,omitempty"`
+	Reason              string            `json:"reason,omitempty"`
+}
+
+// backoffError is returned instead of contacting the CA while a domain is
+// backing off.
+type backoffError struct {
+	Domain string
+	Until  time.Time
+	Reason string
+}
+
+func (e *backoffError) Error() string {
+	return fmt.Sprintf("not requesting a certificate for %s until %s (%s)", e.Domain, e.Until.UTC().Format(time.RFC3339), e.Reason)
+}
+
+// asBackoffError returns the backoffError in err, if any. Errors returned by
+// the ACME transport reach callers wrapped in a *url.Error.
+func asBackoffError(err error) (*backoffError, bool) {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	berr, ok := err.(*backoffError)
+	return berr, ok
+}
+
+// backoffStore loads and saves backoff state.
+type backoffStore interface {
+	Load() (map[string]*domainBackoff, error)
+	Save(map[string]*domainBackoff) error
+}
+
+// secretBackoffStore stores backoff state as JSON under Key in the cache
+// secret.
+type secretBackoffStore struct {
+	Client     kubernetes.Interface
+	Namespace  string
+	SecretName string
+	Key        string
+}
+
+func (s *secretBackoffStore) Load() (map[string]*domainBackoff, error) {
+	secret, err := s.Client.CoreV1().Secrets(s.Namespace).Get(s.SecretName, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]*domainBackoff)
+	if data := secret.Data[s.Key]; len(data) > 0 {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("parsing %s in secret %s: %v", s.Key, s.SecretName, err)
+		}
+	}
+	return state, nil
+}
+
+func (s *secretBackoffStore) Save(state map[string]*domainBackoff) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return updateSecretKey(s.Client, s.Namespace, s.SecretName, s.Key, data)
+}
+
+// backoffTracker decides whether we may ask the CA for a certificate, based
+// on recent failures, rate limit responses and how many certificates we've
+// been issued recently.
+type backoffTracker struct {
+	store backoffStore
+	now   func() time.Time
+
+	mu      sync.Mutex
+	loaded  bool
+	domains map[string]*domainBackoff
+}
+
+// backoffs is the process wide backoff tracker. It is nil, and every request
+// is allowed, until main sets it up.
+var backoffs *backoffTracker
+
+func newBackoffTracker(store backoffStore) *backoffTracker {
+	return &backoffTracker{store: store, now: time.Now, domains: make(map[string]*domainBackoff)}
+}
+
+// load reads the persisted state, if it hasn't been read yet. The caller
+// must hold b.mu.
+func (b *backoffTracker) load() {
+	if b.loaded {
+		return
+	}
+	state, err := b.store.Load()
+	if err != nil {
+		// Try again next time; until then we only know about this process.
+		logger.Warn("could not load backoff state", "err", err)
+		return
+	}
+	for domain, st := range state {
+		if _, ok := b.domains[domain]; !ok {
+			b.domains[domain] = st
+		}
+	}
+	b.loaded = true
+}
+
+// save persists the state. The caller must hold b.mu.
+func (b *backoffTracker) save() {
+	if err := b.store.Save(b.domains); err != nil {
+		logger.Warn("could not save backoff state", "err", err)
+	}
+}
+
+// get returns the state for domain, adding it if needed. The caller must
+// hold b.mu.
+func (b *backoffTracker) get(domain string) *domainBackoff {
+	b.load()
+	st, ok := b.domains[domain]
+	if !ok {
+		st = new(domainBackoff)
+		b.domains[domain] = st
+	}
+	return st
+}
+
+// allow returns a *backoffError if we should not ask the CA for a
+// certificate for domain right now. b may be nil.
+func (b *backoffTracker) allow(domain string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.get(domain)
+	now := b.now()
+	if now.Before(st.RetryAfter) {
+		return &backoffError{Domain: domain, Until: st.RetryAfter, Reason: st.Reason}
+	}
+	var issued []time.Time
+	for _, a := range st.Attempts {
+		if a.Outcome == "success" && now.Sub(a.Time) < duplicateCertificateWindow {
+			issued = append(issued, a.Time)
+		}
+	}
+	if len(issued) >= duplicateCertificateLimit {
+		sort.Slice(issued, func(i, j int) bool { return issued[i].Before(issued[j]) })
+		return &backoffError{
+			Domain: domain,
+			Until:  issued[len(issued)-duplicateCertificateLimit].Add(duplicateCertificateWindow),
+			Reason: "duplicate_certificate_limit",
+		}
+	}
+	return nil
+}
+
+// addAttempt appends to the attempt history, dropping old entries. The
+// caller must hold b.mu.
+func (b *backoffTracker) addAttempt(st *domainBackoff, outcome, reason string) {
+	now := b.now()
+	attempts := st.Attempts[:0]
+	for _, a := range st.Attempts {
+		if now.Sub(a.Time) < duplicateCertificateWindow {
+			attempts = append(attempts, a)
+		}
+	}
+	attempts = append(attempts, issuanceAttempt{Time: now, Outcome: outcome, Reason: reason})
+	if len(attempts) > maxAttemptHistory {
+		attempts = attempts[len(attempts)-maxAttemptHistory:]
+	}
+	st.Attempts = attempts
+}
+
+// recordSuccess notes that a certificate was issued for domain. b may be
+// nil.
+func (b *backoffTracker) recordSuccess(domain string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.get(domain)
+	b.addAttempt(st, "success", "")
+	st.ConsecutiveFailures = 0
+	st.RetryAfter = time.Time{}
+	st.Reason = ""
+	b.save()
+}
+
+// recordFailure notes that obtaining a certificate for domain failed, and
+// starts backing off. b may be nil.
+func (b *backoffTracker) recordFailure(domain string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.get(domain)
+	reason := issuanceFailureReason(err)
+	b.addAttempt(st, "failure", reason)
+	st.ConsecutiveFailures++
+	delay := minBackoff << uint(st.ConsecutiveFailures-1)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	if retryAfter, ok := acme.RateLimit(err); ok {
+		if retryAfter <= 0 {
+			retryAfter = rateLimitBackoff
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+	}
+	b.extend(st, b.now().Add(delay), reason)
+	b.save()
+}
+
+// recordRateLimit notes that the CA told us not to retry for domain before
+// retryAfter. It's used for rate limit responses seen outside a tracked
+// issuance attempt, such as renewals. b may be nil.
+func (b *backoffTracker) recordRateLimit(domain string, retryAfter time.Duration) {
+	if b == nil {
+		return
+	}
+	if retryAfter <= 0 {
+		retryAfter = rateLimitBackoff
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.extend(b.get(domain), b.now().Add(retryAfter), "rate_limited")
+	b.save()
+}
+
+// extend moves st.RetryAfter to until, if that's later. The caller must hold
+// b.mu.
+func (b *backoffTracker) extend(st *domainBackoff, until time.Time, reason string) {
+	if until.After(st.RetryAfter) {
+		st.RetryAfter = until
+		st.Reason = reason
+	}
+}
+
+// active returns the time and reason domain is backing off until, or the
+// zero time if it isn't. b may be nil.
+func (b *backoffTracker) active(domain string) (time.Time, string) {
+	err := b.allow(domain)
+	if berr, ok := err.(*backoffError); ok {
+		return berr.Until, berr.Reason
+	}
+	return time.Time{}, ""
+}
+
+// acmeRequestDomain returns the domain an ACME new-authz or new-cert request
+// is for, from its JWS body. It returns "" if it can't tell.
+func acmeRequestDomain(body []byte) string {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return ""
+	}
+	var req struct {
+		Identifier struct {
+			Value string `json:"value"`
+		} `json:"identifier"`
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return ""
+	}
+	if req.Identifier.Value != "" {
+		return req.Identifier.Value
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		return ""
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return ""
+	}
+	if csr.Subject.CommonName != "" {
+		return csr.Subject.CommonName
+	}
+	if len(csr.DNSNames) > 0 {
+		return csr.DNSNames[0]
+	}
+	return ""
+}
+
+// checkBackoff is called by the ACME transport before sending req. Requests
+// that would start a new authorization or issuance for a domain that is
+// backing off in scope are refused. It returns the domain the request is
+// for, if any.
+func checkBackoff(req *http.Request, endpoint, scope string) (string, error) {
+	if req.Method != "POST" || req.Body == nil || (endpoint != "new-authz" && endpoint != "new-cert") {
+		return "", nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	domain := strings.TrimSuffix(acmeRequestDomain(body), ".")
+	if domain == "" {
+		return "", nil
+	}
+	if err := backoffs.allow(scopedBackoffDomain(scope, domain)); err != nil {
+		issuanceRefused.Inc(domain, err.(*backoffError).Reason)
+		return domain, err
+	}
+	return domain, nil
+}
+
+// scopedBackoffDomain returns the key backoff state for domain is kept
+// under. Fallback issuers back off separately from the primary, so a failing
+// primary doesn't stop us from failing over, and their keys look like
+// "example.com@issuer".
+func scopedBackoffDomain(scope, domain string) string {
+	if scope == "" {
+		return domain
+	}
+	return domain + "@" + scope
+}
+
+// each calls fn for every domain that is currently backing off. b may be
+// nil.
+func (b *backoffTracker) each(fn func(domain string, until time.Time, reason string)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	var domains []string
+	for domain := range b.domains {
+		domains = append(domains, domain)
+	}
+	b.mu.Unlock()
+	sort.Strings(domains)
+	for _, domain := range domains {
+		if until, reason := b.active(domain); !until.IsZero() {
+			fn(domain, until, reason)
+		}
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. It returns 0 if v is empty or invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0
+	}
+	return t.Sub(now)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+type memoryBackoffStore struct {
+	state map[string]*domainBackoff
+}
+
+func (m *memoryBackoffStore) Load() (map[string]*domainBackoff, error) {
+	return m.state, nil
+}
+
+func (m *memoryBackoffStore) Save(state map[string]*domainBackoff) error {
+	m.state = state
+	return nil
+}
+
+func TestBackoffTracker(t *testing.T) {
+	now := time.Date(2018, 8, 21, 12, 0, 0, 0, time.UTC)
+	store := new(memoryBackoffStore)
+	b := newBackoffTracker(store)
+	b.now = func() time.Time { return now }
+
+	if err := b.allow("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	b.recordFailure("example.com", errors.New("unable to authorize"))
+	berr, ok := b.allow("example.com").(*backoffError)
+	if !ok || !berr.Until.Equal(now.Add(minBackoff)) || berr.Reason != "authorization" {
+		t.Fatalf("after one failure: got %v", berr)
+	}
+	b.recordFailure("example.com", errors.New("unable to authorize"))
+	if berr := b.allow("example.com").(*backoffError); !berr.Until.Equal(now.Add(2 * minBackoff)) {
+		t.Errorf("after two failures: got %v", berr.Until)
+	}
+
+	// A rate limit error's Retry-After wins if it's longer.
+	b.recordFailure("example.com", &acme.Error{
+		ProblemType: "urn:acme:error:rateLimited",
+		Header:      http.Header{"Retry-After": []string{"7200"}},
+	})
+	if berr := b.allow("example.com").(*backoffError); !berr.Until.Equal(now.Add(2*time.Hour)) || berr.Reason != "rate_limited" {
+		t.Errorf("after rate limit: got %v", berr)
+	}
+
+	// State survives a restart.
+	b2 := newBackoffTracker(store)
+	b2.now = b.now
+	if _, ok := b2.allow("example.com").(*backoffError); !ok {
+		t.Error("backoff not loaded from store")
+	}
+
+	now = now.Add(3 * time.Hour)
+	b.recordSuccess("example.com")
+	if err := b.allow("example.com"); err != nil {
+		t.Errorf("after success: %v", err)
+	}
+}
+
+func TestBackoffDuplicateCertificateLimit(t *testing.T) {
+	now := time.Date(2018, 8, 21, 12, 0, 0, 0, time.UTC)
+	b := newBackoffTracker(new(memoryBackoffStore))
+	b.now = func() time.Time { return now }
+	first := now
+	for i := 0; i < duplicateCertificateLimit; i++ {
+		b.recordSuccess("example.com")
+		now = now.Add(time.Hour)
+	}
+	berr, ok := b.allow("example.com").(*backoffError)
+	if !ok || berr.Reason != "duplicate_certificate_limit" || !berr.Until.Equal(first.Add(duplicateCertificateWindow)) {
+		t.Fatalf("got %v", berr)
+	}
+	now = first.Add(duplicateCertificateWindow)
+	if err := b.allow("example.com"); err != nil {
+		t.Errorf("after window: %v", err)
+	}
+}
+
+func TestAcmeRequestDomain(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"resource":"new-authz","identifier":{"type":"dns","value":"example.com"}}`))
+	body := []byte(`{"protected":"e30","payload":"` + payload + `","signature":"c2ln"}`)
+	if got := acmeRequestDomain(body); got != "example.com" {
+		t.Errorf("got %q, want example.com", got)
+	}
+	if got := acmeRequestDomain([]byte("not json")); got != "" {
+		t.Errorf("got %q, want empty", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, 8, 21, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"Tue, 21 Aug 2018 13:00:00 GMT", time.Hour},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.in, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q): got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestIssuanceFailureRecordedOncePerOrder(t *testing.T) {
+	backoffs = newBackoffTracker(new(memoryBackoffStore))
+	defer func() { backoffs = nil }()
+	var requests int
+	transport := acmeTransport{base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return nil, errors.New("connection refused")
+	})}
+	order := func() {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"resource":"new-authz","identifier":{"type":"dns","value":"example.com"}}`))
+		body := `{"protected":"e30","payload":"` + payload + `","signature":"c2ln"}`
+		req, err := http.NewRequest("POST", "https://acme.test/acme/new-authz", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport.RoundTrip(req)
+	}
+	certs := newCertificateSet()
+	certs.certs["example.com"] = &managedCertificate{Config: certificateConfig{Domain: "example.com"}, source: errorSource{errors.New("acme: missing certificate")}}
+	getCert := instrumentGetCertificate(certs.managed, certs.backoffScope, certs.GetCertificate)
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	failures := func() int {
+		backoffs.mu.Lock()
+		defer backoffs.mu.Unlock()
+		return backoffs.get("example.com").ConsecutiveFailures
+	}
+
+	// autocert fails every handshake for a while after a failed order
+	// without contacting the CA; only the order is an attempt.
+	order()
+	for i := 0; i < 5; i++ {
+		if _, err := getCert(hello); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if got := failures(); got != 1 {
+		t.Errorf("got %d consecutive failures after one order, want 1", got)
+	}
+
+	// While backing off no order is sent, so nothing more is recorded.
+	order()
+	getCert(hello)
+	if requests != 1 {
+		t.Errorf("sent %d requests, want 1", requests)
+	}
+	if got := failures(); got != 1 {
+		t.Errorf("got %d consecutive failures while backing off, want 1", got)
+	}
+}
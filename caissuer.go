@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// extKeyUsages maps the usages certificates can ask for to extended key
+// usages.
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"server": x509.ExtKeyUsageServerAuth,
+	"client": x509.ExtKeyUsageClientAuth,
+}
+
+// extKeyUsageNames returns the names of the usages in extKeyUsages that are
+// in eku.
+func extKeyUsageNames(eku []x509.ExtKeyUsage) []string {
+	var names []string
+	for name, u := range extKeyUsages {
+		for _, e := range eku {
+			if e == u {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// caSigner signs certificates with a CA certificate and key kept in a
+// kubernetes.io/tls secret. It's for names ACME can't validate, like
+// *.svc.cluster.local and private zones.
+type caSigner struct {
+	Client     kubernetes.Interface
+	Namespace  string
+	SecretName string
+	Validity   time.Duration
+}
+
+// loadCA reads the CA certificate and key. They're read for every
+// certificate, so a rotated CA is picked up without a restart.
+func (s *caSigner) loadCA() (*certBundle, error) {
+	keyPEM, certsPEM, err := readTLSSecret(s.Client, s.Namespace, s.SecretName)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := parseCertBundle(append(append([]byte{}, keyPEM...), certsPEM...))
+	if err != nil {
+		return nil, fmt.Errorf("CA secret %s/%s: %v", s.Namespace, s.SecretName, err)
+	}
+	if !ca.Leaf.IsCA || (ca.Leaf.KeyUsage != 0 && ca.Leaf.KeyUsage&x509.KeyUsageCertSign == 0) {
+		return nil, fmt.Errorf("CA secret %s/%s: certificate %q can't sign certificates", s.Namespace, s.SecretName, ca.Leaf.Subject.CommonName)
+	}
+	return ca, nil
+}
+
+func (s *caSigner) sign(ctx context.Context, cc certificateConfig, key crypto.Signer) ([][]byte, error) {
+	ca, err := s.loadCA()
+	if err != nil {
+		return nil, err
+	}
+	return signWithCA(ca, cc, key.Public(), time.Now(), s.Validity)
+}
+
+// signWithCA signs a certificate for pub and cc with ca, valid from now for
+// validity or until the CA expires, and returns the chain.
+func signWithCA(ca *certBundle, cc certificateConfig, pub crypto.PublicKey, now time.Time, validity time.Duration) ([][]byte, error) {
+	if !now.Before(ca.Leaf.NotAfter) {
+		return nil, fmt.Errorf("CA certificate %q expired at %s", ca.Leaf.Subject.CommonName, ca.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	tmpl, err := leafTemplate(cc, now, validity)
+	if err != nil {
+		return nil, err
+	}
+	// A certificate can't outlive its issuer.
+	if tmpl.NotAfter.After(ca.Leaf.NotAfter) {
+		tmpl.NotAfter = ca.Leaf.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Leaf, pub, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	chain := [][]byte{der}
+	for _, cert := range ca.Chain {
+		chain = append(chain, cert.Raw)
+	}
+	return chain, nil
+}
+
+// leafTemplate returns the certificate to sign for cc, valid from now for
+// validity.
+func leafTemplate(cc certificateConfig, now time.Time, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cc.Domain},
+		DNSNames:     cc.dnsNames(),
+		IPAddresses:  cc.ipAddresses(),
+		// Allow for clocks that are a little behind.
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	for _, u := range cc.usages() {
+		tmpl.ExtKeyUsage = append(tmpl.ExtKeyUsage, extKeyUsages[u])
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func newTestCA(t *testing.T, notAfter time.Time) *certBundle {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Internal CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	b, err := parseCertBundle(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSignWithCA(t *testing.T) {
+	now := time.Now()
+	ca := newTestCA(t, now.Add(365*24*time.Hour))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := certificateConfig{
+		Domain:      "api.default.svc.cluster.local",
+		DNSNames:    []string{"api", "api.default.svc", "api"},
+		IPAddresses: []string{"10.0.0.1"},
+		Usages:      []string{"server", "client"},
+	}
+	chain, err := signWithCA(ca, cc, key.Public(), now, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("got %d certificates in the chain, want leaf and CA", len(chain))
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "api.default.svc", Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}}); err != nil {
+			t.Errorf("usage %v: %v", usage, err)
+		}
+	}
+	if want := []string{"api.default.svc.cluster.local", "api", "api.default.svc"}; !sameStrings(leaf.DNSNames, want) {
+		t.Errorf("got DNS names %v, want %v", leaf.DNSNames, want)
+	}
+	if len(leaf.IPAddresses) != 1 || leaf.IPAddresses[0].String() != "10.0.0.1" {
+		t.Errorf("got IP addresses %v", leaf.IPAddresses)
+	}
+	if got := leaf.NotAfter.Sub(now); got < 30*24*time.Hour-time.Second || got > 30*24*time.Hour+time.Second {
+		t.Errorf("got validity %v", got)
+	}
+
+	// A certificate can't outlive the CA.
+	shortCA := newTestCA(t, now.Add(24*time.Hour))
+	chain, err = signWithCA(shortCA, cc, key.Public(), now, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ = x509.ParseCertificate(chain[0])
+	if !leaf.NotAfter.Equal(shortCA.Leaf.NotAfter) {
+		t.Errorf("got not after %v, want the CA's %v", leaf.NotAfter, shortCA.Leaf.NotAfter)
+	}
+}
+
+// memoryCache is an autocert.Cache for tests.
+type memoryCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (m *memoryCache) Get(ctx context.Context, name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.data[name]
+	if !ok {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (m *memoryCache) Put(ctx context.Context, name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		m.data = make(map[string][]byte)
+	}
+	m.data[name] = data
+	return nil
+}
+
+func (m *memoryCache) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, name)
+	return nil
+}
+
+type testSigner struct {
+	ca    *certBundle
+	calls int
+}
+
+func (s *testSigner) sign(ctx context.Context, cc certificateConfig, key crypto.Signer) ([][]byte, error) {
+	s.calls++
+	return signWithCA(s.ca, cc, key.Public(), time.Now(), 30*24*time.Hour)
+}
+
+func TestSignedSource(t *testing.T) {
+	ctx := context.Background()
+	signer := &testSigner{ca: newTestCA(t, time.Now().Add(365*24*time.Hour))}
+	src := &signedSource{
+		Config: certificateConfig{Domain: "api.internal"},
+		Signer: signer,
+		Cache:  new(memoryCache),
+	}
+	// Handshakes before the first certificate don't count as failed
+	// issuances, which would back off and alert on every one.
+	backoffs = newBackoffTracker(new(memoryBackoffStore))
+	defer func() { backoffs = nil }()
+	getCert := instrumentGetCertificate(func(string) bool { return true }, func(string) string { return "" }, src.GetCertificate)
+	if _, err := getCert(&tls.ClientHelloInfo{ServerName: "api.internal"}); err == nil {
+		t.Fatal("expected an error before the first certificate")
+	}
+	if until, _ := backoffs.active("api.internal"); !until.IsZero() {
+		t.Errorf("handshake before the first certificate backed off until %v", until)
+	}
+
+	now := time.Now()
+	renewAt, err := src.ensure(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.calls != 1 {
+		t.Fatalf("got %d signatures, want 1", signer.calls)
+	}
+	if want := now.Add(20 * 24 * time.Hour); renewAt.Sub(want) > time.Hour || want.Sub(renewAt) > time.Hour {
+		t.Errorf("renewal at %v, want about %v", renewAt, want)
+	}
+	cert, err := src.GetCertificate(nil)
+	if err != nil || cert.Leaf.Subject.CommonName != "api.internal" {
+		t.Fatalf("got %v, %v", cert, err)
+	}
+
+	if _, err := src.ensure(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if signer.calls != 1 {
+		t.Errorf("cached certificate wasn't reused")
+	}
+	if _, err := src.ensure(ctx, renewAt.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if signer.calls != 2 {
+		t.Errorf("certificate wasn't renewed after its renewal time")
+	}
+	src.Config.DNSNames = []string{"api"}
+	if _, err := src.ensure(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if signer.calls != 3 {
+		t.Errorf("certificate wasn't reissued when its names changed")
+	}
+	cert, _ = src.GetCertificate(nil)
+	names := append([]string{}, cert.Leaf.DNSNames...)
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "api" {
+		t.Errorf("got names %v", names)
+	}
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"k8s.io/client-go/kubernetes"
+)
+
+// contactRetryInterval is how long to wait before trying again to update an
+// account contact.
+const contactRetryInterval = time.Hour
+
+// managedCertificate is a certificate we obtain and publish, and the source
+// that obtains it: an autocert.Manager for ACME issuers.
+type managedCertificate struct {
+	Config    certificateConfig
+	Issuer    issuerConfig
+	Fallbacks []issuerConfig
+
+	outputs  outputOptions
+	cache    *kubernetesCache
+	source   certificateSource
+	schedule renewalSchedule
+
+	// Stops a renewingSource.
+	cancel context.CancelFunc
+}
+
+// equal reports whether m and other would obtain and publish the same
+// certificate in the same way. Jitter is chosen afresh for each build, so
+// it's not compared.
+func (m *managedCertificate) equal(other *managedCertificate) bool {
+	return reflect.DeepEqual(m.Config, other.Config) && m.Issuer == other.Issuer &&
+		reflect.DeepEqual(m.Fallbacks, other.Fallbacks) && sameOutputs(m.outputs, other.outputs) &&
+		m.schedule.Window == other.schedule.Window && m.schedule.Stagger == other.schedule.Stagger
+}
+
+// sameSource reports whether m and other obtain the same certificate in the
+// same way, even if they publish it differently.
+func (m *managedCertificate) sameSource(other *managedCertificate) bool {
+	return reflect.DeepEqual(m.Config.withoutPublishing(), other.Config.withoutPublishing()) && m.Issuer == other.Issuer &&
+		reflect.DeepEqual(m.Fallbacks, other.Fallbacks) &&
+		m.schedule.Window == other.schedule.Window && m.schedule.Stagger == other.schedule.Stagger
+}
+
+// keepSource makes m use old's source, which is already running, instead of
+// the one it was built with. old's caches hand everything on to m's, so the
+// source's certificates are published m's way.
+func (m *managedCertificate) keepSource(old *managedCertificate) {
+	next := m.caches()
+	for i, c := range old.caches() {
+		c.forward(next[i])
+	}
+	m.source, m.cancel = old.source, old.cancel
+}
+
+// stop stops the certificate's renewals, and retires its caches so that
+// autocert Managers, which can't be stopped, don't publish anything.
+func (m *managedCertificate) stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	for _, c := range m.caches() {
+		c.retire()
+	}
+}
+
+// caches returns the caches the certificate may be in: one per issuer.
+func (m *managedCertificate) caches() []*kubernetesCache {
+	if f, ok := m.source.(*failoverSource); ok {
+		return f.caches()
+	}
+	return []*kubernetesCache{m.cache}
+}
+
+// sameOutputs compares output options by the contents of their secret
+// templates, rather than the parsed templates.
+func sameOutputs(a, b outputOptions) bool {
+	if !reflect.DeepEqual(a.Formats, b.Formats) || a.PasswordSecret != b.PasswordSecret || a.PasswordSecretKey != b.PasswordSecretKey {
+		return false
+	}
+	if a.Template == nil || b.Template == nil {
+		return a.Template == b.Template
+	}
+	return a.Template.Type == b.Template.Type && reflect.DeepEqual(a.Template.Data, b.Template.Data)
+}
+
+// onDemandRoute obtains certificates for names that match an on-demand
+// route but aren't configured.
+type onDemandRoute struct {
+	Config routeConfig
+	Issuer issuerConfig
+
+	source certificateSource
+}
+
+// stop stops the route's manager from ordering or renewing certificates.
+func (r *onDemandRoute) stop() {
+	if s, ok := r.source.(*onDemandSource); ok {
+		s.Cache.retire()
+	}
+}
+
+// certificateSet is the set of managed certificates, keyed by domain. It
+// picks the certificate to serve for each TLS handshake and the manager to
+// answer each http-01 challenge, and can be changed while we're serving.
+// Names that aren't configured go to the first on-demand route that matches.
+type certificateSet struct {
+	mu     sync.RWMutex
+	certs  map[string]*managedCertificate
+	routes []*onDemandRoute
+}
+
+func newCertificateSet() *certificateSet {
+	return &certificateSet{certs: make(map[string]*managedCertificate)}
+}
+
+// lookup returns the certificate for the server name, or nil.
+func (s *certificateSet) lookup(name string) *managedCertificate {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certs[name]
+}
+
+// lookupRoute returns the on-demand route for a server name that isn't
+// configured, or nil.
+func (s *certificateSet) lookupRoute(name string) *onDemandRoute {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.routes {
+		if r.Config.matches(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// sources returns every certificate source, configured certificates first.
+func (s *certificateSet) sources() []certificateSource {
+	var out []certificateSource
+	for _, m := range s.list() {
+		out = append(out, m.source)
+	}
+	s.mu.RLock()
+	for _, r := range s.routes {
+		out = append(out, r.source)
+	}
+	s.mu.RUnlock()
+	return out
+}
+
+// managed reports whether we have a certificate for name.
+func (s *certificateSet) managed(name string) bool {
+	return s.lookup(name) != nil
+}
+
+// backoffScope returns the scope backoff state for a handshake for name is
+// kept under, which depends on the issuer the certificate is coming from.
+func (s *certificateSet) backoffScope(name string) string {
+	if m := s.lookup(name); m != nil {
+		if f, ok := m.source.(*failoverSource); ok {
+			return f.backoffScope()
+		}
+	}
+	return ""
+}
+
+// list returns the certificates, sorted by domain.
+func (s *certificateSet) list() []*managedCertificate {
+	s.mu.RLock()
+	out := make([]*managedCertificate, 0, len(s.certs))
+	for _, m := range s.certs {
+		out = append(out, m)
+	}
+	s.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Config.Domain < out[j].Config.Domain })
+	return out
+}
+
+// GetCertificate is a tls.Config.GetCertificate that hands the handshake to
+// the manager for its server name.
+func (s *certificateSet) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if strings.HasSuffix(strings.TrimSuffix(hello.ServerName, "."), ".acme.invalid") {
+		// tls-sni challenges don't name the domain being validated, so ask
+		// every manager for the token certificate.
+		for _, src := range s.sources() {
+			if cert, err := src.GetCertificate(hello); err == nil {
+				return cert, nil
+			}
+		}
+		return nil, fmt.Errorf("no token certificate for %q", hello.ServerName)
+	}
+	if m := s.lookup(hello.ServerName); m != nil {
+		return m.source.GetCertificate(hello)
+	}
+	if r := s.lookupRoute(hello.ServerName); r != nil {
+		return r.source.GetCertificate(hello)
+	}
+	return nil, fmt.Errorf("no certificate configured for %q", hello.ServerName)
+}
+
+// HTTPHandler answers http-01 challenges with the manager for the request's
+// host, and passes everything else to fallback.
+func (s *certificateSet) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if m := s.lookup(host); m != nil {
+			m.source.HTTPHandler(fallback).ServeHTTP(w, r)
+			return
+		}
+		if route := s.lookupRoute(host); route != nil {
+			route.source.HTTPHandler(fallback).ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// certificateChanges lists the domains apply added, reconfigured and
+// removed.
+type certificateChanges struct {
+	Added, Updated, Removed []string
+
+	// The certificates that were rebuilt or removed, and need stopping.
+	old []*managedCertificate
+}
+
+// apply makes the set match certs, using build for certificates that are new
+// or configured differently. A certificate that fails to build is left as it
+// was, and the errors are returned with the changes that were made.
+func (s *certificateSet) apply(certs []certificateConfig, build func(certificateConfig) (*managedCertificate, error)) (certificateChanges, error) {
+	var changes certificateChanges
+	var errs []string
+	next := make(map[string]*managedCertificate, len(certs))
+	s.mu.RLock()
+	current := s.certs
+	s.mu.RUnlock()
+	for _, cc := range certs {
+		old := current[cc.Domain]
+		m, err := build(cc)
+		if err != nil {
+			errs = append(errs, err.Error())
+			if old != nil {
+				next[cc.Domain] = old
+			}
+			continue
+		}
+		switch {
+		case old == nil:
+			changes.Added = append(changes.Added, cc.Domain)
+		case old.equal(m):
+			m = old
+		case old.sameSource(m):
+			// Only how it's published changed, so don't start over.
+			m.keepSource(old)
+			changes.Updated = append(changes.Updated, cc.Domain)
+		default:
+			changes.Updated = append(changes.Updated, cc.Domain)
+			changes.old = append(changes.old, old)
+		}
+		next[cc.Domain] = m
+	}
+	for domain, old := range current {
+		if _, ok := next[domain]; !ok {
+			changes.Removed = append(changes.Removed, domain)
+			changes.old = append(changes.old, old)
+		}
+	}
+	sort.Strings(changes.Removed)
+	s.mu.Lock()
+	s.certs = next
+	s.mu.Unlock()
+	if len(errs) > 0 {
+		return changes, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return changes, nil
+}
+
+// applyRoutes replaces the on-demand routes with routes, using build for
+// the ones that are new or configured differently, so existing routes keep
+// their managers. It returns the routes that were dropped, which the caller
+// should stop.
+func (s *certificateSet) applyRoutes(routes []routeConfig, issuers map[string]*issuerConfig, build func(routeConfig) certificateSource) (dropped []*onDemandRoute) {
+	s.mu.RLock()
+	current := s.routes
+	s.mu.RUnlock()
+	var next []*onDemandRoute
+	for _, rc := range routes {
+		if !rc.OnDemand {
+			continue
+		}
+		r := &onDemandRoute{Config: rc, Issuer: *issuers[rc.Issuer]}
+		for _, old := range current {
+			if reflect.DeepEqual(old.Config, r.Config) && old.Issuer == r.Issuer {
+				r = old
+				break
+			}
+		}
+		if r.source == nil {
+			r.source = build(rc)
+		}
+		next = append(next, r)
+	}
+	s.mu.Lock()
+	s.routes = next
+	s.mu.Unlock()
+	for _, old := range current {
+		kept := false
+		for _, r := range next {
+			kept = kept || r == old
+		}
+		if !kept {
+			dropped = append(dropped, old)
+		}
+	}
+	return dropped
+}
+
+// generator builds managed certificates from the configuration.
+type generator struct {
+	Client kubernetes.Interface
+	// Namespace of the kubeconfig context, used if the configuration
+	// doesn't set one.
+	ContextNamespace string
+
+	DryRun  bool
+	Promote bool
+	// Where dry runs report what they would have changed.
+	Out io.Writer
+
+	contactsMu sync.Mutex
+	// The email each ACME directory's account contact was last synced to,
+	// and the email it's being synced to, if an update hasn't succeeded yet.
+	contacts        map[string]string
+	pendingContacts map[string]string
+	// Limits new orders from on-demand routes. Policies can't change on
+	// reload, so it's made on the first sync.
+	onDemandOrders *orderLimiter
+}
+
+// prepare fills in the namespace and applies -dry-run and -promote, which
+// switch Let's Encrypt issuers between staging and production, to a
+// validated configuration.
+func (g *generator) prepare(c *generatorConfig) error {
+	if c.Namespace == "" {
+		c.Namespace = g.ContextNamespace
+	}
+	c.Namespace = defaultNamespace(c.Namespace)
+	if g.DryRun {
+		for _, ic := range c.Issuers {
+			if ic.directoryURL() == acme.LetsEncryptURL {
+				ic.DirectoryURL, ic.Staging = "", true
+			}
+		}
+	}
+	if !g.Promote {
+		return nil
+	}
+	validations, err := loadStagingValidations(g.Client, c.Namespace, c.CacheSecret)
+	if err != nil {
+		return fmt.Errorf("could not read staging validations: %v", err)
+	}
+	for _, cc := range c.Certificates {
+		if c.issuer(cc).directoryURL() != letsEncryptStagingURL {
+			continue
+		}
+		outputs, err := cc.outputOptions()
+		if err != nil {
+			return err
+		}
+		if err := checkPromotion(validations, cc.Domain, configFingerprint(cc.Domain, cc.IngressSecret, outputs)); err != nil {
+			return err
+		}
+		logger.Info("promoting to production", "domain", cc.Domain, "validated", validations[cc.Domain].Time)
+	}
+	for _, ic := range c.Issuers {
+		if ic.directoryURL() == letsEncryptStagingURL {
+			ic.DirectoryURL, ic.Staging = "", false
+		}
+	}
+	return nil
+}
+
+// newCertificate returns a managed certificate for cc, which must be one of
+// c's certificates.
+func (g *generator) newCertificate(c *generatorConfig, cc certificateConfig) (*managedCertificate, error) {
+	outputs, err := cc.outputOptions()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cc.Domain, err)
+	}
+	issuer := c.issuer(cc)
+	directoryURL := issuer.directoryURL()
+	cache := newKubernetesCache(c.CacheSecret, cc.IngressSecret, c.Namespace, cc.Domain, directoryURL, g.Client, 1, outputs, cc.RestartWorkloads)
+	cache.AccountSecretName = c.AccountSecret
+	var managerCache autocert.Cache = cache
+	if g.DryRun {
+		managerCache = newDryRunCache(cache, g.Out)
+	}
+	m := &managedCertificate{
+		Config:   cc,
+		Issuer:   *issuer,
+		outputs:  outputs,
+		cache:    cache,
+		schedule: c.newRenewalSchedule(cc),
+	}
+	switch issuer.Type {
+	case issuerCA:
+		ns, name := splitSecretRef(issuer.CASecret, c.Namespace)
+		m.source = &signedSource{
+			Config:   cc,
+			Signer:   &caSigner{Client: g.Client, Namespace: ns, SecretName: name, Validity: issuer.Validity.Duration},
+			Cache:    managerCache,
+			Schedule: m.schedule,
+		}
+	case issuerCSR:
+		var signer certificateSigner = &csrSigner{Client: g.Client, AutoApprove: issuer.AutoApprove, ApprovalTimeout: issuer.ApprovalTimeout.Duration}
+		if g.DryRun {
+			signer = &dryRunCSRSigner{Out: g.Out}
+		}
+		m.source = &signedSource{Config: cc, Signer: signer, Cache: managerCache, Schedule: m.schedule}
+	default:
+		if len(cc.FallbackIssuers) > 0 && !g.DryRun {
+			m.source = g.newFailoverSource(c, cc, m)
+			break
+		}
+		m.source = newACMEManager(issuer, autocert.HostWhitelist(cc.Domain), managerCache, newCertificateACMEHTTPClient(cache.isRetired), acmeRenewBefore(m.schedule, cache))
+	}
+	return m, nil
+}
+
+// newFailoverSource returns the source for a certificate with fallback
+// issuers, and records their configuration in m. Dry runs only use the
+// primary issuer.
+func (g *generator) newFailoverSource(c *generatorConfig, cc certificateConfig, m *managedCertificate) *failoverSource {
+	f := &failoverSource{
+		Domain: cc.Domain,
+		Policy: failoverPolicy{
+			FailoverAfter:   c.Policies.FailoverAfter.Duration,
+			EmergencyWindow: c.Policies.EmergencyWindow.Duration,
+			RenewBefore:     acmeRenewBefore(m.schedule, m.cache),
+		},
+	}
+	for i, name := range append([]string{cc.Issuer}, cc.FallbackIssuers...) {
+		issuer := c.Issuers[name]
+		cache := m.cache
+		if i > 0 {
+			m.Fallbacks = append(m.Fallbacks, *issuer)
+			cache = newKubernetesCache(c.CacheSecret, cc.IngressSecret, c.Namespace, cc.Domain, issuer.directoryURL(), g.Client, 1, m.outputs, cc.RestartWorkloads)
+			cache.AccountSecretName = c.AccountSecret
+			cache.backoffScope = name
+		}
+		f.Candidates = append(f.Candidates, &failoverCandidate{
+			Issuer: name,
+			cache:  cache,
+			source: newACMEManager(issuer, autocert.HostWhitelist(cc.Domain), cache, newFailoverACMEHTTPClient(cache.backoffScope, f.standby(i), cache.isRetired), f.Policy.RenewBefore),
+		})
+	}
+	return f
+}
+
+// newACMEManager returns an autocert.Manager for an ACME issuer. A zero
+// renewBefore is autocert's default.
+func newACMEManager(issuer *issuerConfig, policy autocert.HostPolicy, cache autocert.Cache, client *http.Client, renewBefore time.Duration) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  policy,
+		Cache:       cache,
+		Email:       issuer.Email,
+		RenewBefore: renewBefore,
+		Client: &acme.Client{
+			DirectoryURL: issuer.directoryURL(),
+			HTTPClient:   client,
+		},
+	}
+}
+
+// newOnDemandSource returns the source for an on-demand route. Certificates
+// are kept in the cache secret but not published, so the cache has no domain
+// or ingress secret.
+func (g *generator) newOnDemandSource(c *generatorConfig, rc routeConfig) certificateSource {
+	issuer := c.Issuers[rc.Issuer]
+	directoryURL := issuer.directoryURL()
+	cache := newKubernetesCache(c.CacheSecret, "", c.Namespace, "", directoryURL, g.Client, 1, outputOptions{}, false)
+	cache.AccountSecretName = c.AccountSecret
+	if g.onDemandOrders == nil {
+		g.onDemandOrders = &orderLimiter{PerHour: c.Policies.OnDemandOrdersPerHour}
+	}
+	max := rc.MaxCertificates
+	if max == 0 {
+		max = defaultOnDemandMaxCertificates
+	}
+	policy := func(ctx context.Context, host string) error {
+		if !rc.matches(host) {
+			return fmt.Errorf("%s doesn't match the route for %s", host, strings.Join(rc.Hosts, ", "))
+		}
+		logger.Info("obtaining certificate on demand", "domain", host, "issuer", rc.Issuer, "directory", directoryURL)
+		return nil
+	}
+	schedule := renewalSchedule{Window: c.renewWindow(certificateConfig{Issuer: rc.Issuer})}
+	return &onDemandSource{
+		Route:   rc,
+		Max:     max,
+		Orders:  g.onDemandOrders,
+		Cache:   cache,
+		manager: newACMEManager(issuer, policy, cache, newCertificateACMEHTTPClient(cache.isRetired), acmeRenewBefore(schedule, nil)),
+	}
+}
+
+// splitSecretRef splits a secret reference, as name or namespace/name.
+func splitSecretRef(ref, defaultNamespace string) (namespace, name string) {
+	if parts := strings.SplitN(ref, "/", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return defaultNamespace, ref
+}
+
+// start does what's needed when a certificate is added or rebuilt: tracking
+// its status, adopting an existing certificate and starting a dry run.
+func (g *generator) start(ctx context.Context, m *managedCertificate) {
+	cc := m.Config
+	certStatus.add(cc.Domain, cc.IngressSecret)
+	certStatus.setSchedule(cc.Domain, m.schedule)
+	logger.Info("managing certificate", "domain", cc.Domain, "issuer", cc.Issuer, "directory", m.Issuer.directoryURL(), "secret", cc.IngressSecret)
+	if cc.AdoptSecret != "" && !g.DryRun {
+		ns, name := splitSecretRef(cc.AdoptSecret, m.cache.Namespace)
+		// Serving a new certificate is better than not starting, so this
+		// isn't fatal.
+		if err := adoptCertificate(ctx, m.cache, ns, name); err != nil {
+			logger.Error("could not adopt certificate", "domain", cc.Domain, "secret", cc.AdoptSecret, "err", err)
+		}
+	}
+	if src, ok := m.source.(renewingSource); ok {
+		if m.cancel == nil {
+			runCtx, cancel := context.WithCancel(ctx)
+			m.cancel = cancel
+			go src.run(runCtx)
+		}
+	} else if g.DryRun {
+		go dryRunIssue(m.source.GetCertificate, cc.Domain)
+	}
+}
+
+// forget forgets a certificate that is no longer configured. Its secrets are
+// left alone.
+func (g *generator) forget(domain string) {
+	certStatus.remove(domain)
+	certNotAfter.Delete(domain)
+	certExpiry.Delete(domain)
+	logger.Info("no longer managing certificate", "domain", domain)
+}
+
+// sync makes set match c, starting and stopping certificates as needed.
+func (g *generator) sync(ctx context.Context, set *certificateSet, c *generatorConfig) error {
+	changes, err := set.apply(c.Certificates, func(cc certificateConfig) (*managedCertificate, error) {
+		return g.newCertificate(c, cc)
+	})
+	for _, old := range changes.old {
+		old.stop()
+	}
+	for _, domain := range append(changes.Added, changes.Updated...) {
+		if m := set.lookup(domain); m != nil {
+			g.start(ctx, m)
+		}
+	}
+	for _, domain := range changes.Removed {
+		g.forget(domain)
+	}
+	routes := c.Routes
+	if g.DryRun {
+		// Nothing would be published, so there's nothing to show.
+		routes = nil
+	}
+	dropped := set.applyRoutes(routes, c.Issuers, func(rc routeConfig) certificateSource {
+		return g.newOnDemandSource(c, rc)
+	})
+	for _, r := range dropped {
+		r.stop()
+	}
+	if !g.DryRun {
+		g.syncContacts(ctx, c)
+	}
+	notifications.setRecipients(c)
+	return err
+}
+
+// syncContacts updates the account contacts of c's ACME issuers, in the
+// background, when their email has changed since the last sync. Failed
+// updates are retried until they succeed or the email changes again.
+func (g *generator) syncContacts(ctx context.Context, c *generatorConfig) {
+	g.contactsMu.Lock()
+	defer g.contactsMu.Unlock()
+	if g.contacts == nil {
+		g.contacts = make(map[string]string)
+		g.pendingContacts = make(map[string]string)
+	}
+	for name, issuer := range c.Issuers {
+		if issuer.Type != issuerACME {
+			continue
+		}
+		directoryURL := issuer.directoryURL()
+		if synced, ok := g.contacts[directoryURL]; ok && synced == issuer.Email {
+			delete(g.pendingContacts, directoryURL)
+			continue
+		}
+		if pending, ok := g.pendingContacts[directoryURL]; ok && pending == issuer.Email {
+			continue
+		}
+		g.pendingContacts[directoryURL] = issuer.Email
+		cache := newKubernetesCache(c.CacheSecret, "", c.Namespace, "", directoryURL, g.Client, 1, outputOptions{}, false)
+		cache.AccountSecretName = c.AccountSecret
+		go g.syncContact(ctx, name, cache, issuer.Email)
+	}
+}
+
+// syncContact updates the contact of the account for cache's directory to
+// email, retrying until it succeeds, ctx is done or another email is wanted.
+func (g *generator) syncContact(ctx context.Context, issuer string, cache *kubernetesCache, email string) {
+	directoryURL := cache.directoryURL
+	for {
+		err := syncAccountContact(ctx, cache, email)
+		g.contactsMu.Lock()
+		if g.pendingContacts[directoryURL] != email {
+			// A later sync wants another email and has its own update.
+			g.contactsMu.Unlock()
+			return
+		}
+		if err == nil {
+			g.contacts[directoryURL] = email
+			delete(g.pendingContacts, directoryURL)
+			g.contactsMu.Unlock()
+			return
+		}
+		g.contactsMu.Unlock()
+		logger.Warn("could not update account contact", "issuer", issuer, "directory", directoryURL, "retry_in", contactRetryInterval, "err", err)
+		select {
+		case <-ctx.Done():
+			g.contactsMu.Lock()
+			if g.pendingContacts[directoryURL] == email {
+				delete(g.pendingContacts, directoryURL)
+			}
+			g.contactsMu.Unlock()
+			return
+		case <-time.After(contactRetryInterval):
+		}
+	}
+}
+
+// fileHash returns a hash of the file at path, to tell when it changes.
+// ConfigMap volumes are updated by swapping symlinks, so modification times
+// aren't reliable.
+func fileHash(path string) ([sha256.Size]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// watchConfig calls reload whenever the file at path changes, checking every
+// interval, or the process gets SIGHUP, until ctx is done. An interval of 0
+// only reloads on SIGHUP.
+func watchConfig(ctx context.Context, path string, interval time.Duration, reload func(reason string)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last, _ := fileHash(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			last, _ = fileHash(path)
+			reload("SIGHUP")
+		case <-tick:
+			sum, err := fileHash(path)
+			if err != nil {
+				logger.Warn("could not read config file", "path", path, "err", err)
+				continue
+			}
+			if sum != last {
+				last = sum
+				reload("file changed")
+			}
+		}
+	}
+}
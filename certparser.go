@@ -5,7 +5,9 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -77,3 +79,138 @@ func getPrivPubBytes(data []byte) ([]byte, []byte, error) {
 	}
 	return buf.Bytes(), pubCopy, nil
 }
+
+// certBundle is a parsed copy of the data acme/autocert stores for a
+// certificate: a private key followed by the leaf certificate and any
+// intermediates.
+type certBundle struct {
+	Key   crypto.Signer
+	Leaf  *x509.Certificate
+	Chain []*x509.Certificate // Chain[0] is Leaf
+
+	// PEM encodings of the pieces above, in the same format they were
+	// stored in.
+	KeyPEM   []byte
+	CertsPEM []byte
+}
+
+// parseCertBundle splits data into its private key and certificate chain,
+// and checks that the key matches the leaf certificate.
+func parseCertBundle(data []byte) (*certBundle, error) {
+	keyPEM, certsPEM, err := getPrivPubBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	b := &certBundle{Key: key, KeyPEM: keyPEM, CertsPEM: certsPEM}
+	rest := certsPEM
+	for len(rest) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block %q in certificate chain", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		b.Chain = append(b.Chain, cert)
+	}
+	if len(b.Chain) == 0 {
+		return nil, errors.New("no certificates found after private key")
+	}
+	b.Leaf = b.Chain[0]
+	if !publicKeysEqual(b.Leaf.PublicKey, key.Public()) {
+		return nil, errors.New("private key does not match public key in leaf certificate")
+	}
+	return b, nil
+}
+
+// errNoCertificates is returned by parseCertificates for data without any.
+var errNoCertificates = errors.New("no certificates found")
+
+// parseCertificates returns the certificates in data: every CERTIFICATE block
+// if it's PEM, ignoring anything else such as keys, or else a DER encoded
+// certificate or chain.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	sawPEM := false
+	for rest := data; len(rest) > 0; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		sawPEM = true
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if !sawPEM && len(data) > 0 {
+		if der, err := x509.ParseCertificates(data); err == nil {
+			certs = der
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errNoCertificates
+	}
+	return certs, nil
+}
+
+// Intermediates returns the certificates in the chain after the leaf.
+func (b *certBundle) Intermediates() []*x509.Certificate {
+	return b.Chain[1:]
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	switch a := a.(type) {
+	case *rsa.PublicKey:
+		b, ok := b.(*rsa.PublicKey)
+		return ok && a.N.Cmp(b.N) == 0 && a.E == b.E
+	case *ecdsa.PublicKey:
+		b, ok := b.(*ecdsa.PublicKey)
+		return ok && a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
+	default:
+		return false
+	}
+}
+
+// Fingerprint returns the hex encoded SHA-256 hash of the leaf certificate.
+func (b *certBundle) Fingerprint() string {
+	return fingerprint(b.Leaf)
+}
+
+// fingerprint returns the hex encoded SHA-256 hash of cert.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyType returns a short description of the private key, e.g. "ECDSA P-256"
+// or "RSA 2048".
+func (b *certBundle) KeyType() string {
+	return keyType(b.Key.Public())
+}
+
+func keyType(pub crypto.PublicKey) string {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + pub.Curve.Params().Name
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"golang.org/x/crypto/acme"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// envPrefix is the prefix of environment variables that override settings in
+// the config file.
+const envPrefix = "K8S_CERT_GENERATOR_"
+
+// generatorConfig is the configuration file passed to -config. It's YAML or
+// JSON, e.g.
+//
+//	namespace: web
+//	issuers:
+//	  letsencrypt:
+//	    email: ops@example.com
+//	certificates:
+//	- domain: example.com
+//	  ingressSecret: example-com-tls
+//	- domain: shop.example.com
+//	  ingressSecret: shop-tls
+//	  outputFormats: [pkcs12]
+//	  keystorePasswordSecret: shop-keystore
+//
+// Without -config, the same structure is built from the command line flags.
+type generatorConfig struct {
+	// Namespace holding the cache and ingress secrets.
+	Namespace   string `json:"namespace"`
+	CacheSecret string `json:"cacheSecret"`
+	// AccountSecret, if set, holds the ACME account keys instead of the
+	// cache secret, so access to them can be restricted further.
+	AccountSecret string `json:"accountSecret"`
+	// Object to record Kubernetes Events against, as Kind/name. The default
+	// is the ingress secret if there's one certificate, and the cache secret
+	// otherwise.
+	EventsFor string `json:"eventsFor"`
+
+	Listen        listenConfig             `json:"listen"`
+	Issuers       map[string]*issuerConfig `json:"issuers"`
+	Routes        []routeConfig            `json:"routes"`
+	Certificates  []certificateConfig      `json:"certificates"`
+	Policies      policyConfig             `json:"policies"`
+	Watchdog      watchdogConfig           `json:"watchdog"`
+	Notifications notificationConfig       `json:"notifications"`
+
+	// How often to check the file for changes. Set to 0 to only reload on
+	// SIGHUP.
+	ReloadInterval duration `json:"reloadInterval"`
+}
+
+type listenConfig struct {
+	HTTPPort int `json:"httpPort"`
+	TLSPort  int `json:"tlsPort"`
+	// Set to 0 to disable.
+	HealthPort  int `json:"healthPort"`
+	MetricsPort int `json:"metricsPort"`
+}
+
+// Issuer types.
+const (
+	issuerACME = "acme"
+	issuerCA   = "ca"
+	issuerCSR  = "csr"
+)
+
+// defaultCAValidity is how long certificates signed by a ca issuer are valid
+// for, unless it says otherwise.
+const defaultCAValidity = 90 * 24 * time.Hour
+
+// defaultCSRApprovalTimeout is how long a csr issuer waits for a request to
+// be approved and signed, unless it says otherwise.
+const defaultCSRApprovalTimeout = time.Hour
+
+// issuerConfig describes a CA certificates are requested from.
+type issuerConfig struct {
+	// Type is the kind of issuer: "acme", the default, "ca" to sign
+	// certificates with a CA keypair kept in a secret, or "csr" to have the
+	// cluster CA sign them through the certificates.k8s.io API.
+	Type string `json:"type"`
+
+	// DirectoryURL is the ACME directory. The default is Let's Encrypt
+	// production, or staging if Staging is set.
+	DirectoryURL string `json:"directoryURL"`
+	Staging      bool   `json:"staging"`
+	Email        string `json:"email"`
+
+	// CASecret is the kubernetes.io/tls secret, as name or namespace/name,
+	// holding the CA certificate and key for a ca issuer.
+	CASecret string `json:"caSecret"`
+	// Validity is how long certificates a ca issuer signs are valid for.
+	Validity duration `json:"validity"`
+
+	// AutoApprove makes a csr issuer approve its own requests, rather than
+	// wait for an administrator or controller to.
+	AutoApprove bool `json:"autoApprove"`
+	// ApprovalTimeout is how long a csr issuer waits for a request to be
+	// approved and signed before giving up and trying again later.
+	ApprovalTimeout duration `json:"approvalTimeout"`
+}
+
+// routeConfig sends hostnames matching Hosts to an issuer. Routes are tried
+// in order and the first match wins.
+type routeConfig struct {
+	// Hosts are hostnames or patterns: "*.example.com" matches any name
+	// under example.com, and "*" matches everything.
+	Hosts  []string `json:"hosts"`
+	Issuer string   `json:"issuer"`
+	// OnDemand obtains certificates for matching names that aren't in
+	// certificates, on their first TLS handshake, like autocert does. They're
+	// served from the TLS port and kept in the cache secret, but not
+	// published to an ingress secret. Only ACME issuers can be used.
+	OnDemand bool `json:"onDemand"`
+	// MaxCertificates is how many names an on-demand route obtains
+	// certificates for. The default is 100.
+	MaxCertificates int `json:"maxCertificates"`
+}
+
+// matches reports whether the route covers name, which must be lowercase.
+func (rc *routeConfig) matches(name string) bool {
+	for _, pattern := range rc.Hosts {
+		if hostMatches(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches reports whether name matches a route pattern.
+func hostMatches(pattern, name string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(name, pattern[1:])
+	default:
+		return name == pattern
+	}
+}
+
+// certificateConfig describes a certificate to obtain and where to publish
+// it.
+type certificateConfig struct {
+	Domain string `json:"domain"`
+	// Issuer is the name of an entry in the issuers map. It can be left out
+	// if a route matches the domain, or there's only one.
+	Issuer string `json:"issuer"`
+	// FallbackIssuers are ACME issuers to try, in order, when Issuer is
+	// failing. See policyConfig.
+	FallbackIssuers []string `json:"fallbackIssuers"`
+	IngressSecret   string   `json:"ingressSecret"`
+	// RenewBefore overrides policies.renewBefore.
+	RenewBefore renewWindow `json:"renewBefore"`
+	// NotifyEmail are more addresses to email this certificate's alerts
+	// and digests to, on top of notifications.email.to.
+	NotifyEmail []string `json:"notifyEmail"`
+
+	// Extra subject alternative names and extended key usages ("server",
+	// "client"), for certificates from ca and csr issuers. Domain is always one of
+	// the names, and the default usage is server.
+	DNSNames    []string `json:"dnsNames"`
+	IPAddresses []string `json:"ipAddresses"`
+	Usages      []string `json:"usages"`
+
+	OutputFormats          []string `json:"outputFormats"`
+	KeystorePasswordSecret string   `json:"keystorePasswordSecret"`
+	KeystorePasswordKey    string   `json:"keystorePasswordKey"`
+	SecretTemplate         string   `json:"secretTemplate"` // path to a secret template file
+
+	RestartWorkloads bool `json:"restartWorkloads"`
+	// kubernetes.io/tls secret, as name or namespace/name, to import on
+	// startup if no certificate is cached.
+	AdoptSecret string `json:"adoptSecret"`
+}
+
+// withoutPublishing returns cc without the settings for how the certificate
+// is published and who is told about it, leaving those for how it's
+// obtained.
+func (cc certificateConfig) withoutPublishing() certificateConfig {
+	cc.IngressSecret = ""
+	cc.NotifyEmail = nil
+	cc.OutputFormats = nil
+	cc.KeystorePasswordSecret, cc.KeystorePasswordKey = "", ""
+	cc.SecretTemplate = ""
+	cc.RestartWorkloads = false
+	cc.AdoptSecret = ""
+	return cc
+}
+
+type policyConfig struct {
+	// Report not ready when a certificate expires within this window.
+	CriticalExpiry duration `json:"criticalExpiry"`
+	// For certificates with fallback issuers: move to the next issuer when
+	// the current one has been failing for FailoverAfter, or at once if it's
+	// failing and the certificate expires within EmergencyWindow.
+	FailoverAfter   duration `json:"failoverAfter"`
+	EmergencyWindow duration `json:"emergencyWindow"`
+	// How long before expiry to renew: a duration, or a fraction of the
+	// lifetime like "33%". The default is 30 days for ACME issuers and a
+	// third of the lifetime for the others.
+	RenewBefore renewWindow `json:"renewBefore"`
+	// Each certificate is renewed up to RenewJitter earlier, chosen at
+	// random, and certificates are spread over RenewStagger by a hash of
+	// their domain, so a lot of certificates issued at once aren't all
+	// renewed at once.
+	RenewJitter  duration `json:"renewJitter"`
+	RenewStagger duration `json:"renewStagger"`
+	// How many certificates every on-demand route together may order per
+	// hour.
+	OnDemandOrdersPerHour int `json:"onDemandOrdersPerHour"`
+}
+
+// watchdogConfig configures the scan of every TLS secret in the cluster,
+// whoever issued it. See watchdog.go.
+type watchdogConfig struct {
+	// How often to scan. 0 disables the watchdog.
+	Interval duration `json:"interval"`
+	// Namespaces to scan. The default is every namespace.
+	Namespaces []string `json:"namespaces"`
+	// Opaque secrets matching OpaqueSelector, a label selector, are scanned
+	// too, for certificates under keys matching OpaqueKeys, e.g. "*.crt".
+	// Without a selector no Opaque secrets are scanned.
+	OpaqueSelector string   `json:"opaqueSelector"`
+	OpaqueKeys     []string `json:"opaqueKeys"`
+	// RSA keys smaller than this are reported as weak.
+	MinRSABits int `json:"minRSABits"`
+}
+
+// notificationConfig configures where notifications about certificates are
+// sent. See notify.go.
+type notificationConfig struct {
+	Webhooks []webhookConfig `json:"webhooks"`
+	Email    emailConfig     `json:"email"`
+	// A certificate is notified as expiring once as it crosses each
+	// threshold, e.g. 14, 7 and 1 days before it expires.
+	ExpiryThresholds []duration `json:"expiryThresholds"`
+	// An ongoing failure is notified again at most this often. 0 notifies it
+	// once, until it's resolved.
+	RepeatInterval duration `json:"repeatInterval"`
+}
+
+// emailConfig is the SMTP server alerts are emailed through. Email is off
+// without a Host.
+type emailConfig struct {
+	Host string `json:"host"`
+	// Port defaults to 465 with implicit TLS, and 587 otherwise.
+	Port int `json:"port"`
+	// TLS is "starttls", the default, "implicit" or "none".
+	TLS string `json:"tls"`
+	// Environment variables holding the credentials, if the server needs
+	// them.
+	UsernameEnv string   `json:"usernameEnv"`
+	PasswordEnv string   `json:"passwordEnv"`
+	From        string   `json:"from"`
+	To          []string `json:"to"`
+	// Events emailed as they happen. The default is failures and expiry.
+	Events []string `json:"events"`
+	// Every DigestInterval, each recipient is sent a digest of their
+	// certificates that are failing or expire within DigestExpiry. 0
+	// disables digests.
+	DigestInterval duration `json:"digestInterval"`
+	DigestExpiry   duration `json:"digestExpiry"`
+}
+
+// webhookConfig is an HTTP endpoint notifications are posted to.
+type webhookConfig struct {
+	Name string `json:"name"`
+	// URL, or the environment variable holding it, for URLs that are
+	// secrets themselves like Slack's.
+	URL    string `json:"url"`
+	URLEnv string `json:"urlEnv"`
+	// Format of the body: "generic" JSON, the default, "slack" or "teams".
+	// Template, a text/template executed against the notification,
+	// replaces it.
+	Format   string `json:"format"`
+	Template string `json:"template"`
+	// Events to send. The default is all of them.
+	Events []string `json:"events"`
+	// HMACKeyEnv names an environment variable holding a key to sign bodies
+	// with.
+	HMACKeyEnv string            `json:"hmacKeyEnv"`
+	Headers    map[string]string `json:"headers"`
+}
+
+// duration is a time.Duration that's written as a string like "168h" in
+// config files.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"72h\", got %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// defaultConfig returns a configuration with the defaults that the file
+// overrides.
+func defaultConfig() *generatorConfig {
+	return &generatorConfig{
+		CacheSecret: "acme.secret",
+		Listen: listenConfig{
+			HTTPPort:    8442,
+			TLSPort:     8443,
+			HealthPort:  8081,
+			MetricsPort: 9090,
+		},
+		Policies: policyConfig{
+			CriticalExpiry:        duration{7 * 24 * time.Hour},
+			FailoverAfter:         duration{defaultFailoverAfter},
+			EmergencyWindow:       duration{defaultEmergencyWindow},
+			OnDemandOrdersPerHour: defaultOnDemandOrdersPerHour,
+		},
+		Watchdog: watchdogConfig{
+			OpaqueKeys: defaultOpaqueKeys,
+			MinRSABits: defaultMinRSABits,
+		},
+		Notifications: notificationConfig{
+			ExpiryThresholds: defaultExpiryThresholds,
+			RepeatInterval:   duration{defaultRepeatInterval},
+			Email: emailConfig{
+				Events:         defaultEmailEvents,
+				DigestInterval: duration{defaultDigestInterval},
+				DigestExpiry:   duration{defaultExpiryWarning},
+			},
+		},
+		ReloadInterval: duration{30 * time.Second},
+	}
+}
+
+// parseConfig parses a YAML or JSON configuration. Unknown fields are an
+// error, so typos don't go unnoticed.
+func parseConfig(data []byte) (*generatorConfig, error) {
+	js, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	c := defaultConfig()
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	for name, ic := range c.Issuers {
+		if ic == nil {
+			c.Issuers[name] = new(issuerConfig)
+		}
+	}
+	return c, nil
+}
+
+// loadConfig reads the configuration file at path, applies overrides from the
+// environment and validates it.
+func loadConfig(path string) (*generatorConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// applyEnv overrides settings with K8S_CERT_GENERATOR_* environment
+// variables, as returned by lookup:
+//
+//	K8S_CERT_GENERATOR_NAMESPACE, K8S_CERT_GENERATOR_CACHE_SECRET
+//	K8S_CERT_GENERATOR_HTTP_PORT, _TLS_PORT, _HEALTH_PORT, _METRICS_PORT
+//	K8S_CERT_GENERATOR_CRITICAL_EXPIRY
+//	K8S_CERT_GENERATOR_EMAIL: the email of every ACME issuer
+//	K8S_CERT_GENERATOR_STAGING: use Let's Encrypt staging for every issuer
+//	that would use Let's Encrypt production, if true
+func (c *generatorConfig) applyEnv(lookup func(string) (string, bool)) error {
+	ints := map[string]*int{
+		"HTTP_PORT":    &c.Listen.HTTPPort,
+		"TLS_PORT":     &c.Listen.TLSPort,
+		"HEALTH_PORT":  &c.Listen.HealthPort,
+		"METRICS_PORT": &c.Listen.MetricsPort,
+	}
+	for name, p := range ints {
+		if v, ok := lookup(envPrefix + name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s%s: %v", envPrefix, name, err)
+			}
+			*p = n
+		}
+	}
+	if v, ok := lookup(envPrefix + "NAMESPACE"); ok {
+		c.Namespace = v
+	}
+	if v, ok := lookup(envPrefix + "CACHE_SECRET"); ok {
+		c.CacheSecret = v
+	}
+	if v, ok := lookup(envPrefix + "ACCOUNT_SECRET"); ok {
+		c.AccountSecret = v
+	}
+	if v, ok := lookup(envPrefix + "CRITICAL_EXPIRY"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%sCRITICAL_EXPIRY: %v", envPrefix, err)
+		}
+		c.Policies.CriticalExpiry = duration{d}
+	}
+	// EMAIL and STAGING only mean something to ACME issuers, and validate
+	// rejects them on the others.
+	if v, ok := lookup(envPrefix + "EMAIL"); ok {
+		for _, ic := range c.Issuers {
+			if ic.isACME() {
+				ic.Email = v
+			}
+		}
+	}
+	if v, ok := lookup(envPrefix + "STAGING"); ok {
+		staging, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sSTAGING: %v", envPrefix, err)
+		}
+		for _, ic := range c.Issuers {
+			if staging && ic.isACME() && (ic.DirectoryURL == "" || ic.DirectoryURL == acme.LetsEncryptURL) {
+				ic.DirectoryURL = ""
+				ic.Staging = true
+			}
+		}
+	}
+	return nil
+}
+
+// configErrors is every problem found in a configuration.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+// validate checks the configuration and fills in defaults that depend on
+// other settings. It reports every problem, each prefixed with the path to
+// the setting.
+func (c *generatorConfig) validate() error {
+	var errs configErrors
+	addf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.CacheSecret == "" {
+		addf("cacheSecret: required")
+	}
+	if c.AccountSecret != "" && c.AccountSecret == c.CacheSecret {
+		addf("accountSecret: must not be the cache secret; leave it out to keep account keys there")
+	}
+	if c.EventsFor != "" {
+		if _, _, err := parseEventObject(c.EventsFor); err != nil {
+			addf("eventsFor: %v", err)
+		}
+	}
+	checkPort := func(name string, port int, optional bool) {
+		if optional && port == 0 {
+			return
+		}
+		if port < 1 || port > 65535 {
+			addf("listen.%s: %d is not a valid port", name, port)
+		}
+	}
+	checkPort("httpPort", c.Listen.HTTPPort, false)
+	checkPort("tlsPort", c.Listen.TLSPort, false)
+	checkPort("healthPort", c.Listen.HealthPort, true)
+	checkPort("metricsPort", c.Listen.MetricsPort, true)
+	if c.Policies.CriticalExpiry.Duration < 0 {
+		addf("policies.criticalExpiry: must not be negative")
+	}
+	if c.Policies.FailoverAfter.Duration < 0 {
+		addf("policies.failoverAfter: must not be negative")
+	}
+	if !c.Policies.RenewBefore.isZero() {
+		if err := c.Policies.RenewBefore.validate(); err != nil {
+			addf("policies.renewBefore: %v", err)
+		}
+	}
+	if c.Policies.RenewJitter.Duration < 0 {
+		addf("policies.renewJitter: must not be negative")
+	}
+	if c.Policies.RenewStagger.Duration < 0 {
+		addf("policies.renewStagger: must not be negative")
+	}
+	if c.Policies.OnDemandOrdersPerHour < 1 {
+		addf("policies.onDemandOrdersPerHour: must be at least 1")
+	}
+	renewBefore := c.Policies.RenewBefore
+	if renewBefore.isZero() {
+		renewBefore = defaultACMERenewBefore
+	}
+	if w, max := c.Policies.EmergencyWindow.Duration, renewBefore.before(assumedACMELifetime); w < 0 || w >= max {
+		addf("policies.emergencyWindow: must be between 0 and the %v renewal window", max)
+	}
+	if w := c.Watchdog.Interval.Duration; w != 0 && w < time.Minute {
+		addf("watchdog.interval: must be 0 or at least 1m")
+	}
+	if _, err := labels.Parse(c.Watchdog.OpaqueSelector); err != nil {
+		addf("watchdog.opaqueSelector: %v", err)
+	}
+	for _, pattern := range c.Watchdog.OpaqueKeys {
+		if _, err := path.Match(pattern, ""); err != nil {
+			addf("watchdog.opaqueKeys: %q: %v", pattern, err)
+		}
+	}
+	if c.Watchdog.MinRSABits < 0 {
+		addf("watchdog.minRSABits: must not be negative")
+	}
+	c.validateNotifications(addf)
+	if c.ReloadInterval.Duration < 0 {
+		addf("reloadInterval: must not be negative")
+	}
+
+	issuerNames := make([]string, 0, len(c.Issuers))
+	for name := range c.Issuers {
+		issuerNames = append(issuerNames, name)
+	}
+	sort.Strings(issuerNames)
+	for _, name := range issuerNames {
+		ic := c.Issuers[name]
+		path := "issuers." + name
+		if ic.Type == "" {
+			ic.Type = issuerACME
+		}
+		switch ic.Type {
+		case issuerACME:
+			if ic.Staging && ic.DirectoryURL != "" {
+				addf("%s: set directoryURL or staging, not both", path)
+			}
+			if ic.CASecret != "" || ic.Validity.Duration != 0 {
+				addf("%s: caSecret and validity are only used by ca issuers", path)
+			}
+			if ic.AutoApprove || ic.ApprovalTimeout.Duration != 0 {
+				addf("%s: autoApprove and approvalTimeout are only used by csr issuers", path)
+			}
+		case issuerCA:
+			if ic.CASecret == "" {
+				addf("%s.caSecret: required", path)
+			}
+			if ic.DirectoryURL != "" || ic.Staging || ic.Email != "" {
+				addf("%s: directoryURL, staging and email are only used by acme issuers", path)
+			}
+			if ic.Validity.Duration == 0 {
+				ic.Validity = duration{defaultCAValidity}
+			}
+			if ic.Validity.Duration < time.Hour {
+				addf("%s.validity: must be at least 1h", path)
+			}
+			if ic.AutoApprove || ic.ApprovalTimeout.Duration != 0 {
+				addf("%s: autoApprove and approvalTimeout are only used by csr issuers", path)
+			}
+		case issuerCSR:
+			if ic.DirectoryURL != "" || ic.Staging || ic.Email != "" {
+				addf("%s: directoryURL, staging and email are only used by acme issuers", path)
+			}
+			if ic.CASecret != "" || ic.Validity.Duration != 0 {
+				addf("%s: caSecret and validity are only used by ca issuers; the cluster decides how long certificates are valid", path)
+			}
+			if ic.ApprovalTimeout.Duration == 0 {
+				ic.ApprovalTimeout = duration{defaultCSRApprovalTimeout}
+			}
+			if ic.ApprovalTimeout.Duration < csrPollInterval {
+				addf("%s.approvalTimeout: must be at least %v", path, csrPollInterval)
+			}
+		default:
+			addf("%s.type: unsupported issuer type %q", path, ic.Type)
+		}
+	}
+	if len(c.Issuers) == 0 {
+		addf("issuers: at least one issuer is required")
+	}
+
+	for i := range c.Routes {
+		rc := &c.Routes[i]
+		path := fmt.Sprintf("routes[%d]", i)
+		if len(rc.Hosts) == 0 {
+			addf("%s.hosts: required", path)
+		}
+		for j, pattern := range rc.Hosts {
+			pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+			rc.Hosts[j] = pattern
+			rest := strings.TrimPrefix(pattern, "*.")
+			if pattern != "*" && (rest == "" || strings.ContainsAny(rest, "/:*@ ")) {
+				addf("%s.hosts: %q is not a hostname, *.domain or *", path, pattern)
+			}
+			if pattern == "*" && rc.OnDemand {
+				addf("%s.hosts: \"*\" can't be used on demand; anyone could have certificates issued", path)
+			}
+		}
+		ic, ok := c.Issuers[rc.Issuer]
+		switch {
+		case rc.Issuer == "":
+			addf("%s.issuer: required", path)
+		case !ok:
+			addf("%s.issuer: no issuer named %q (have %s)", path, rc.Issuer, strings.Join(issuerNames, ", "))
+		case rc.OnDemand && ic.Type != issuerACME:
+			addf("%s.onDemand: only supported by acme issuers", path)
+		}
+		if rc.MaxCertificates < 0 {
+			addf("%s.maxCertificates: must not be negative", path)
+		}
+	}
+
+	if len(c.Certificates) == 0 {
+		addf("certificates: at least one certificate is required")
+	}
+	domains := make(map[string]int)
+	ingressSecrets := make(map[string]int)
+	for i := range c.Certificates {
+		cc := &c.Certificates[i]
+		path := fmt.Sprintf("certificates[%d]", i)
+		cc.Domain = strings.ToLower(strings.TrimSuffix(cc.Domain, "."))
+		switch {
+		case cc.Domain == "":
+			addf("%s.domain: required", path)
+		case strings.ContainsAny(cc.Domain, "/:*@ "):
+			addf("%s.domain: %q is not a hostname", path, cc.Domain)
+		default:
+			if j, ok := domains[cc.Domain]; ok {
+				addf("%s.domain: %s is also certificates[%d]", path, cc.Domain, j)
+			}
+			domains[cc.Domain] = i
+		}
+
+		if cc.Issuer == "" {
+			if rc := c.route(cc.Domain); rc != nil {
+				cc.Issuer = rc.Issuer
+			} else if len(c.Issuers) == 1 {
+				cc.Issuer = issuerNames[0]
+			}
+		}
+		if cc.Issuer == "" {
+			if len(c.Issuers) > 1 {
+				addf("%s.issuer: required when there is more than one issuer and no route matches", path)
+			}
+		} else if _, ok := c.Issuers[cc.Issuer]; !ok {
+			addf("%s.issuer: no issuer named %q (have %s)", path, cc.Issuer, strings.Join(issuerNames, ", "))
+		}
+
+		if len(cc.FallbackIssuers) > 0 {
+			if ic := c.Issuers[cc.Issuer]; ic != nil && ic.Type != issuerACME {
+				addf("%s.fallbackIssuers: only supported for certificates from acme issuers", path)
+			}
+		}
+		seenIssuers := map[string]bool{cc.Issuer: true}
+		for _, name := range cc.FallbackIssuers {
+			ic, ok := c.Issuers[name]
+			switch {
+			case !ok:
+				addf("%s.fallbackIssuers: no issuer named %q (have %s)", path, name, strings.Join(issuerNames, ", "))
+			case ic.Type != issuerACME:
+				addf("%s.fallbackIssuers: %s is not an acme issuer", path, name)
+			case seenIssuers[name]:
+				addf("%s.fallbackIssuers: %s is listed more than once", path, name)
+			}
+			seenIssuers[name] = true
+		}
+
+		if cc.IngressSecret == "" {
+			addf("%s.ingressSecret: required", path)
+		} else {
+			if cc.IngressSecret == c.CacheSecret {
+				addf("%s.ingressSecret: must not be the cache secret", path)
+			}
+			if cc.IngressSecret == c.AccountSecret {
+				addf("%s.ingressSecret: must not be the account secret", path)
+			}
+			if j, ok := ingressSecrets[cc.IngressSecret]; ok {
+				addf("%s.ingressSecret: %s is also used by certificates[%d]", path, cc.IngressSecret, j)
+			}
+			ingressSecrets[cc.IngressSecret] = i
+		}
+		if !cc.RenewBefore.isZero() {
+			if err := cc.RenewBefore.validate(); err != nil {
+				addf("%s.renewBefore: %v", path, err)
+			}
+		}
+
+		if ic := c.Issuers[cc.Issuer]; ic != nil && ic.Type == issuerACME {
+			if len(cc.DNSNames) > 0 || len(cc.IPAddresses) > 0 || len(cc.Usages) > 0 {
+				addf("%s: dnsNames, ipAddresses and usages are only supported by ca and csr issuers", path)
+			}
+		}
+		for _, ip := range cc.IPAddresses {
+			if net.ParseIP(ip) == nil {
+				addf("%s.ipAddresses: %q is not an IP address", path, ip)
+			}
+		}
+		for _, u := range cc.Usages {
+			if _, ok := extKeyUsages[u]; !ok {
+				addf("%s.usages: unknown usage %q (expected server or client)", path, u)
+			}
+		}
+
+		if cc.KeystorePasswordKey == "" {
+			cc.KeystorePasswordKey = "password"
+		}
+		if _, err := cc.outputOptions(); err != nil {
+			addf("%s: %v", path, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// isACME reports whether the issuer is an ACME issuer. Type may not have been
+// defaulted yet.
+func (ic *issuerConfig) isACME() bool {
+	return ic.Type == "" || ic.Type == issuerACME
+}
+
+// directoryURL returns the ACME directory the issuer uses. Other kinds of
+// issuer return an identifier for the CA, which namespaces their entries in
+// the cache secret the same way.
+func (ic *issuerConfig) directoryURL() string {
+	switch {
+	case ic.Type == issuerCA:
+		return "ca:" + ic.CASecret
+	case ic.Type == issuerCSR:
+		return "csr:certificates.k8s.io"
+	case ic.DirectoryURL != "":
+		return ic.DirectoryURL
+	case ic.Staging:
+		return letsEncryptStagingURL
+	default:
+		return acme.LetsEncryptURL
+	}
+}
+
+// outputOptions returns the extra encodings to publish the certificate in,
+// loading the secret template if there is one.
+func (cc *certificateConfig) outputOptions() (outputOptions, error) {
+	formats, err := parseOutputFormats(strings.Join(cc.OutputFormats, ","))
+	if err != nil {
+		return outputOptions{}, fmt.Errorf("outputFormats: %v", err)
+	}
+	o := outputOptions{
+		Formats:           formats,
+		PasswordSecret:    cc.KeystorePasswordSecret,
+		PasswordSecretKey: cc.KeystorePasswordKey,
+	}
+	if cc.SecretTemplate != "" {
+		o.Template, err = loadSecretTemplate(cc.SecretTemplate)
+		if err != nil {
+			return outputOptions{}, fmt.Errorf("secretTemplate: %v", err)
+		}
+	}
+	if err := o.validate(); err != nil {
+		return outputOptions{}, err
+	}
+	return o, nil
+}
+
+// route returns the first route that matches name, or nil.
+func (c *generatorConfig) route(name string) *routeConfig {
+	for i := range c.Routes {
+		if c.Routes[i].matches(name) {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// issuer returns the configuration of the issuer for cc. The configuration
+// must have been validated.
+func (c *generatorConfig) issuer(cc certificateConfig) *issuerConfig {
+	return c.Issuers[cc.Issuer]
+}
+
+// eventObject returns the object to record Kubernetes Events against.
+func (c *generatorConfig) eventObject() (kind, name string) {
+	if c.EventsFor != "" {
+		kind, name, _ = parseEventObject(c.EventsFor)
+		return kind, name
+	}
+	if len(c.Certificates) == 1 {
+		return "Secret", c.Certificates[0].IngressSecret
+	}
+	return "Secret", c.CacheSecret
+}
+
+// backoffKey returns the key in the cache secret that backoff state is
+// stored under. Backoff state is per domain; it's namespaced by directory
+// when every certificate uses the same one, as it is without -config.
+func (c *generatorConfig) backoffKey() string {
+	directories := make(map[string]bool)
+	for _, cc := range c.Certificates {
+		directories[c.issuer(cc).directoryURL()] = true
+	}
+	if len(directories) == 1 {
+		for dir := range directories {
+			return directoryKeyPrefix(dir) + backoffSecretKey
+		}
+	}
+	return backoffSecretKey
+}
+
+// validateNotifications checks the notifications section, reporting problems
+// with addf.
+func (c *generatorConfig) validateNotifications(addf func(format string, args ...interface{})) {
+	nc := &c.Notifications
+	for i, t := range nc.ExpiryThresholds {
+		if t.Duration <= 0 {
+			addf("notifications.expiryThresholds[%d]: must be positive", i)
+		}
+	}
+	if nc.RepeatInterval.Duration < 0 {
+		addf("notifications.repeatInterval: must not be negative")
+	}
+	c.validateEmail(addf)
+	names := make(map[string]int)
+	for i := range nc.Webhooks {
+		wc := &nc.Webhooks[i]
+		path := fmt.Sprintf("notifications.webhooks[%d]", i)
+		if wc.Name == "" {
+			addf("%s.name: required", path)
+		} else if j, ok := names[wc.Name]; ok {
+			addf("%s.name: %s is also notifications.webhooks[%d]", path, wc.Name, j)
+		} else {
+			names[wc.Name] = i
+		}
+		switch {
+		case (wc.URL == "") == (wc.URLEnv == ""):
+			addf("%s: exactly one of url and urlEnv is required", path)
+		case wc.URL != "":
+			if u, err := url.Parse(wc.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				addf("%s.url: %q is not an http or https URL", path, wc.URL)
+			}
+		}
+		switch wc.Format {
+		case "":
+			wc.Format = webhookGeneric
+		case webhookGeneric, webhookSlack, webhookTeams:
+		default:
+			addf("%s.format: must be %s, %s or %s, not %q", path, webhookGeneric, webhookSlack, webhookTeams, wc.Format)
+		}
+		if wc.Template != "" {
+			if _, err := parseWebhookTemplate(wc.Name, wc.Template); err != nil {
+				addf("%s.template: %v", path, err)
+			}
+		}
+		checkNotificationEvents(path+".events", wc.Events, addf)
+	}
+}
+
+// checkNotificationEvents reports events that aren't notificationEvents.
+func checkNotificationEvents(path string, events []string, addf func(format string, args ...interface{})) {
+	for _, e := range events {
+		known := false
+		for _, name := range notificationEvents {
+			known = known || e == name
+		}
+		if !known {
+			addf("%s: unknown event %q (have %s)", path, e, strings.Join(notificationEvents, ", "))
+		}
+	}
+}
+
+// validateEmail checks notifications.email and the certificates' notifyEmail,
+// reporting problems with addf.
+func (c *generatorConfig) validateEmail(addf func(format string, args ...interface{})) {
+	ec := &c.Notifications.Email
+	checkAddresses := func(path string, addrs ...string) {
+		for _, addr := range addrs {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				addf("%s: %q: %v", path, addr, err)
+			}
+		}
+	}
+	for i, cc := range c.Certificates {
+		if len(cc.NotifyEmail) == 0 {
+			continue
+		}
+		path := fmt.Sprintf("certificates[%d].notifyEmail", i)
+		if ec.Host == "" {
+			addf("%s: notifications.email.host is not set", path)
+		}
+		checkAddresses(path, cc.NotifyEmail...)
+	}
+	if ec.Host == "" {
+		return
+	}
+	switch ec.TLS {
+	case "":
+		ec.TLS = smtpSTARTTLS
+	case smtpSTARTTLS, smtpImplicit, smtpNone:
+	default:
+		addf("notifications.email.tls: must be %s, %s or %s, not %q", smtpSTARTTLS, smtpImplicit, smtpNone, ec.TLS)
+	}
+	if ec.Port == 0 {
+		ec.Port = 587
+		if ec.TLS == smtpImplicit {
+			ec.Port = 465
+		}
+	}
+	if ec.Port < 1 || ec.Port > 65535 {
+		addf("notifications.email.port: %d is not a valid port", ec.Port)
+	}
+	if (ec.UsernameEnv == "") != (ec.PasswordEnv == "") {
+		addf("notifications.email: usernameEnv and passwordEnv go together")
+	}
+	if ec.From == "" {
+		addf("notifications.email.from: required")
+	}
+	checkAddresses("notifications.email.from", ec.From)
+	checkAddresses("notifications.email.to", ec.To...)
+	checkNotificationEvents("notifications.email.events", ec.Events, addf)
+	if ec.DigestInterval.Duration < 0 {
+		addf("notifications.email.digestInterval: must not be negative")
+	}
+	if ec.DigestExpiry.Duration <= 0 {
+		addf("notifications.email.digestExpiry: must be positive")
+	}
+}
+
+// keepRestartSettings copies the settings that can only be changed by
+// restarting from c to next, and returns the ones that differed.
+func (c *generatorConfig) keepRestartSettings(next *generatorConfig) []string {
+	var changed []string
+	if c.Namespace != next.Namespace {
+		changed = append(changed, "namespace")
+	}
+	if c.CacheSecret != next.CacheSecret {
+		changed = append(changed, "cacheSecret")
+	}
+	if c.AccountSecret != next.AccountSecret {
+		changed = append(changed, "accountSecret")
+	}
+	kind, name := c.eventObject()
+	if nextKind, nextName := next.eventObject(); kind != nextKind || name != nextName {
+		changed = append(changed, "eventsFor")
+	}
+	if c.Listen != next.Listen {
+		changed = append(changed, "listen")
+	}
+	if c.Policies != next.Policies {
+		changed = append(changed, "policies")
+	}
+	if !reflect.DeepEqual(c.Watchdog, next.Watchdog) {
+		changed = append(changed, "watchdog")
+	}
+	if !reflect.DeepEqual(c.Notifications, next.Notifications) {
+		changed = append(changed, "notifications")
+	}
+	if c.ReloadInterval != next.ReloadInterval {
+		changed = append(changed, "reloadInterval")
+	}
+	if c.backoffKey() != next.backoffKey() {
+		// The tracker keeps using the old key, which is harmless.
+		changed = append(changed, "issuers (where backoff state is stored)")
+	}
+	next.Namespace = c.Namespace
+	next.CacheSecret = c.CacheSecret
+	next.AccountSecret = c.AccountSecret
+	next.EventsFor = c.EventsFor
+	next.Listen = c.Listen
+	next.Policies = c.Policies
+	next.Watchdog = c.Watchdog
+	next.Notifications = c.Notifications
+	next.ReloadInterval = c.ReloadInterval
+	return changed
+}
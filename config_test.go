@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const testConfig = `
+namespace: web
+issuers:
+  letsencrypt:
+    email: ops@example.com
+  internal:
+    directoryURL: https://ca.internal/acme/directory
+certificates:
+- domain: Example.COM.
+  issuer: letsencrypt
+  ingressSecret: example-com-tls
+- domain: api.internal
+  issuer: internal
+  ingressSecret: api-tls
+  outputFormats: [pem-combined]
+policies:
+  criticalExpiry: 72h
+`
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Namespace != "web" || c.CacheSecret != "acme.secret" || c.Listen.TLSPort != 8443 {
+		t.Errorf("got namespace %q, cache secret %q, TLS port %d", c.Namespace, c.CacheSecret, c.Listen.TLSPort)
+	}
+	if c.Policies.CriticalExpiry.Duration != 72*time.Hour {
+		t.Errorf("got critical expiry %v", c.Policies.CriticalExpiry)
+	}
+	if got := c.Certificates[0].Domain; got != "example.com" {
+		t.Errorf("domain not normalized: %q", got)
+	}
+	if got := c.issuer(c.Certificates[0]).directoryURL(); got != acme.LetsEncryptURL {
+		t.Errorf("letsencrypt issuer: got directory %q", got)
+	}
+	if got := c.issuer(c.Certificates[1]).directoryURL(); got != "https://ca.internal/acme/directory" {
+		t.Errorf("internal issuer: got directory %q", got)
+	}
+	if kind, name := c.eventObject(); kind != "Secret" || name != "acme.secret" {
+		t.Errorf("got event object %s/%s, want the cache secret", kind, name)
+	}
+	if got := c.backoffKey(); got != backoffSecretKey {
+		t.Errorf("got backoff key %q for two directories", got)
+	}
+
+	if _, err := parseConfig([]byte("certificates:\n- domian: example.com\n")); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	c, err := parseConfig([]byte(`
+accountSecret: acme.secret
+listen:
+  tlsPort: 70000
+issuers:
+  a: {}
+  b: {type: vault}
+certificates:
+- domain: example.com
+  ingressSecret: tls
+  renewBefore: 30m
+  notifyEmail: [web-team@example.com]
+- domain: example.com
+  issuer: c
+  ingressSecret: tls
+  outputFormats: [pkcs12]
+policies:
+  renewBefore: 95%
+  onDemandOrdersPerHour: 0
+watchdog:
+  interval: 10s
+notifications:
+  webhooks:
+  - name: ops
+    url: ftp://example.com/hook
+    format: email
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.validate()
+	errs, ok := err.(configErrors)
+	if !ok {
+		t.Fatalf("got %v, want configErrors", err)
+	}
+	want := []string{
+		"accountSecret: must not be the cache secret",
+		"listen.tlsPort: 70000 is not a valid port",
+		"issuers.b.type: unsupported issuer type \"vault\"",
+		"policies.renewBefore: must be between 0% and 90% of the lifetime",
+		"policies.onDemandOrdersPerHour: must be at least 1",
+		"watchdog.interval: must be 0 or at least 1m",
+		"notifications.webhooks[0].url: \"ftp://example.com/hook\" is not an http or https URL",
+		"notifications.webhooks[0].format: must be generic, slack or teams, not \"email\"",
+		"certificates[0].issuer: required when there is more than one issuer",
+		"certificates[0].renewBefore: must be more than 1h",
+		"certificates[0].notifyEmail: notifications.email.host is not set",
+		"certificates[1].domain: example.com is also certificates[0]",
+		"certificates[1].issuer: no issuer named \"c\" (have a, b)",
+		"certificates[1].ingressSecret: tls is also used by certificates[0]",
+		"certificates[1]: output formats [pkcs12] require a keystore password secret",
+	}
+	for _, w := range want {
+		found := false
+		for _, e := range errs {
+			if strings.HasPrefix(e, w) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing error %q in %v", w, errs)
+		}
+	}
+	if len(errs) != len(want) {
+		t.Errorf("got %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	withSigners := strings.Replace(testConfig, "issuers:\n", "issuers:\n  cluster-ca: {type: ca, caSecret: ca}\n  cluster-csr: {type: csr}\n", 1)
+	c, err := parseConfig([]byte(withSigners))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"K8S_CERT_GENERATOR_NAMESPACE": "certs",
+		"K8S_CERT_GENERATOR_TLS_PORT":  "9443",
+		"K8S_CERT_GENERATOR_STAGING":   "true",
+		"K8S_CERT_GENERATOR_EMAIL":     "certs@example.com",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	if err := c.applyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if c.Namespace != "certs" || c.Listen.TLSPort != 9443 {
+		t.Errorf("got namespace %q, TLS port %d", c.Namespace, c.Listen.TLSPort)
+	}
+	if got := c.Issuers["letsencrypt"].directoryURL(); got != letsEncryptStagingURL {
+		t.Errorf("letsencrypt issuer: got %q, want staging", got)
+	}
+	if got := c.Issuers["internal"].directoryURL(); got != "https://ca.internal/acme/directory" {
+		t.Errorf("STAGING changed a non Let's Encrypt issuer to %q", got)
+	}
+	if c.Issuers["letsencrypt"].Email != "certs@example.com" {
+		t.Errorf("letsencrypt issuer: got email %q", c.Issuers["letsencrypt"].Email)
+	}
+	// ca and csr issuers don't take an email or staging, and would fail
+	// validation with them.
+	if err := c.validate(); err != nil {
+		t.Errorf("validating with EMAIL and STAGING set: %v", err)
+	}
+
+	env["K8S_CERT_GENERATOR_HTTP_PORT"] = "http"
+	if err := c.applyEnv(lookup); err == nil || !strings.Contains(err.Error(), "K8S_CERT_GENERATOR_HTTP_PORT") {
+		t.Errorf("got %v, want an error naming the variable", err)
+	}
+}
+
+func TestKeepRestartSettings(t *testing.T) {
+	c, _ := parseConfig([]byte(testConfig))
+	next, _ := parseConfig([]byte(testConfig))
+	c.validate()
+	next.Namespace = "other"
+	next.Listen.HTTPPort = 80
+	next.Certificates[1].IngressSecret = "api-tls-v2"
+	next.validate()
+	changed := c.keepRestartSettings(next)
+	if want := []string{"namespace", "listen"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("got %v, want %v", changed, want)
+	}
+	if next.Namespace != "web" || next.Listen.HTTPPort != 8442 {
+		t.Errorf("restart only settings weren't kept: %+v", next)
+	}
+}
+
+func TestCertificateSetApply(t *testing.T) {
+	builds := 0
+	build := func(cc certificateConfig) (*managedCertificate, error) {
+		builds++
+		cache := newKubernetesCache("acme.secret", cc.IngressSecret, "default", cc.Domain, "", nil, 1, outputOptions{}, false)
+		return &managedCertificate{Config: cc, cache: cache, source: namedSource(cc.IngressSecret)}, nil
+	}
+	s := newCertificateSet()
+	changes, err := s.apply([]certificateConfig{
+		{Domain: "a.example.com", IngressSecret: "a"},
+		{Domain: "b.example.com", IngressSecret: "b"},
+	}, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.example.com", "b.example.com"}; !reflect.DeepEqual(changes.Added, want) {
+		t.Errorf("added %v, want %v", changes.Added, want)
+	}
+	a := s.lookup("A.example.com.")
+	if a == nil {
+		t.Fatal("lookup is case sensitive")
+	}
+
+	changes, err = s.apply([]certificateConfig{
+		{Domain: "a.example.com", IngressSecret: "a"},
+		{Domain: "c.example.com", IngressSecret: "c"},
+	}, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes.Added, []string{"c.example.com"}) || !reflect.DeepEqual(changes.Removed, []string{"b.example.com"}) || changes.Updated != nil {
+		t.Errorf("got changes %+v", changes)
+	}
+	if s.lookup("a.example.com") != a {
+		t.Error("unchanged certificate was replaced")
+	}
+	if s.managed("b.example.com") {
+		t.Error("removed certificate is still managed")
+	}
+
+	// Only the secret it's published to changed, so the source is kept, and
+	// writes through its cache go to the new one.
+	changes, _ = s.apply([]certificateConfig{
+		{Domain: "a.example.com", IngressSecret: "a2"},
+		{Domain: "c.example.com", IngressSecret: "c"},
+	}, build)
+	if !reflect.DeepEqual(changes.Updated, []string{"a.example.com"}) || changes.old != nil {
+		t.Errorf("got changes %+v", changes)
+	}
+	a2 := s.lookup("a.example.com")
+	if a2.source != a.source {
+		t.Error("source was replaced when only the ingress secret changed")
+	}
+	if current, err := a.cache.current(); err != nil || current != a2.cache {
+		t.Errorf("old cache forwards to %v (%v), want the new cache", current, err)
+	}
+
+	// A new issuer needs a new source.
+	changes, _ = s.apply([]certificateConfig{
+		{Domain: "a.example.com", Issuer: "other", IngressSecret: "a2"},
+		{Domain: "c.example.com", IngressSecret: "c"},
+	}, build)
+	if len(changes.old) != 1 || changes.old[0] != a2 {
+		t.Errorf("got changes %+v", changes)
+	}
+	if builds != 8 {
+		t.Errorf("got %d builds", builds)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	c, err := parseConfig([]byte(`
+issuers:
+  letsencrypt: {}
+  customer-ca:
+    directoryURL: https://acme.customer-ca.example/directory
+  step-ca:
+    directoryURL: https://ca.internal/acme/directory
+routes:
+- hosts: [customer-a.com, "*.customer-a.com"]
+  issuer: customer-ca
+- hosts: ["*.Internal."]
+  issuer: step-ca
+  onDemand: true
+- hosts: ["*"]
+  issuer: letsencrypt
+certificates:
+- domain: shop.customer-a.com
+  ingressSecret: shop-tls
+- domain: api.internal
+  ingressSecret: api-tls
+- domain: example.com
+  ingressSecret: example-tls
+- domain: override.internal
+  issuer: letsencrypt
+  ingressSecret: override-tls
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	var issuers []string
+	for _, cc := range c.Certificates {
+		issuers = append(issuers, cc.Issuer)
+	}
+	if want := []string{"customer-ca", "step-ca", "letsencrypt", "letsencrypt"}; !reflect.DeepEqual(issuers, want) {
+		t.Errorf("got issuers %v, want %v", issuers, want)
+	}
+	for name, want := range map[string]string{
+		"customer-a.com":     "customer-ca",
+		"a.b.customer-a.com": "customer-ca",
+		"xcustomer-a.com":    "letsencrypt",
+		"db.internal":        "step-ca",
+		"internal":           "letsencrypt",
+	} {
+		if got := c.route(name).Issuer; got != want {
+			t.Errorf("%s: got issuer %s, want %s", name, got, want)
+		}
+	}
+
+	c, err = parseConfig([]byte(`
+issuers:
+  letsencrypt: {}
+  internal: {type: ca, caSecret: ca}
+routes:
+- hosts: ["*"]
+  issuer: letsencrypt
+  onDemand: true
+- hosts: ["*.internal", "a/b"]
+  issuer: internal
+  onDemand: true
+- hosts: []
+  issuer: nope
+  maxCertificates: -1
+certificates:
+- domain: example.com
+  ingressSecret: tls
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, _ := c.validate().(configErrors)
+	want := []string{
+		`routes[0].hosts: "*" can't be used on demand`,
+		`routes[1].hosts: "a/b" is not a hostname`,
+		`routes[1].onDemand: only supported by acme issuers`,
+		`routes[2].hosts: required`,
+		`routes[2].issuer: no issuer named "nope"`,
+		`routes[2].maxCertificates: must not be negative`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got errors %v, want %d", errs, len(want))
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(errs[i], w) {
+			t.Errorf("got %q, want %q", errs[i], w)
+		}
+	}
+}
+
+// namedSource is a certificateSource that returns a certificate holding
+// its name.
+type namedSource string
+
+func (s namedSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &tls.Certificate{Certificate: [][]byte{[]byte(s)}}, nil
+}
+
+func (s namedSource) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+func TestCertificateSetRoutes(t *testing.T) {
+	s := newCertificateSet()
+	s.apply([]certificateConfig{{Domain: "api.internal"}}, func(cc certificateConfig) (*managedCertificate, error) {
+		return &managedCertificate{Config: cc, source: namedSource("configured")}, nil
+	})
+	issuers := map[string]*issuerConfig{"step-ca": {}, "letsencrypt": {}}
+	routes := []routeConfig{
+		{Hosts: []string{"*.internal"}, Issuer: "step-ca", OnDemand: true},
+		{Hosts: []string{"*"}, Issuer: "letsencrypt"},
+	}
+	builds := 0
+	build := func(rc routeConfig) certificateSource {
+		builds++
+		return namedSource(rc.Issuer)
+	}
+	s.applyRoutes(routes, issuers, build)
+	for name, want := range map[string]string{
+		"api.internal": "configured",
+		"DB.internal.": "step-ca",
+	} {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got := string(cert.Certificate[0]); got != want {
+			t.Errorf("%s: got certificate from %s, want %s", name, got, want)
+		}
+	}
+	if _, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"}); err == nil {
+		t.Error("expected an error for a name that only matches a route that isn't on demand")
+	}
+
+	if dropped := s.applyRoutes(routes, issuers, build); builds != 1 || len(dropped) != 0 {
+		t.Errorf("unchanged route was rebuilt")
+	}
+	if dropped := s.applyRoutes(nil, issuers, build); len(dropped) != 1 || dropped[0].Config.Issuer != "step-ca" {
+		t.Errorf("got dropped routes %v", dropped)
+	}
+	if s.lookupRoute("db.internal") != nil {
+		t.Error("removed route is still used")
+	}
+}
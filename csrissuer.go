@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	certificates "k8s.io/client-go/pkg/apis/certificates/v1beta1"
+)
+
+const (
+	// csrDomainAnnotation records which certificate a request is for, so
+	// pending requests are easy to recognize before approving them.
+	csrDomainAnnotation = "k8s-cert-generator/domain"
+	// csrPollInterval is how often a pending request is checked.
+	csrPollInterval = 5 * time.Second
+)
+
+// csrSigner has certificates signed by the cluster CA, through the
+// certificates.k8s.io API. A request has to be approved, by an administrator
+// or an approving controller, before the cluster signs it, unless
+// AutoApprove is set.
+type csrSigner struct {
+	Client          kubernetes.Interface
+	AutoApprove     bool
+	ApprovalTimeout time.Duration
+}
+
+func (s *csrSigner) sign(ctx context.Context, cc certificateConfig, key crypto.Signer) ([][]byte, error) {
+	request, err := csrRequest(cc, key)
+	if err != nil {
+		return nil, err
+	}
+	csrs := s.Client.CertificatesV1beta1().CertificateSigningRequests()
+	csr, err := csrs.Create(&certificates.CertificateSigningRequest{
+		ObjectMeta: meta_v1.ObjectMeta{
+			GenerateName: "k8s-cert-generator-",
+			Annotations:  map[string]string{csrDomainAnnotation: cc.Domain},
+		},
+		Spec: certificates.CertificateSigningRequestSpec{
+			Request: request,
+			Usages:  csrUsages(cc),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create certificate signing request: %v", err)
+	}
+	name := csr.Name
+	// The key is only kept in memory, so the request is no use to anyone
+	// once we stop waiting for it.
+	defer func() {
+		if err := csrs.Delete(name, nil); err != nil && !apierrors.IsNotFound(err) {
+			logger.Warn("could not delete certificate signing request", "csr", name, "err", err)
+		}
+	}()
+
+	if s.AutoApprove {
+		csr.Status.Conditions = append(csr.Status.Conditions, certificates.CertificateSigningRequestCondition{
+			Type:           certificates.CertificateApproved,
+			Reason:         "AutoApproved",
+			Message:        "Approved by k8s-cert-generator",
+			LastUpdateTime: meta_v1.Now(),
+		})
+		if csr, err = csrs.UpdateApproval(csr); err != nil {
+			return nil, fmt.Errorf("could not approve certificate signing request %s: %v", name, err)
+		}
+	}
+
+	logger.Info("waiting for certificate signing request", "domain", cc.Domain, "csr", name, "timeout", s.ApprovalTimeout)
+	timeout := time.NewTimer(s.ApprovalTimeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(csrPollInterval)
+	defer poll.Stop()
+	for {
+		chain, err := csrResult(csr, key.Public())
+		if err != nil {
+			return nil, fmt.Errorf("certificate signing request %s: %v", name, err)
+		}
+		if chain != nil {
+			logger.Info("certificate signing request signed", "domain", cc.Domain, "csr", name)
+			return chain, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout.C:
+			return nil, fmt.Errorf("certificate signing request %s was not approved and signed within %v", name, s.ApprovalTimeout)
+		case <-poll.C:
+		}
+		if csr, err = csrs.Get(name, meta_v1.GetOptions{}); err != nil {
+			return nil, fmt.Errorf("could not get certificate signing request %s: %v", name, err)
+		}
+	}
+}
+
+// csrRequest returns the PEM encoded PKCS#10 request for cc, signed by key.
+func csrRequest(cc certificateConfig, key crypto.Signer) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: cc.Domain},
+		DNSNames:    cc.dnsNames(),
+		IPAddresses: cc.ipAddresses(),
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// csrUsages returns the key usages to ask for in a request for cc.
+func csrUsages(cc certificateConfig) []certificates.KeyUsage {
+	usages := []certificates.KeyUsage{certificates.UsageDigitalSignature, certificates.UsageKeyEncipherment}
+	for _, u := range cc.usages() {
+		switch u {
+		case "server":
+			usages = append(usages, certificates.UsageServerAuth)
+		case "client":
+			usages = append(usages, certificates.UsageClientAuth)
+		}
+	}
+	return usages
+}
+
+// csrResult returns the DER encoded chain in a signed request, nil if it
+// hasn't been signed yet, or an error if it was denied or the certificate
+// isn't for pub.
+func csrResult(csr *certificates.CertificateSigningRequest, pub crypto.PublicKey) ([][]byte, error) {
+	for _, c := range csr.Status.Conditions {
+		if c.Type == certificates.CertificateDenied {
+			msg := "denied"
+			if reason := strings.TrimSpace(c.Reason + " " + c.Message); reason != "" {
+				msg += ": " + reason
+			}
+			return nil, errors.New(msg)
+		}
+	}
+	if len(csr.Status.Certificate) == 0 {
+		return nil, nil
+	}
+	var chain [][]byte
+	rest := csr.Status.Certificate
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificates in the signed request")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeysEqual(leaf.PublicKey, pub) {
+		return nil, errors.New("signed certificate does not match the key")
+	}
+	return chain, nil
+}
+
+// dryRunCSRSigner stands in for csrSigner in dry runs, which must not create
+// requests. It says what it would ask for, and signs the certificate with a
+// throwaway CA so the changes to the secrets can still be shown.
+type dryRunCSRSigner struct {
+	Out io.Writer
+}
+
+func (s *dryRunCSRSigner) sign(ctx context.Context, cc certificateConfig, key crypto.Signer) ([][]byte, error) {
+	var usages []string
+	for _, u := range csrUsages(cc) {
+		usages = append(usages, string(u))
+	}
+	fmt.Fprintf(s.Out, "Would submit a certificate signing request for %s\n  names:  %s\n  usages: %s\n",
+		cc.Domain, strings.Join(append(cc.dnsNames(), cc.IPAddresses...), ", "), strings.Join(usages, ", "))
+	ca, err := throwawayCA()
+	if err != nil {
+		return nil, err
+	}
+	return signWithCA(ca, cc, key.Public(), time.Now(), defaultCAValidity)
+}
+
+// throwawayCA returns a self-signed CA that only lives in memory.
+func throwawayCA() (*certBundle, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "k8s-cert-generator dry run CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(2 * defaultCAValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &certBundle{Key: key, Leaf: cert, Chain: []*x509.Certificate{cert}}, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	certificates "k8s.io/client-go/pkg/apis/certificates/v1beta1"
+)
+
+func TestCSRRequest(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := certificateConfig{
+		Domain:      "api.web.svc.cluster.local",
+		DNSNames:    []string{"api.web.svc"},
+		IPAddresses: []string{"10.0.0.10"},
+		Usages:      []string{"client"},
+	}
+	data, err := csrRequest(cc, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		t.Fatalf("got %q, want a PEM certificate request", data)
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.CheckSignature(); err != nil {
+		t.Error(err)
+	}
+	if req.Subject.CommonName != cc.Domain || !sameStrings(req.DNSNames, cc.dnsNames()) {
+		t.Errorf("got CN %q and names %v", req.Subject.CommonName, req.DNSNames)
+	}
+	if len(req.IPAddresses) != 1 || req.IPAddresses[0].String() != "10.0.0.10" {
+		t.Errorf("got IP addresses %v", req.IPAddresses)
+	}
+	usages := csrUsages(cc)
+	if last := usages[len(usages)-1]; last != certificates.UsageClientAuth || len(usages) != 3 {
+		t.Errorf("got usages %v", usages)
+	}
+}
+
+func TestCSRResult(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := &certificates.CertificateSigningRequest{}
+	if chain, err := csrResult(csr, key.Public()); chain != nil || err != nil {
+		t.Errorf("pending request: got %v, %v", chain, err)
+	}
+
+	csr.Status.Conditions = []certificates.CertificateSigningRequestCondition{{Type: certificates.CertificateApproved}}
+	if chain, err := csrResult(csr, key.Public()); chain != nil || err != nil {
+		t.Errorf("approved request: got %v, %v", chain, err)
+	}
+
+	ca := newTestCA(t, time.Now().Add(24*time.Hour))
+	chain, err := signWithCA(ca, certificateConfig{Domain: "api.internal"}, key.Public(), time.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, der := range chain {
+		csr.Status.Certificate = append(csr.Status.Certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	got, err := csrResult(csr, key.Public())
+	if err != nil || len(got) != 2 {
+		t.Errorf("signed request: got %d certificates, %v", len(got), err)
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := csrResult(csr, other.Public()); err == nil {
+		t.Error("expected an error for a certificate that doesn't match the key")
+	}
+
+	csr.Status.Conditions = []certificates.CertificateSigningRequestCondition{{Type: certificates.CertificateDenied, Reason: "NotAllowed", Message: "ask the platform team"}}
+	if _, err := csrResult(csr, key.Public()); err == nil || !strings.Contains(err.Error(), "denied: NotAllowed ask the platform team") {
+		t.Errorf("denied request: got %v", err)
+	}
+}
+
+func TestValidateCSRIssuer(t *testing.T) {
+	c, err := parseConfig([]byte(`
+issuers:
+  cluster: {type: csr, email: ops@example.com}
+certificates:
+- domain: api.web.svc.cluster.local
+  ingressSecret: api-tls
+  dnsNames: [api.web.svc]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.validate()
+	if err == nil || !strings.Contains(err.Error(), "issuers.cluster: directoryURL, staging and email are only used by acme issuers") {
+		t.Errorf("got %v", err)
+	}
+	c.Issuers["cluster"].Email = ""
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Issuers["cluster"].ApprovalTimeout.Duration; got != defaultCSRApprovalTimeout {
+		t.Errorf("got approval timeout %v", got)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// letsEncryptStagingURL is the Let's Encrypt staging directory, which issues
+// untrusted certificates but has much higher rate limits.
+const letsEncryptStagingURL = "https://acme-staging.api.letsencrypt.org/directory"
+
+// stagingValidationKey is the key in the cache secret recording which
+// configurations have been issued a certificate by the staging CA.
+const stagingValidationKey = "k8s-cert-generator.staging-validated"
+
+var invalidKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]+`)
+
+// directoryKeyPrefix returns the prefix for cache secret keys holding state
+// for the ACME directory at directoryURL, so certificates and account keys
+// from different CAs are never mixed up.
+func directoryKeyPrefix(directoryURL string) string {
+	switch directoryURL {
+	case "":
+		return ""
+	case acme.LetsEncryptURL:
+		return "production__"
+	case letsEncryptStagingURL:
+		return "staging__"
+	}
+	u, err := url.Parse(directoryURL)
+	if err != nil || u.Host == "" {
+		return invalidKeyChars.ReplaceAllString(directoryURL, "-") + "__"
+	}
+	return invalidKeyChars.ReplaceAllString(u.Host+u.Path, "-") + "__"
+}
+
+// isStagingIssuer reports whether cert was issued by the Let's Encrypt
+// staging CA, whose intermediates are called things like "Fake LE
+// Intermediate X1" and "(STAGING) Artificial Apricot R3".
+func isStagingIssuer(cert *x509.Certificate) bool {
+	names := append([]string{cert.Issuer.CommonName}, cert.Issuer.Organization...)
+	for _, name := range names {
+		if strings.Contains(name, "Fake LE") || strings.Contains(strings.ToUpper(name), "STAGING") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIssuer returns an error if cert can't have come from the Let's Encrypt
+// directory at directoryURL: a staging certificate when we're configured for
+// production, or the other way round. Other directories aren't checked.
+func checkIssuer(cert *x509.Certificate, directoryURL string) error {
+	var wantStaging bool
+	switch directoryURL {
+	case acme.LetsEncryptURL:
+		wantStaging = false
+	case letsEncryptStagingURL:
+		wantStaging = true
+	default:
+		return nil
+	}
+	if isStagingIssuer(cert) == wantStaging {
+		return nil
+	}
+	return fmt.Errorf("certificate issued by %q does not come from the configured directory %s", cert.Issuer.CommonName, directoryURL)
+}
+
+// configFingerprint returns a hash of the settings that affect what gets
+// published for domain, so we can tell whether a production run uses the same
+// configuration that was validated against staging.
+func configFingerprint(domain, ingressSecret string, outputs outputOptions) string {
+	formats := make([]string, len(outputs.Formats))
+	for i, f := range outputs.Formats {
+		formats[i] = string(f)
+	}
+	sort.Strings(formats)
+	config := map[string]interface{}{
+		"domain":        domain,
+		"ingressSecret": ingressSecret,
+		"formats":       formats,
+		"secretType":    string(outputs.secretType()),
+	}
+	if outputs.Template != nil {
+		config["template"] = outputs.Template.Data
+	}
+	data, _ := json.Marshal(config) // maps are marshalled in key order
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// stagingValidation records that the staging CA issued a certificate for a
+// domain with a given configuration.
+type stagingValidation struct {
+	Config      string    `json:"config"`
+	Time        time.Time `json:"time"`
+	Fingerprint string    `json:"fingerprintSHA256"`
+}
+
+// loadStagingValidations reads the staging validation records from the cache
+// secret, keyed by domain.
+func loadStagingValidations(client kubernetes.Interface, namespace, secretName string) (map[string]stagingValidation, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(secretName, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	validations := make(map[string]stagingValidation)
+	if data := secret.Data[stagingValidationKey]; len(data) > 0 {
+		if err := json.Unmarshal(data, &validations); err != nil {
+			return nil, fmt.Errorf("parsing %s in secret %s: %v", stagingValidationKey, secretName, err)
+		}
+	}
+	return validations, nil
+}
+
+// recordStagingValidation notes in the cache secret that bundle was issued
+// by the staging CA for the cache's current configuration.
+func (k *kubernetesCache) recordStagingValidation(bundle *certBundle) error {
+	v := stagingValidation{
+		Config:      configFingerprint(k.domain, k.IngressSecretName, k.outputs),
+		Time:        time.Now().UTC(),
+		Fingerprint: bundle.Fingerprint(),
+	}
+	return updateSecret(k.Client, k.Namespace, k.SecretName, func(secretData map[string][]byte) error {
+		validations := make(map[string]stagingValidation)
+		if data := secretData[stagingValidationKey]; len(data) > 0 {
+			// Start again if it's corrupt; it's only a record.
+			json.Unmarshal(data, &validations)
+		}
+		validations[k.domain] = v
+		data, err := json.Marshal(validations)
+		if err != nil {
+			return err
+		}
+		secretData[stagingValidationKey] = data
+		return nil
+	})
+}
+
+// checkPromotion returns an error unless the staging CA has issued a
+// certificate for domain with the configuration identified by config.
+func checkPromotion(validations map[string]stagingValidation, domain, config string) error {
+	v, ok := validations[domain]
+	if !ok {
+		return fmt.Errorf("%s has not been issued a certificate by the staging CA; run with -staging first", domain)
+	}
+	if v.Config != config {
+		return fmt.Errorf("the configuration for %s has changed since it was validated against staging on %s; run with -staging again", domain, v.Time.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestDirectoryKeyPrefix(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"", ""},
+		{acme.LetsEncryptURL, "production__"},
+		{letsEncryptStagingURL, "staging__"},
+		{"https://ca.internal:14000/dir", "ca.internal-14000-dir__"},
+	}
+	for _, tt := range tests {
+		if got := directoryKeyPrefix(tt.url); got != tt.want {
+			t.Errorf("directoryKeyPrefix(%q): got %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestCheckIssuer(t *testing.T) {
+	staging := &x509.Certificate{Issuer: pkix.Name{CommonName: "Fake LE Intermediate X1"}}
+	production := &x509.Certificate{Issuer: pkix.Name{CommonName: "Let's Encrypt Authority X3", Organization: []string{"Let's Encrypt"}}}
+	if err := checkIssuer(staging, letsEncryptStagingURL); err != nil {
+		t.Errorf("staging cert, staging directory: %v", err)
+	}
+	if err := checkIssuer(production, acme.LetsEncryptURL); err != nil {
+		t.Errorf("production cert, production directory: %v", err)
+	}
+	if err := checkIssuer(staging, acme.LetsEncryptURL); err == nil {
+		t.Error("staging cert, production directory: expected error")
+	}
+	if err := checkIssuer(production, letsEncryptStagingURL); err == nil {
+		t.Error("production cert, staging directory: expected error")
+	}
+	if err := checkIssuer(staging, "https://ca.internal/dir"); err != nil {
+		t.Errorf("unknown directory: %v", err)
+	}
+}
+
+func TestCheckPromotion(t *testing.T) {
+	outputs := outputOptions{Formats: []outputFormat{outputPKCS12}}
+	config := configFingerprint("example.com", "acme.ingress.secret", outputs)
+	if config != configFingerprint("example.com", "acme.ingress.secret", outputs) {
+		t.Fatal("config fingerprint is not stable")
+	}
+	validations := map[string]stagingValidation{
+		"example.com": {Config: config, Time: time.Now()},
+	}
+	if err := checkPromotion(validations, "example.com", config); err != nil {
+		t.Errorf("validated config: %v", err)
+	}
+	if err := checkPromotion(validations, "example.org", config); err == nil || !strings.Contains(err.Error(), "run with -staging first") {
+		t.Errorf("unvalidated domain: got %v", err)
+	}
+	changed := configFingerprint("example.com", "acme.ingress.secret", outputOptions{})
+	if err := checkPromotion(validations, "example.com", changed); err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("changed config: got %v", err)
+	}
+}
+
+func TestRecordStagingValidationRetries(t *testing.T) {
+	api := newFakeSecretsAPI(&v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: "acme.secret", Namespace: "certs"}})
+	client, srv := api.serve(t)
+	defer srv.Close()
+	// The backoff tracker writes the secret between our read and update.
+	api.interleave = func(stored *v1.Secret) {
+		stored.Data = map[string][]byte{backoffSecretKey: []byte("{}")}
+	}
+	b, err := parseCertBundle(newTestBundle(t, "example.com", time.Now().Add(90*24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newKubernetesCache("acme.secret", "tls", "certs", "example.com", letsEncryptStagingURL, client, 1, outputOptions{}, false)
+	if err := k.recordStagingValidation(b); err != nil {
+		t.Fatal(err)
+	}
+	validations, err := loadStagingValidations(client, "certs", "acme.secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validations["example.com"].Fingerprint != b.Fingerprint() {
+		t.Errorf("got validations %+v", validations)
+	}
+	if api.get("certs", "acme.secret").Data[backoffSecretKey] == nil {
+		t.Error("the other writer's change was lost")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// certSummary describes a certificate in a dry run report.
+type certSummary struct {
+	Fingerprint string    `json:"fingerprintSHA256"`
+	DNSNames    []string  `json:"dnsNames"`
+	Issuer      string    `json:"issuer"`
+	NotAfter    time.Time `json:"notAfter"`
+}
+
+func summarizeCert(leaf *x509.Certificate) *certSummary {
+	return &certSummary{
+		Fingerprint: fingerprint(leaf),
+		DNSNames:    leaf.DNSNames,
+		Issuer:      leaf.Issuer.CommonName,
+		NotAfter:    leaf.NotAfter,
+	}
+}
+
+// summarizeSecretCert summarizes the first certificate in a secret's tls.crt,
+// or returns nil if there isn't one.
+func summarizeSecretCert(secret *v1.Secret) *certSummary {
+	if secret == nil {
+		return nil
+	}
+	block, _ := pem.Decode(secret.Data["tls.crt"])
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return summarizeCert(leaf)
+}
+
+// secretChange describes what publishing a certificate would do to a secret.
+type secretChange struct {
+	Secret      string       `json:"secret"`
+	Action      string       `json:"action"` // "create" or "update"
+	AddedKeys   []string     `json:"addedKeys,omitempty"`
+	ChangedKeys []string     `json:"changedKeys,omitempty"`
+	Old         *certSummary `json:"old,omitempty"`
+	New         *certSummary `json:"new"`
+}
+
+// diffSecret compares the secret as it is now (nil if it doesn't exist) with
+// how it would be after publishing the certificate in bundle.
+func diffSecret(existing, desired *v1.Secret, bundle *certBundle) *secretChange {
+	c := &secretChange{
+		Secret: desired.Namespace + "/" + desired.Name,
+		Action: "update",
+		Old:    summarizeSecretCert(existing),
+		New:    summarizeCert(bundle.Leaf),
+	}
+	var old map[string][]byte
+	if existing == nil {
+		c.Action = "create"
+	} else {
+		old = existing.Data
+	}
+	for key, val := range desired.Data {
+		prev, ok := old[key]
+		if !ok {
+			c.AddedKeys = append(c.AddedKeys, key)
+		} else if !bytes.Equal(prev, val) {
+			c.ChangedKeys = append(c.ChangedKeys, key)
+		}
+	}
+	sort.Strings(c.AddedKeys)
+	sort.Strings(c.ChangedKeys)
+	return c
+}
+
+// String formats the change as a short diff for people to read.
+func (c *secretChange) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Would %s secret %s\n", c.Action, c.Secret)
+	for _, key := range c.AddedKeys {
+		fmt.Fprintf(&buf, "  + %s\n", key)
+	}
+	for _, key := range c.ChangedKeys {
+		fmt.Fprintf(&buf, "  ~ %s\n", key)
+	}
+	line := func(field, old, new string) {
+		if c.Old == nil {
+			fmt.Fprintf(&buf, "  %-12s %s\n", field+":", new)
+		} else if old == new {
+			fmt.Fprintf(&buf, "  %-12s %s (unchanged)\n", field+":", new)
+		} else {
+			fmt.Fprintf(&buf, "  %-12s %s -> %s\n", field+":", old, new)
+		}
+	}
+	var old certSummary
+	if c.Old != nil {
+		old = *c.Old
+	}
+	line("fingerprint", old.Fingerprint, c.New.Fingerprint)
+	line("names", strings.Join(old.DNSNames, ","), strings.Join(c.New.DNSNames, ","))
+	line("issuer", old.Issuer, c.New.Issuer)
+	line("not after", formatTime(old.NotAfter), formatTime(c.New.NotAfter))
+	return buf.String()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// dryRunCache is an autocert.Cache that keeps everything in memory, so a dry
+// run always goes through a full issuance and never writes to the cache
+// secret. When a certificate is stored it reports what publishing it would
+// have changed in the live Ingress secret, which is only read.
+type dryRunCache struct {
+	live *kubernetesCache
+	out  io.Writer
+
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newDryRunCache(live *kubernetesCache, out io.Writer) *dryRunCache {
+	return &dryRunCache{live: live, out: out, data: make(map[string][]byte)}
+}
+
+func (d *dryRunCache) Get(ctx context.Context, name string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, ok := d.data[name]
+	if !ok {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (d *dryRunCache) Put(ctx context.Context, name string, data []byte) error {
+	d.mu.Lock()
+	d.data[name] = data
+	d.mu.Unlock()
+	if !d.live.isPrivateCert(name) {
+		return nil
+	}
+	change, err := d.plan(data)
+	certStatus.setDryRun(d.live.domain, change, err)
+	if err != nil {
+		logger.Error("dry run: could not work out changes", "domain", d.live.domain, "err", err)
+		return nil
+	}
+	logger.Info("dry run: issued certificate", "domain", d.live.domain, "secret", change.Secret, "action", change.Action, "fingerprint", change.New.Fingerprint)
+	fmt.Fprint(d.out, change)
+	return nil
+}
+
+func (d *dryRunCache) plan(data []byte) (*secretChange, error) {
+	bundle, err := parseCertBundle(data)
+	if err != nil {
+		return nil, err
+	}
+	existing, desired, err := d.live.desiredIngressSecret(bundle)
+	if err != nil {
+		return nil, err
+	}
+	return diffSecret(existing, desired, bundle), nil
+}
+
+func (d *dryRunCache) Delete(ctx context.Context, name string) error {
+	d.mu.Lock()
+	delete(d.data, name)
+	d.mu.Unlock()
+	return nil
+}
+
+// dryRunIssue asks the manager for a certificate for domain, as a client
+// connecting would. It's used to start a dry run without waiting for traffic.
+func dryRunIssue(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error), domain string) {
+	logger.Info("dry run: requesting certificate", "domain", domain)
+	_, err := getCert(ecdsaHello(domain))
+	if err != nil {
+		certStatus.setDryRun(domain, nil, err)
+		logger.Error("dry run: issuance failed", "domain", domain, "err", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestDiffSecret(t *testing.T) {
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldBundle, err := parseCertBundle(newTestBundle(t, "example.com", notAfter.Add(-90*24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBundle, err := parseCertBundle(newTestBundle(t, "example.com", notAfter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := meta_v1.ObjectMeta{Name: "acme.ingress.secret", Namespace: "default"}
+	existing := &v1.Secret{ObjectMeta: meta, Data: map[string][]byte{
+		"tls.crt": oldBundle.CertsPEM,
+		"tls.key": oldBundle.KeyPEM,
+		"other":   []byte("unchanged"),
+	}}
+	desired := &v1.Secret{ObjectMeta: meta, Data: map[string][]byte{
+		"tls.crt":          newBundle.CertsPEM,
+		"tls.key":          newBundle.KeyPEM,
+		"other":            []byte("unchanged"),
+		"tls-combined.pem": []byte("combined"),
+	}}
+
+	c := diffSecret(existing, desired, newBundle)
+	if c.Action != "update" || c.Secret != "default/acme.ingress.secret" {
+		t.Errorf("got action %q on %q", c.Action, c.Secret)
+	}
+	if !reflect.DeepEqual(c.AddedKeys, []string{"tls-combined.pem"}) {
+		t.Errorf("got added keys %v", c.AddedKeys)
+	}
+	if !reflect.DeepEqual(c.ChangedKeys, []string{"tls.crt", "tls.key"}) {
+		t.Errorf("got changed keys %v", c.ChangedKeys)
+	}
+	if c.Old == nil || c.Old.Fingerprint != oldBundle.Fingerprint() || c.New.Fingerprint != newBundle.Fingerprint() {
+		t.Errorf("got fingerprints %+v -> %+v", c.Old, c.New)
+	}
+	out := c.String()
+	for _, want := range []string{
+		"Would update secret default/acme.ingress.secret",
+		"+ tls-combined.pem",
+		"names:       example.com (unchanged)",
+		"not after:   2029-10-03T00:00:00Z -> 2030-01-01T00:00:00Z",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+
+	c = diffSecret(nil, desired, newBundle)
+	if c.Action != "create" || c.Old != nil || len(c.AddedKeys) != 4 {
+		t.Errorf("create: got %+v", c)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP connection security.
+const (
+	smtpSTARTTLS = "starttls"
+	smtpImplicit = "implicit"
+	smtpNone     = "none"
+)
+
+const defaultDigestInterval = 24 * time.Hour
+
+// defaultEmailEvents are the events emailed as they happen.
+var defaultEmailEvents = []string{notifyIssuanceFailed, notifyPublishFailed, notifyExpiring}
+
+// emailSink emails notifications through an SMTP server, and a periodic
+// digest of every certificate that's failing or expiring soon.
+type emailSink struct {
+	Host string
+	Port int
+	// TLS is smtpSTARTTLS, smtpImplicit or smtpNone.
+	TLS      string
+	Username string
+	Password string
+	From     string
+	To       []string
+	// Events emailed as they happen.
+	Events map[string]bool
+	// Recipients returns the extra recipients for a certificate's alerts.
+	Recipients func(domain string) []string
+
+	// Every DigestInterval, certificates that are failing or expire within
+	// DigestExpiry are summarized. A zero DigestInterval disables digests.
+	DigestInterval time.Duration
+	DigestExpiry   time.Duration
+
+	// TLSConfig, if set, is used instead of verifying the server as Host.
+	TLSConfig *tls.Config
+}
+
+// newEmailSink returns the email sink ec describes. lookupEnv resolves
+// usernameEnv and passwordEnv.
+func newEmailSink(ec emailConfig, lookupEnv func(string) (string, bool), recipients func(string) []string) (*emailSink, error) {
+	e := &emailSink{
+		Host:           ec.Host,
+		Port:           ec.Port,
+		TLS:            ec.TLS,
+		From:           ec.From,
+		To:             ec.To,
+		Events:         make(map[string]bool),
+		Recipients:     recipients,
+		DigestInterval: ec.DigestInterval.Duration,
+		DigestExpiry:   ec.DigestExpiry.Duration,
+	}
+	for _, event := range ec.Events {
+		e.Events[event] = true
+	}
+	for _, v := range []struct {
+		name string
+		dst  *string
+	}{{ec.UsernameEnv, &e.Username}, {ec.PasswordEnv, &e.Password}} {
+		if v.name == "" {
+			continue
+		}
+		s, ok := lookupEnv(v.name)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("$%s is not set", v.name)
+		}
+		*v.dst = s
+	}
+	return e, nil
+}
+
+func (e *emailSink) name() string {
+	return "email"
+}
+
+func (e *emailSink) wants(n *notification) bool {
+	return e.Events[n.Event]
+}
+
+// recipientsFor returns To and the recipients for domain, without
+// duplicates.
+func (e *emailSink) recipientsFor(domain string) []string {
+	seen := make(map[string]bool)
+	var to []string
+	extra := []string(nil)
+	if e.Recipients != nil {
+		extra = e.Recipients(domain)
+	}
+	for _, addr := range append(append([]string{}, e.To...), extra...) {
+		if key := strings.ToLower(addr); !seen[key] {
+			seen[key] = true
+			to = append(to, addr)
+		}
+	}
+	return to
+}
+
+func (e *emailSink) send(ctx context.Context, n *notification) error {
+	to := e.recipientsFor(n.Domain)
+	if len(to) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s\n\n", n.Message)
+	writeField := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&body, "%-12s %s\n", name+":", value)
+		}
+	}
+	writeField("Domain", n.Domain)
+	writeField("Namespace", n.Namespace)
+	writeField("Secret", n.Secret)
+	writeField("Issuer", n.Issuer)
+	if n.NotAfter != nil {
+		writeField("Expires", n.NotAfter.UTC().Format(time.RFC3339))
+	}
+	writeField("Fingerprint", n.Fingerprint)
+	writeField("Error", n.Error)
+	writeField("Time", n.Time.UTC().Format(time.RFC3339))
+	subject := n.Title()
+	if n.Severity == "critical" {
+		subject = "CRITICAL: " + subject
+	}
+	return e.sendMail(ctx, to, subject, body.String())
+}
+
+// digest returns the body of a digest of the certificates in statuses that
+// are failing or expire within e.DigestExpiry, or "" if there are none.
+func (e *emailSink) digest(statuses []certificateStatus, now time.Time) string {
+	var failing, expiring bytes.Buffer
+	for _, st := range statuses {
+		if st.LastOutcome == "failure" {
+			fmt.Fprintf(&failing, "  %s\n    last attempt %s: %s\n", st.Domain, st.LastAttempt.UTC().Format(time.RFC3339), st.LastError)
+			if st.BackoffUntil != nil {
+				fmt.Fprintf(&failing, "    backing off until %s (%s)\n", st.BackoffUntil.UTC().Format(time.RFC3339), st.BackoffReason)
+			}
+		}
+		if st.NotAfter != nil && st.NotAfter.Sub(now) < e.DigestExpiry {
+			left := "EXPIRED"
+			if st.NotAfter.After(now) {
+				left = "in " + formatDays(st.NotAfter.Sub(now))
+			}
+			fmt.Fprintf(&expiring, "  %s\n    expires %s, %s", st.Domain, st.NotAfter.UTC().Format(time.RFC3339), left)
+			if st.NextRenewal != nil && st.NextRenewal.After(now) {
+				fmt.Fprintf(&expiring, "; renewal due %s", st.NextRenewal.UTC().Format(time.RFC3339))
+			}
+			expiring.WriteString("\n")
+		}
+	}
+	if failing.Len() == 0 && expiring.Len() == 0 {
+		return ""
+	}
+	var body bytes.Buffer
+	if failing.Len() > 0 {
+		fmt.Fprintf(&body, "Failing to renew:\n\n%s\n", failing.String())
+	}
+	if expiring.Len() > 0 {
+		fmt.Fprintf(&body, "Expiring within %s:\n\n%s\n", formatDays(e.DigestExpiry), expiring.String())
+	}
+	return body.String()
+}
+
+// sendDigests emails each recipient a digest of the certificates in s they
+// get alerts for, if any need attention.
+func (e *emailSink) sendDigests(ctx context.Context, s *statusTracker, namespace string, now time.Time) {
+	byRecipient := make(map[string][]certificateStatus)
+	var recipients []string
+	for _, st := range s.list() {
+		for _, addr := range e.recipientsFor(st.Domain) {
+			if _, ok := byRecipient[addr]; !ok {
+				recipients = append(recipients, addr)
+			}
+			byRecipient[addr] = append(byRecipient[addr], st)
+		}
+	}
+	sort.Strings(recipients)
+	for _, addr := range recipients {
+		body := e.digest(byRecipient[addr], now)
+		if body == "" {
+			continue
+		}
+		subject := fmt.Sprintf("Certificate digest for %s: certificates need attention", namespace)
+		if err := e.sendMail(ctx, []string{addr}, subject, body); err != nil {
+			notificationsSent.Inc(e.name(), "digest", "failed")
+			logger.Error("could not send digest", "to", addr, "err", err)
+			continue
+		}
+		notificationsSent.Inc(e.name(), "digest", "sent")
+	}
+}
+
+// run sends digests every DigestInterval until ctx is done.
+func (e *emailSink) run(ctx context.Context, s *statusTracker, namespace string) {
+	if e.DigestInterval <= 0 {
+		return
+	}
+	for {
+		t := time.NewTimer(e.DigestInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		sendCtx, cancel := context.WithTimeout(ctx, e.DigestInterval)
+		e.sendDigests(sendCtx, s, namespace, time.Now())
+		cancel()
+	}
+}
+
+// message returns an RFC 5322 message with a quoted-printable plain text
+// body.
+func (e *emailSink) message(to []string, subject, body string, now time.Time) []byte {
+	var id [12]byte
+	rand.Read(id[:])
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", e.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[k8s-cert-generator] "+subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%x@%s>\r\n", id, e.Host)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	qp.Close()
+	return buf.Bytes()
+}
+
+// envelopeAddress returns the bare address in addr, which may have a display
+// name like "On call <oncall@example.com>".
+func envelopeAddress(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		return a.Address
+	}
+	return addr
+}
+
+// smtpError prefixes err with what was being done, and marks it permanent if
+// the server rejected the command with a 5xx reply; 4xx replies are worth
+// retrying.
+func smtpError(what string, err error) error {
+	wrapped := fmt.Errorf("%s: %v", what, err)
+	if tp, ok := err.(*textproto.Error); ok && tp.Code >= 500 {
+		return permanentError{wrapped}
+	}
+	return wrapped
+}
+
+// sendMail delivers a message to the SMTP server. net/smtp won't send
+// credentials over an unencrypted connection, except to localhost.
+func (e *emailSink) sendMail(ctx context.Context, to []string, subject, body string) error {
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	tlsConfig := e.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: e.Host}
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if e.TLS == smtpImplicit {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if e.TLS == smtpSTARTTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return permanentError{fmt.Errorf("%s doesn't support STARTTLS", addr)}
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if e.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.Username, e.Password, e.Host)); err != nil {
+			return permanentError{fmt.Errorf("authenticating as %s: %v", e.Username, err)}
+		}
+	}
+	if err := c.Mail(envelopeAddress(e.From)); err != nil {
+		return smtpError("sender "+e.From, err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(envelopeAddress(rcpt)); err != nil {
+			return smtpError("recipient "+rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(e.message(to, subject, body, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
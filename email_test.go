@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpMessage is a message received by fakeSMTPServer.
+type smtpMessage struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer is a plain text SMTP server on localhost that records the
+// messages it receives, and rejects recipients in reject.
+type fakeSMTPServer struct {
+	l      net.Listener
+	reject map[string]bool
+
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{l: l, reject: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ESMTP")
+	var m smtpMessage
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			fields := strings.Fields(line)
+			creds, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			m.auth = strings.Replace(string(creds), "\x00", " ", -1)
+			c.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL":
+			m.from = line[len("MAIL FROM:"):]
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			to := line[len("RCPT TO:"):]
+			if s.reject[to] {
+				c.PrintfLine("550 5.1.1 No such user")
+				continue
+			}
+			m.to = append(m.to, to)
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m.data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, m)
+			s.mu.Unlock()
+			m = smtpMessage{}
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+// received returns and forgets the messages s has received.
+func (s *fakeSMTPServer) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.messages
+	s.messages = nil
+	return m
+}
+
+func TestEmailSink(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	defer srv.l.Close()
+	srv.reject["<nobody@example.com>"] = true
+
+	env := map[string]string{"SMTP_USER": "alerts", "SMTP_PASSWORD": "hunter2"}
+	lookup := func(name string) (string, bool) { v, ok := env[name]; return v, ok }
+	recipients := map[string][]string{"example.com": {"Web team <web@example.com>", "OPS@example.com"}}
+	e, err := newEmailSink(emailConfig{
+		Host:        "localhost",
+		Port:        srv.port(),
+		TLS:         smtpNone,
+		UsernameEnv: "SMTP_USER",
+		PasswordEnv: "SMTP_PASSWORD",
+		From:        "Certificates <certs@example.com>",
+		To:          []string{"ops@example.com"},
+		Events:      defaultEmailEvents,
+	}, lookup, func(domain string) []string { return recipients[domain] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.wants(&notification{Event: notifyRenewed}) {
+		t.Error("renewals are not emailed by default")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	notAfter := time.Now().Add(12 * time.Hour)
+	err = e.send(ctx, &notification{
+		Event:    notifyExpiring,
+		Severity: "critical",
+		Domain:   "example.com",
+		Message:  "Certificate for example.com expires in 12 hours",
+		Time:     time.Now(),
+		NotAfter: &notAfter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := srv.received()
+	if len(got) != 1 {
+		t.Fatalf("got %d messages, want 1", len(got))
+	}
+	m := got[0]
+	if m.auth != " alerts hunter2" {
+		t.Errorf("got AUTH PLAIN %q", m.auth)
+	}
+	if m.from != "<certs@example.com>" || strings.Join(m.to, ",") != "<ops@example.com>,<web@example.com>" {
+		t.Errorf("got envelope from %s to %v", m.from, m.to)
+	}
+	for _, want := range []string{
+		"Subject: [k8s-cert-generator] CRITICAL: Certificate for example.com expires soon",
+		"To: ops@example.com, Web team <web@example.com>",
+		"Domain:      example.com",
+	} {
+		if !strings.Contains(m.data, want) {
+			t.Errorf("message is missing %q:\n%s", want, m.data)
+		}
+	}
+
+	// Rejected recipients aren't worth retrying.
+	e.To = []string{"nobody@example.com"}
+	err = e.send(ctx, &notification{Event: notifyIssuanceFailed, Domain: "other.com", Time: time.Now()})
+	if _, ok := err.(permanentError); !ok {
+		t.Errorf("got %v, want a permanent error", err)
+	}
+
+	if _, err := newEmailSink(emailConfig{Host: "localhost", UsernameEnv: "UNSET", PasswordEnv: "SMTP_PASSWORD"}, lookup, nil); err == nil {
+		t.Error("expected an error for an unset usernameEnv")
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	defer srv.l.Close()
+
+	now := time.Now()
+	s := newStatusTracker(defaultRenewBefore)
+	for domain, expires := range map[string]time.Duration{
+		"soon.example.com":  3 * 24 * time.Hour,
+		"later.example.com": 60 * 24 * time.Hour,
+	} {
+		b, err := parseCertBundle(newTestBundle(t, domain, now.Add(expires)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.setCertificate(domain, b)
+	}
+	recipients := map[string][]string{"later.example.com": {"later@example.com"}}
+	e := &emailSink{
+		Host:         "localhost",
+		Port:         srv.port(),
+		TLS:          smtpNone,
+		From:         "certs@example.com",
+		To:           []string{"ops@example.com"},
+		Recipients:   func(domain string) []string { return recipients[domain] },
+		DigestExpiry: 30 * 24 * time.Hour,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.sendDigests(ctx, s, "web", now)
+
+	// later@example.com only gets later.example.com, which is fine.
+	got := srv.received()
+	if len(got) != 1 {
+		t.Fatalf("got %d digests, want 1", len(got))
+	}
+	if strings.Join(got[0].to, ",") != "<ops@example.com>" {
+		t.Errorf("got digest for %v", got[0].to)
+	}
+	body := got[0].data
+	if !strings.Contains(body, "Expiring within 30 days:") || !strings.Contains(body, "soon.example.com") || strings.Contains(body, "later.example.com") {
+		t.Errorf("got digest:\n%s", body)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Event reasons recorded against the target object.
+const (
+	reasonIssued           = "Issued"
+	reasonRenewed          = "Renewed"
+	reasonIssuanceFailed   = "IssuanceFailed"
+	reasonPublished        = "Published"
+	reasonPublishFailed    = "PublishFailed"
+	reasonValidationFailed = "ValidationFailed"
+	reasonRestarted        = "RestartedWorkload"
+	reasonImported         = "Imported"
+	reasonIssuerChanged    = "IssuerChanged"
+)
+
+const eventComponent = "k8s-cert-generator"
+
+// eventRecorder records Kubernetes Events against a single object, so
+// `kubectl describe` on it shows what the generator has been doing. client-go's
+// tools/record isn't vendored, so this does the minimum: create an Event, or
+// bump the count on the last identical one.
+type eventRecorder struct {
+	Client    kubernetes.Interface
+	Namespace string
+
+	// Kind and Name of the object to record events against, e.g. "Secret"
+	// and "acme.ingress.secret". Secrets and Ingresses are looked up to find
+	// their UID, which kubectl describe needs to match events to the object.
+	Kind string
+	Name string
+
+	host string
+
+	mu     sync.Mutex
+	recent map[string]*v1.Event
+}
+
+// events is the process wide event recorder. It is nil, and recording is a
+// no-op, until main sets it up.
+var events *eventRecorder
+
+func newEventRecorder(client kubernetes.Interface, namespace, kind, name string) *eventRecorder {
+	host, _ := os.Hostname()
+	return &eventRecorder{
+		Client:    client,
+		Namespace: namespace,
+		Kind:      kind,
+		Name:      name,
+		host:      host,
+		recent:    make(map[string]*v1.Event),
+	}
+}
+
+// parseEventObject parses a "Kind/name" reference as passed to -events-for.
+func parseEventObject(s string) (kind, name string, err error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid object %q: expected Kind/name, e.g. Ingress/my-ingress", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// objectReference returns a reference to the object events are recorded
+// against.
+func (r *eventRecorder) objectReference() v1.ObjectReference {
+	ref := v1.ObjectReference{Kind: r.Kind, Name: r.Name, Namespace: r.Namespace}
+	switch r.Kind {
+	case "Secret":
+		ref.APIVersion = "v1"
+		if s, err := r.Client.CoreV1().Secrets(r.Namespace).Get(r.Name, meta_v1.GetOptions{}); err == nil {
+			ref.UID = s.UID
+			ref.ResourceVersion = s.ResourceVersion
+		}
+	case "Ingress":
+		ref.APIVersion = "extensions/v1beta1"
+		if ing, err := r.Client.ExtensionsV1beta1().Ingresses(r.Namespace).Get(r.Name, meta_v1.GetOptions{}); err == nil {
+			ref.UID = ing.UID
+			ref.ResourceVersion = ing.ResourceVersion
+		}
+	}
+	return ref
+}
+
+// Eventf records an event in the background. r may be nil.
+func (r *eventRecorder) Eventf(eventType, reason, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	go func() {
+		if err := r.record(eventType, reason, message); err != nil {
+			logger.Warn("recording event", "reason", reason, "err", err)
+		}
+	}()
+}
+
+func (r *eventRecorder) record(eventType, reason, message string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := meta_v1.NewTime(time.Now())
+	key := eventType + "\xff" + reason + "\xff" + message
+	if prev, ok := r.recent[key]; ok {
+		ev := *prev
+		ev.Count++
+		ev.LastTimestamp = now
+		updated, err := r.Client.CoreV1().Events(r.Namespace).Update(&ev)
+		if err == nil {
+			r.recent[key] = updated
+			return nil
+		}
+		// The event may have been garbage collected; fall through and create
+		// a new one.
+		delete(r.recent, key)
+	}
+	ev := &v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", r.Name, time.Now().UnixNano()),
+			Namespace: r.Namespace,
+		},
+		InvolvedObject: r.objectReference(),
+		Reason:         reason,
+		Message:        message,
+		Source:         v1.EventSource{Component: eventComponent, Host: r.host},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+	created, err := r.Client.CoreV1().Events(r.Namespace).Create(ev)
+	if err != nil {
+		return err
+	}
+	// Only remember the last event for each reason, so the map stays small.
+	for k, prev := range r.recent {
+		if prev.Reason == reason {
+			delete(r.recent, k)
+		}
+	}
+	r.recent[key] = created
+	return nil
+}
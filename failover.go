@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Defaults for policies.failoverAfter and policies.emergencyWindow.
+const (
+	defaultFailoverAfter   = 48 * time.Hour
+	defaultEmergencyWindow = 14 * 24 * time.Hour
+)
+
+// failoverCheckInterval is how often a failoverSource looks at the cached
+// certificates to decide which issuer should be active.
+const failoverCheckInterval = 5 * time.Minute
+
+// failoverCandidate is one of the issuers a failoverSource can use. Each has
+// its own autocert.Manager, and so its own ACME account and cache entries.
+type failoverCandidate struct {
+	Issuer string
+	cache  *kubernetesCache
+	source certificateSource
+}
+
+// failoverPolicy says when a failoverSource changes issuer.
+type failoverPolicy struct {
+	// Fail over when the active issuer has been failing this long...
+	FailoverAfter time.Duration
+	// ...or at once if it's failing and the newest certificate expires
+	// within this window.
+	EmergencyWindow time.Duration
+	// How long before expiry certificates are renewed.
+	RenewBefore time.Duration
+}
+
+// failoverState is which issuer a failoverSource is using and how it's
+// doing.
+type failoverState struct {
+	Active int
+	// When the active issuer started failing, if it has.
+	FailingSince time.Time
+	// When Active last changed.
+	SwitchedAt time.Time
+}
+
+// failoverSource gets a certificate from the first of several ACME issuers,
+// and moves down the list when the active one keeps failing, e.g. because
+// the CA is down or rate limiting us. It moves back to the first issuer when
+// the certificate from the fallback is due for renewal. Only the active
+// issuer may start orders; the others stand by.
+type failoverSource struct {
+	Domain     string
+	Candidates []*failoverCandidate
+	Policy     failoverPolicy
+
+	mu    sync.Mutex
+	state failoverState
+}
+
+// standby returns the standby function for the transport of candidate i.
+func (f *failoverSource) standby(i int) func() bool {
+	return func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.state.Active != i
+	}
+}
+
+// active returns the active candidate.
+func (f *failoverSource) active() *failoverCandidate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Candidates[f.state.Active]
+}
+
+// backoffScope returns the backoff scope of the active candidate.
+func (f *failoverSource) backoffScope() string {
+	return f.active().cache.backoffScope
+}
+
+// caches returns the caches of every candidate.
+func (f *failoverSource) caches() []*kubernetesCache {
+	caches := make([]*kubernetesCache, len(f.Candidates))
+	for i, c := range f.Candidates {
+		caches[i] = c.cache
+	}
+	return caches
+}
+
+// noteResult records the outcome of asking the active issuer for a
+// certificate.
+func (f *failoverSource) noteResult(err error, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case err == nil:
+		f.state.FailingSince = time.Time{}
+	case f.state.FailingSince.IsZero():
+		f.state.FailingSince = now
+	}
+}
+
+func (f *failoverSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if isChallengeHello(hello) {
+		// The token certificate is held by whichever manager is
+		// validating.
+		var err error
+		for _, c := range f.Candidates {
+			var cert *tls.Certificate
+			if cert, err = c.source.GetCertificate(hello); err == nil {
+				return cert, nil
+			}
+		}
+		return nil, err
+	}
+	cert, err := f.active().source.GetCertificate(hello)
+	f.noteResult(err, time.Now())
+	return cert, err
+}
+
+// HTTPHandler answers http-01 challenges for any of the issuers, since a
+// standby issuer's order may still be in flight.
+func (f *failoverSource) HTTPHandler(fallback http.Handler) http.Handler {
+	h := fallback
+	for i := len(f.Candidates) - 1; i >= 0; i-- {
+		h = f.Candidates[i].source.HTTPHandler(h)
+	}
+	return h
+}
+
+func (f *failoverSource) run(ctx context.Context) {
+	f.mu.Lock()
+	f.state.SwitchedAt = time.Now()
+	f.mu.Unlock()
+	certStatus.setActiveIssuer(f.Domain, f.Candidates[0].Issuer)
+	for {
+		f.check(time.Now())
+		t := time.NewTimer(failoverCheckInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// check changes issuer if the policy says to, and asks the active issuer for
+// a certificate if it doesn't have one.
+func (f *failoverSource) check(now time.Time) {
+	leaves := make([]*x509.Certificate, len(f.Candidates))
+	for i, c := range f.Candidates {
+		b, err := c.cache.cached()
+		if err != nil {
+			// Don't fail over because we can't see the cache.
+			logger.Warn("could not read cached certificate", "domain", f.Domain, "issuer", c.Issuer, "err", err)
+			return
+		}
+		if b != nil {
+			leaves[i] = b.Leaf
+		}
+	}
+
+	f.mu.Lock()
+	prev := f.state.Active
+	next, reason := decideFailover(f.state, leaves, now, f.Policy)
+	if next != prev {
+		f.state = failoverState{Active: next, SwitchedAt: now}
+	}
+	f.mu.Unlock()
+
+	active := f.Candidates[next]
+	if next != prev {
+		from := f.Candidates[prev].Issuer
+		logger.Warn("changing issuer", "domain", f.Domain, "from", from, "to", active.Issuer, "reason", reason)
+		eventType := v1.EventTypeWarning
+		if next < prev {
+			eventType = v1.EventTypeNormal
+		}
+		events.Eventf(eventType, reasonIssuerChanged, "Certificate for %s now comes from %s instead of %s: %s", f.Domain, active.Issuer, from, reason)
+		issuerChanges.Inc(f.Domain, active.Issuer)
+		certStatus.setActiveIssuer(f.Domain, active.Issuer)
+	}
+	if leaves[next] == nil || !now.Before(leaves[next].NotAfter) || next != prev {
+		// autocert only orders when asked for the certificate, so ask.
+		_, err := active.source.GetCertificate(ecdsaHello(f.Domain))
+		f.noteResult(err, now)
+		if err != nil && pendingOrders.finish(scopedBackoffDomain(active.cache.backoffScope, f.Domain)) {
+			recordIssuanceFailure(f.Domain, active.cache.backoffScope, err)
+		}
+	}
+}
+
+// decideFailover returns the candidate that should be active, and why it
+// changed. leaves holds each candidate's cached certificate, or nil.
+func decideFailover(st failoverState, leaves []*x509.Certificate, now time.Time, p failoverPolicy) (int, string) {
+	active := st.Active
+	current := leaves[active]
+	var newest *x509.Certificate
+	for _, leaf := range leaves {
+		if leaf != nil && (newest == nil || leaf.NotAfter.After(newest.NotAfter)) {
+			newest = leaf
+		}
+	}
+
+	// A certificate that's overdue for renewal means renewals have been
+	// failing since it was due, even if nothing told us.
+	failingSince := st.FailingSince
+	if current != nil {
+		if due := current.NotAfter.Add(-p.RenewBefore); now.After(due) && (failingSince.IsZero() || due.Before(failingSince)) {
+			failingSince = due
+		}
+	}
+	// Give a newly active issuer the full period.
+	if !failingSince.IsZero() && failingSince.Before(st.SwitchedAt) {
+		failingSince = st.SwitchedAt
+	}
+
+	if active > 0 && current != nil && !now.Before(current.NotAfter.Add(-p.RenewBefore)) && now.Sub(st.SwitchedAt) >= p.FailoverAfter {
+		return 0, "the certificate from the fallback issuer is due for renewal"
+	}
+	if failingSince.IsZero() || active == len(leaves)-1 {
+		return active, ""
+	}
+	if newest != nil && !now.Before(newest.NotAfter.Add(-p.EmergencyWindow)) {
+		return active + 1, fmt.Sprintf("issuance is failing and the certificate expires at %s, within the emergency window", newest.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if now.Sub(failingSince) >= p.FailoverAfter {
+		return active + 1, fmt.Sprintf("issuance has been failing since %s", failingSince.UTC().Format(time.RFC3339))
+	}
+	return active, ""
+}
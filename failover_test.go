@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestDecideFailover(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	p := failoverPolicy{FailoverAfter: 48 * time.Hour, EmergencyWindow: 14 * day, RenewBefore: 30 * day}
+	expiring := func(in time.Duration) *x509.Certificate {
+		return &x509.Certificate{NotAfter: now.Add(in)}
+	}
+	longAgo := now.Add(-90 * day)
+	tests := []struct {
+		name   string
+		st     failoverState
+		leaves []*x509.Certificate
+		want   int
+	}{
+		{"healthy primary", failoverState{SwitchedAt: longAgo}, []*x509.Certificate{expiring(60 * day), nil}, 0},
+		{"renewal overdue", failoverState{SwitchedAt: longAgo}, []*x509.Certificate{expiring(20 * day), nil}, 1},
+		{"failing briefly", failoverState{SwitchedAt: longAgo, FailingSince: now.Add(-time.Hour)}, []*x509.Certificate{nil, nil}, 0},
+		{"failing for days", failoverState{SwitchedAt: longAgo, FailingSince: now.Add(-3 * day)}, []*x509.Certificate{nil, nil}, 1},
+		{"emergency", failoverState{SwitchedAt: longAgo, FailingSince: now.Add(-time.Hour)}, []*x509.Certificate{expiring(10 * day), nil}, 1},
+		{"emergency on fallback", failoverState{Active: 1, SwitchedAt: now.Add(-time.Hour), FailingSince: now.Add(-time.Minute)}, []*x509.Certificate{expiring(10 * day), nil, nil}, 2},
+		{"last issuer", failoverState{Active: 1, SwitchedAt: longAgo, FailingSince: now.Add(-3 * day)}, []*x509.Certificate{nil, nil}, 1},
+		{"fallback due for renewal", failoverState{Active: 1, SwitchedAt: now.Add(-60 * day)}, []*x509.Certificate{nil, expiring(29 * day)}, 0},
+		{"fallback due right after failing over", failoverState{Active: 1, SwitchedAt: now.Add(-time.Hour)}, []*x509.Certificate{nil, expiring(29 * day)}, 1},
+		{"primary gets a full period after switching back", failoverState{SwitchedAt: now.Add(-time.Hour), FailingSince: now.Add(-time.Hour)}, []*x509.Certificate{expiring(-time.Hour), expiring(29 * day)}, 0},
+	}
+	for _, tt := range tests {
+		got, reason := decideFailover(tt.st, tt.leaves, now, p)
+		if got != tt.want {
+			t.Errorf("%s: got issuer %d, want %d (%s)", tt.name, got, tt.want, reason)
+		}
+		if (got != tt.st.Active) != (reason != "") {
+			t.Errorf("%s: got reason %q for issuer %d", tt.name, reason, got)
+		}
+	}
+}
+
+func TestValidateFallbackIssuers(t *testing.T) {
+	c, err := parseConfig([]byte(`
+issuers:
+  letsencrypt: {}
+  zerossl:
+    directoryURL: https://acme.zerossl.com/v2/DV90
+  internal: {type: ca, caSecret: ca}
+certificates:
+- domain: example.com
+  issuer: letsencrypt
+  fallbackIssuers: [zerossl, zerossl, internal, letsencrypt, nope]
+  ingressSecret: tls
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, _ := c.validate().(configErrors)
+	want := []string{
+		"certificates[0].fallbackIssuers: zerossl is listed more than once",
+		"certificates[0].fallbackIssuers: internal is not an acme issuer",
+		"certificates[0].fallbackIssuers: letsencrypt is listed more than once",
+		`certificates[0].fallbackIssuers: no issuer named "nope"`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got errors %v, want %d", errs, len(want))
+	}
+	for i, w := range want {
+		if errs[i][:len(w)] != w {
+			t.Errorf("got %q, want %q", errs[i], w)
+		}
+	}
+	if c.Policies.FailoverAfter.Duration != defaultFailoverAfter || c.Policies.EmergencyWindow.Duration != defaultEmergencyWindow {
+		t.Errorf("got policies %+v", c.Policies)
+	}
+}
+
+// errorSource is a certificateSource that always fails.
+type errorSource struct{ err error }
+
+func (s errorSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return nil, s.err
+}
+
+func (s errorSource) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+func TestFailoverBackoffScope(t *testing.T) {
+	backoffs = newBackoffTracker(new(memoryBackoffStore))
+	defer func() { backoffs = nil }()
+	backoffs.recordFailure("example.com", errors.New("primary is down"))
+	primaryUntil, _ := backoffs.active("example.com")
+
+	f := &failoverSource{
+		Domain: "example.com",
+		Candidates: []*failoverCandidate{
+			{Issuer: "letsencrypt", cache: &kubernetesCache{}, source: errorSource{errors.New("primary is down")}},
+			{Issuer: "zerossl", cache: &kubernetesCache{backoffScope: "zerossl"}, source: errorSource{errors.New("fallback is down")}},
+		},
+		state: failoverState{Active: 1},
+	}
+	certs := newCertificateSet()
+	certs.certs["example.com"] = &managedCertificate{Config: certificateConfig{Domain: "example.com"}, source: f}
+	getCert := instrumentGetCertificate(certs.managed, certs.backoffScope, certs.GetCertificate)
+
+	// The fallback's failure is its own, and doesn't extend the primary's
+	// backoff.
+	pendingOrders.start("example.com@zerossl")
+	if _, err := getCert(&tls.ClientHelloInfo{ServerName: "example.com"}); err == nil {
+		t.Fatal("expected an error from the fallback")
+	}
+	if until, _ := backoffs.active("example.com@zerossl"); until.IsZero() {
+		t.Error("the fallback isn't backing off after failing")
+	}
+	if until, _ := backoffs.active("example.com"); !until.Equal(primaryUntil) {
+		t.Errorf("the primary's backoff changed from %v to %v", primaryUntil, until)
+	}
+
+	// And its success doesn't end it.
+	b, err := parseCertBundle(newTestBundle(t, "example.com", time.Now().Add(90*24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordIssuance("example.com", f.backoffScope(), b)
+	if until, _ := backoffs.active("example.com@zerossl"); !until.IsZero() {
+		t.Error("the fallback is still backing off after an issuance")
+	}
+	if until, _ := backoffs.active("example.com"); until.IsZero() {
+		t.Error("the primary stopped backing off after the fallback issued")
+	}
+}
+
+// helloSource is a certificateSource that records the hellos it's asked
+// for, and has no certificate.
+type helloSource struct{ hellos []*tls.ClientHelloInfo }
+
+func (s *helloSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.hellos = append(s.hellos, hello)
+	return nil, errors.New("no certificate yet")
+}
+
+func (s *helloSource) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+func TestFailoverAsksForECDSA(t *testing.T) {
+	api := newFakeSecretsAPI(&v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: "acme.secret", Namespace: "certs"}})
+	client, srv := api.serve(t)
+	defer srv.Close()
+	src := new(helloSource)
+	f := &failoverSource{
+		Domain: "example.com",
+		Candidates: []*failoverCandidate{{
+			Issuer: "letsencrypt",
+			cache:  newKubernetesCache("acme.secret", "tls", "certs", "example.com", "", client, 1, outputOptions{}, false),
+			source: src,
+		}},
+		Policy: failoverPolicy{FailoverAfter: defaultFailoverAfter, EmergencyWindow: defaultEmergencyWindow, RenewBefore: defaultRenewBefore},
+	}
+	f.check(time.Now())
+
+	// autocert gets an RSA certificate, which isn't published, for a
+	// hello that doesn't offer ECDSA.
+	if len(src.hellos) != 1 {
+		t.Fatalf("got %d requests for a certificate, want 1", len(src.hellos))
+	}
+	ecdsa := false
+	for _, suite := range src.hellos[0].CipherSuites {
+		ecdsa = ecdsa || suite == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	}
+	if hello := src.hellos[0]; hello.ServerName != "example.com" || !ecdsa {
+		t.Errorf("asked for a certificate with %+v", hello)
+	}
+}
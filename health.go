@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// healthChecker serves the /healthz and /readyz endpoints used by Kubernetes
+// probes.
+type healthChecker struct {
+	Client     kubernetes.Interface
+	Namespace  string
+	SecretName string
+
+	// The certificates we are expected to have.
+	Certificates *certificateSet
+
+	// Certificates expiring within CriticalWindow are reported as not ready.
+	CriticalWindow time.Duration
+}
+
+// checkAPIServer checks that we can reach the API server and read the cache
+// secret.
+func (h *healthChecker) checkAPIServer() error {
+	_, err := h.Client.CoreV1().Secrets(h.Namespace).Get(h.SecretName, meta_v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("reading secret %s/%s: %v", h.Namespace, h.SecretName, err)
+	}
+	return nil
+}
+
+// checkCertificate returns an error if b is not a usable certificate for
+// domain at time now, or expires within window.
+func checkCertificate(b *certBundle, domain string, now time.Time, window time.Duration) error {
+	if err := b.Leaf.VerifyHostname(domain); err != nil {
+		return err
+	}
+	if now.Before(b.Leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid until %s", b.Leaf.NotBefore.Format(time.RFC3339))
+	}
+	if !now.Before(b.Leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", b.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	if b.Leaf.NotAfter.Sub(now) < window {
+		return fmt.Errorf("certificate expires at %s, within the critical window of %s", b.Leaf.NotAfter.Format(time.RFC3339), window)
+	}
+	return nil
+}
+
+// checkCertificates loads every configured certificate from the cache and
+// checks it. The result has an entry for each domain; a nil error means the
+// certificate is fine.
+func (h *healthChecker) checkCertificates(ctx context.Context) map[string]error {
+	certs := h.Certificates.list()
+	results := make(map[string]error, len(certs))
+	now := time.Now()
+	for _, m := range certs {
+		domain := m.Config.Domain
+		b, err := newestCached(ctx, m)
+		if err != nil {
+			results[domain] = err
+			continue
+		}
+		results[domain] = checkCertificate(b, domain, now, h.CriticalWindow)
+	}
+	return results
+}
+
+// newestCached returns the cached certificate for m that expires last. With
+// fallback issuers, each issuer has its own cache entry.
+func newestCached(ctx context.Context, m *managedCertificate) (*certBundle, error) {
+	caches := m.caches()
+	var newest *certBundle
+	var lastErr error
+	for _, cache := range caches {
+		data, err := cache.Get(ctx, m.Config.Domain)
+		if err == autocert.ErrCacheMiss {
+			continue
+		}
+		if err == nil {
+			var b *certBundle
+			if b, err = parseCertBundle(data); err == nil {
+				if newest == nil || b.Leaf.NotAfter.After(newest.Leaf.NotAfter) {
+					newest = b
+				}
+				continue
+			}
+		}
+		lastErr = err
+	}
+	switch {
+	case newest != nil:
+		if len(caches) > 1 {
+			// Get recorded each one as current in turn.
+			recordCertificate(m.Config.Domain, newest)
+		}
+		return newest, nil
+	case lastErr != nil:
+		return nil, lastErr
+	default:
+		return nil, fmt.Errorf("no certificate in cache")
+	}
+}
+
+func (h *healthChecker) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := h.checkAPIServer(); err != nil {
+		http.Error(w, "api server: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (h *healthChecker) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	results := h.checkCertificates(ctx)
+	status := http.StatusOK
+	body := ""
+	domains := make([]string, 0, len(results))
+	for domain := range results {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		if err := results[domain]; err != nil {
+			status = http.StatusServiceUnavailable
+			body += fmt.Sprintf("%s: %v\n", domain, err)
+		} else {
+			body += fmt.Sprintf("%s: ok\n", domain)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
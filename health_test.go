@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckCertificate(t *testing.T) {
+	now := time.Now()
+	b, err := parseCertBundle(newTestBundle(t, "example.com", now.Add(30*24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCertificate(b, "example.com", now, 7*24*time.Hour); err != nil {
+		t.Errorf("expected valid certificate, got %v", err)
+	}
+	if err := checkCertificate(b, "other.example.com", now, 0); err == nil {
+		t.Error("expected hostname mismatch error")
+	}
+	if err := checkCertificate(b, "example.com", now, 60*24*time.Hour); err == nil {
+		t.Error("expected error for certificate inside critical window")
+	}
+	if err := checkCertificate(b, "example.com", now.Add(31*24*time.Hour), 0); err == nil {
+		t.Error("expected error for expired certificate")
+	}
+}
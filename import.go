@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// errRSAImport is returned for RSA certificates. The vendored autocert only
+// serves ECDSA certificates from a domain's cache entry, and RSA ones from a
+// separate entry for clients without ECDSA support, so an imported RSA
+// certificate would not be served to almost any client, and they would have
+// an ECDSA certificate issued straight away.
+var errRSAImport = errors.New("RSA certificates can't be imported, since every client that supports ECDSA would have a new certificate issued on its first connection; reissue it with an ECDSA key, or let the generator issue one")
+
+// validateImport returns an error if b can't be served for domain at now
+// when issuing from directoryURL.
+func validateImport(b *certBundle, domain, directoryURL string, now time.Time) error {
+	if _, ok := b.Key.(*rsa.PrivateKey); ok {
+		return errRSAImport
+	}
+	if err := checkCertificate(b, domain, now, 0); err != nil {
+		return err
+	}
+	return checkIssuer(b.Leaf, directoryURL)
+}
+
+// importCertificate validates keyPEM and certsPEM as a certificate for
+// k.domain and stores it in the cache under the domain, so it is served and
+// renewed like one we were issued, and publishes it to the Ingress secret.
+func importCertificate(k *kubernetesCache, keyPEM, certsPEM []byte, now time.Time) (*certBundle, error) {
+	b, err := parseCertBundle(append(append([]byte{}, keyPEM...), certsPEM...))
+	if err != nil {
+		return nil, err
+	}
+	if err := validateImport(b, k.domain, k.directoryURL, now); err != nil {
+		return nil, err
+	}
+	// This doesn't go through Put, since the certificate wasn't issued to
+	// us and shouldn't be counted as an issuance. Store it re-encoded the
+	// way autocert does, so it reads back exactly.
+	data := append(append([]byte{}, b.KeyPEM...), b.CertsPEM...)
+	if err := updateSecretKey(k.Client, k.Namespace, k.SecretName, k.secretKey(k.domain), data); err != nil {
+		return nil, err
+	}
+	if err := k.updateIngressSecret(b); err != nil {
+		return nil, err
+	}
+	recordCertificate(k.domain, b)
+	events.Eventf(v1.EventTypeNormal, reasonImported, "Imported existing certificate for %s, issued by %s, expires %s",
+		k.domain, b.Leaf.Issuer.CommonName, b.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	return b, nil
+}
+
+// readTLSSecret returns the tls.key and tls.crt values of a kubernetes.io/tls
+// secret.
+func readTLSSecret(client kubernetes.Interface, namespace, name string) (keyPEM, certsPEM []byte, err error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(name, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, certsPEM = secret.Data["tls.key"], secret.Data["tls.crt"]
+	if len(keyPEM) == 0 || len(certsPEM) == 0 {
+		return nil, nil, fmt.Errorf("secret %s/%s has no tls.key or tls.crt", namespace, name)
+	}
+	return keyPEM, certsPEM, nil
+}
+
+// ensureCacheSecret creates the cache secret if it doesn't exist, since
+// kubernetesCache only updates it.
+func ensureCacheSecret(client kubernetes.Interface, namespace, name string) error {
+	secrets := client.CoreV1().Secrets(namespace)
+	_, err := secrets.Get(name, meta_v1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+	_, err = secrets.Create(&v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: namespace}})
+	return err
+}
+
+// adoptCertificate imports the certificate in the kubernetes.io/tls secret
+// namespace/name into the cache, unless the cache already has one. It's
+// used to take over a hostname from another controller without issuing a
+// new certificate straight away.
+func adoptCertificate(ctx context.Context, k *kubernetesCache, namespace, name string) error {
+	keyPEM, certsPEM, err := readTLSSecret(k.Client, namespace, name)
+	if err != nil {
+		return err
+	}
+	if _, err := k.Get(ctx, k.domain); err == nil {
+		logger.Debug("not adopting certificate; already cached", "domain", k.domain, "secret", name)
+		return nil
+	} else if err != autocert.ErrCacheMiss {
+		return err
+	}
+	b, err := importCertificate(k, keyPEM, certsPEM, time.Now())
+	if err != nil {
+		return fmt.Errorf("secret %s/%s: %v", namespace, name, err)
+	}
+	logger.Info("adopted certificate", "domain", k.domain, "secret", name, "fingerprint", b.Fingerprint(), "not_after", b.Leaf.NotAfter)
+	return nil
+}
+
+// runImport implements the import subcommand.
+func runImport(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	kubeconfigPath := fs.String("kubeconfig", "", "Path to a kubeconfig file (default $KUBECONFIG, ~/.kube/config, or the in-cluster config)")
+	ns := fs.String("namespace", "", "Namespace of the cache and ingress secrets (default the kubeconfig context's namespace)")
+	domainName := fs.String("domain", "", "The domain the certificate is for")
+	cacheSecret := fs.String("secret", "acme.secret", "Secret used for cert storage")
+	ingressSecret := fs.String("ingress-secret", "acme.ingress.secret", "Secret to publish the certificate to")
+	fromSecret := fs.String("from-secret", "", "kubernetes.io/tls secret to import from")
+	fromNamespace := fs.String("from-namespace", "", "Namespace of -from-secret (default -namespace)")
+	certFile := fs.String("cert", "", "PEM file holding the certificate chain to import, leaf first")
+	keyFile := fs.String("key", "", "PEM file holding the private key to import")
+	useStaging := fs.Bool("staging", false, "Import into the cache for the letsencrypt staging server")
+	force := fs.Bool("force", false, "Replace a certificate that is already cached")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *domainName == "" {
+		return fmt.Errorf("-domain is required")
+	}
+	if (*fromSecret == "") == (*certFile == "" && *keyFile == "") {
+		return fmt.Errorf("pass either -from-secret or -cert and -key")
+	}
+
+	client, contextNamespace, err := commandClient(*kubeconfigPath)
+	if err != nil {
+		return err
+	}
+	if *ns == "" {
+		*ns = contextNamespace
+	}
+	*ns = defaultNamespace(*ns)
+	if *fromNamespace == "" {
+		*fromNamespace = *ns
+	}
+
+	var keyPEM, certsPEM []byte
+	if *fromSecret != "" {
+		keyPEM, certsPEM, err = readTLSSecret(client, *fromNamespace, *fromSecret)
+	} else {
+		if certsPEM, err = ioutil.ReadFile(*certFile); err == nil {
+			keyPEM, err = ioutil.ReadFile(*keyFile)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	directoryURL := acme.LetsEncryptURL
+	if *useStaging {
+		directoryURL = letsEncryptStagingURL
+	}
+	if err := ensureCacheSecret(client, *ns, *cacheSecret); err != nil {
+		return err
+	}
+	k := newKubernetesCache(*cacheSecret, *ingressSecret, *ns, *domainName, directoryURL, client, 1, outputOptions{}, false)
+	ctx := context.Background()
+	if !*force {
+		if _, err := k.Get(ctx, *domainName); err == nil {
+			return fmt.Errorf("the cache already has a certificate for %s; pass -force to replace it", *domainName)
+		}
+	}
+	b, err := importCertificate(k, keyPEM, certsPEM, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Imported certificate for %s as %s in %s/%s and published it to %s\n", *domainName, k.secretKey(*domainName), *ns, *cacheSecret, *ingressSecret)
+	fmt.Fprintf(out, "  names:       %v\n  issuer:      %s\n  expires:     %s\n  fingerprint: %s\n",
+		b.Leaf.DNSNames, b.Leaf.Issuer.CommonName, b.Leaf.NotAfter.UTC().Format(time.RFC3339), b.Fingerprint())
+	return nil
+}
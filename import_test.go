@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestImportRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	// It's refused before anything is written, so the cache needs no client.
+	k := newKubernetesCache("acme.secret", "tls", "default", "example.com", acme.LetsEncryptURL, nil, 1, outputOptions{}, false)
+	if _, err := importCertificate(k, keyPEM, certPEM, time.Now()); err != errRSAImport {
+		t.Errorf("got %v, want errRSAImport", err)
+	}
+}
+
+func TestImportCertificate(t *testing.T) {
+	api := newFakeSecretsAPI(&v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: "acme.secret", Namespace: "certs"}})
+	client, srv := api.serve(t)
+	defer srv.Close()
+	// A running generator writes the cache secret between our read and
+	// update.
+	api.interleave = func(stored *v1.Secret) {
+		stored.Data = map[string][]byte{backoffSecretKey: []byte("{}")}
+	}
+	b, err := parseCertBundle(newTestBundle(t, "example.com", time.Now().Add(30*24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newKubernetesCache("acme.secret", "tls", "certs", "example.com", "https://acme.example.com/directory", client, 1, outputOptions{}, false)
+	if _, err := importCertificate(k, b.KeyPEM, b.CertsPEM, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := k.cached(); err != nil || cached == nil || cached.Fingerprint() != b.Fingerprint() {
+		t.Errorf("got cached certificate %v, %v", cached, err)
+	}
+	if api.get("certs", "acme.secret").Data[backoffSecretKey] == nil {
+		t.Error("the other writer's change was lost")
+	}
+	if tls := api.get("certs", "tls"); tls == nil || !bytes.Equal(tls.Data["tls.crt"], b.CertsPEM) {
+		t.Error("the certificate wasn't published")
+	}
+}
+
+func TestValidateImport(t *testing.T) {
+	now := time.Now()
+	b, err := parseCertBundle(newTestBundle(t, "example.com", now.Add(30*24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateImport(b, "example.com", acme.LetsEncryptURL, now); err != nil {
+		t.Errorf("valid certificate: %v", err)
+	}
+	if err := validateImport(b, "example.org", acme.LetsEncryptURL, now); err == nil {
+		t.Error("wrong domain: expected error")
+	}
+	if err := validateImport(b, "example.com", acme.LetsEncryptURL, now.Add(31*24*time.Hour)); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expired: got %v", err)
+	}
+	// The test CA isn't a staging CA.
+	if err := validateImport(b, "example.com", letsEncryptStagingURL, now); err == nil {
+		t.Error("production certificate into staging cache: expected error")
+	}
+}
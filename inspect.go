@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// cacheKeyRx splits a cache secret key into its directory prefix, if it has
+// one, and the escaped autocert cache name. Prefixes never contain "_", so
+// "acme_account-__plus__-key" has none.
+var cacheKeyRx = regexp.MustCompile(`^([a-zA-Z0-9](?:[-.a-zA-Z0-9]*[a-zA-Z0-9])?)__(.+)$`)
+
+// certInfo summarizes a certificate for inspect.
+type certInfo struct {
+	DNSNames    []string  `json:"dnsNames"`
+	Issuer      string    `json:"issuer"`
+	KeyType     string    `json:"keyType"`
+	Fingerprint string    `json:"fingerprintSHA256"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	Expired     bool      `json:"expired,omitempty"`
+}
+
+func newCertInfo(b *certBundle, now time.Time) *certInfo {
+	return &certInfo{
+		DNSNames:    b.Leaf.DNSNames,
+		Issuer:      b.Leaf.Issuer.CommonName,
+		KeyType:     b.KeyType(),
+		Fingerprint: b.Fingerprint(),
+		NotBefore:   b.Leaf.NotBefore,
+		NotAfter:    b.Leaf.NotAfter,
+		Expired:     !now.Before(b.Leaf.NotAfter),
+	}
+}
+
+// cacheEntry describes one key in the cache secret.
+type cacheEntry struct {
+	Key string `json:"key"`
+	// Directory is "production", "staging", another directory's prefix, or
+	// empty for entries written before entries were namespaced.
+	Directory string    `json:"directory,omitempty"`
+	Name      string    `json:"name"` // the autocert cache name
+	Kind      string    `json:"kind"`
+	Size      int       `json:"size"`
+	Cert      *certInfo `json:"certificate,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Orphaned  string    `json:"orphaned,omitempty"` // why the entry is no longer used
+}
+
+// ingressSecretInfo describes a secret the certificate is published to.
+type ingressSecretInfo struct {
+	Name  string    `json:"name"`
+	Type  string    `json:"type,omitempty"`
+	Keys  []string  `json:"keys,omitempty"`
+	Cert  *certInfo `json:"certificate,omitempty"`
+	Error string    `json:"error,omitempty"`
+	// The cache entry holding the same certificate, if any.
+	MatchesCacheKey string `json:"matchesCacheKey,omitempty"`
+}
+
+type inspectReport struct {
+	Namespace      string              `json:"namespace"`
+	CacheSecret    string              `json:"cacheSecret"`
+	Entries        []cacheEntry        `json:"entries"`
+	AccountSecret  string              `json:"accountSecret,omitempty"`
+	AccountEntries []cacheEntry        `json:"accountEntries,omitempty"`
+	IngressSecrets []ingressSecretInfo `json:"ingressSecrets"`
+}
+
+// parseCacheKey returns the directory and autocert cache name for a key in
+// the cache secret.
+func parseCacheKey(key string) (directory, name string) {
+	name = key
+	if m := cacheKeyRx.FindStringSubmatch(key); m != nil {
+		directory, name = m[1], m[2]
+	}
+	return directory, strings.Replace(name, "-__plus__-", "+", -1)
+}
+
+// inspectCacheEntry describes the cache secret entry key holding data.
+func inspectCacheEntry(key string, data []byte, now time.Time) cacheEntry {
+	e := cacheEntry{Key: key, Size: len(data)}
+	e.Directory, e.Name = parseCacheKey(key)
+	switch {
+	case e.Name == backoffSecretKey:
+		e.Kind = "backoff-state"
+	case e.Name == stagingValidationKey:
+		e.Kind = "staging-validations"
+	case e.Name == "acme_account+key" || e.Name == "acme_account.key":
+		e.Kind = "account-key"
+		if e.Directory == "" {
+			e.Orphaned = "account key from before entries were namespaced by directory"
+		}
+	case strings.HasSuffix(e.Name, "+token"):
+		e.Kind = "challenge-certificate"
+		e.Orphaned = "leftover challenge certificate"
+	default:
+		b, err := parseCertBundle(data)
+		if err != nil {
+			e.Kind = "unknown"
+			e.Error = err.Error()
+			e.Orphaned = "not a certificate or other known entry"
+			break
+		}
+		e.Kind = "certificate"
+		e.Cert = newCertInfo(b, now)
+		if e.Cert.Expired {
+			e.Orphaned = "expired"
+		}
+	}
+	return e
+}
+
+// inspectSecretEntries describes every key in secret, sorted by key.
+func inspectSecretEntries(secret *v1.Secret, now time.Time) []cacheEntry {
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]cacheEntry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, inspectCacheEntry(key, secret.Data[key], now))
+	}
+	return entries
+}
+
+// inspectSecrets builds a report on the cache secret, the account secret if
+// account isn't nil, and the secrets the certificate is published to. A nil
+// ingress secret means it doesn't exist.
+func inspectSecrets(cache, account *v1.Secret, ingress map[string]*v1.Secret, now time.Time) *inspectReport {
+	r := &inspectReport{Namespace: cache.Namespace, CacheSecret: cache.Name}
+	r.Entries = inspectSecretEntries(cache, now)
+	current := make(map[string]string) // certificate name -> namespaced key
+	for _, e := range r.Entries {
+		if e.Kind == "certificate" && e.Directory != "" {
+			current[e.Name] = e.Key
+		}
+	}
+	if account != nil {
+		r.AccountSecret = account.Name
+		r.AccountEntries = inspectSecretEntries(account, now)
+	}
+	for i := range r.Entries {
+		e := &r.Entries[i]
+		if e.Kind == "certificate" && e.Directory == "" && e.Orphaned == "" {
+			if key, ok := current[e.Name]; ok {
+				e.Orphaned = "superseded by " + key
+			}
+		}
+		if e.Kind == "account-key" && e.Orphaned == "" && account != nil && account.Data[e.Key] != nil {
+			e.Orphaned = "superseded by the account secret"
+		}
+	}
+
+	names := make([]string, 0, len(ingress))
+	for name := range ingress {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := ingressSecretInfo{Name: name}
+		secret := ingress[name]
+		if secret == nil {
+			info.Error = "secret does not exist"
+			r.IngressSecrets = append(r.IngressSecrets, info)
+			continue
+		}
+		info.Type = string(secret.Type)
+		for key := range secret.Data {
+			info.Keys = append(info.Keys, key)
+		}
+		sort.Strings(info.Keys)
+		b, err := parseCertBundle(append(append([]byte{}, secret.Data["tls.key"]...), secret.Data["tls.crt"]...))
+		if err != nil {
+			info.Error = "tls.key and tls.crt: " + err.Error()
+			r.IngressSecrets = append(r.IngressSecrets, info)
+			continue
+		}
+		info.Cert = newCertInfo(b, now)
+		for _, e := range r.Entries {
+			if e.Cert != nil && e.Cert.Fingerprint == info.Cert.Fingerprint {
+				info.MatchesCacheKey = e.Key
+				break
+			}
+		}
+		r.IngressSecrets = append(r.IngressSecrets, info)
+	}
+	return r
+}
+
+// writeText writes the report in a form meant for people.
+func (r *inspectReport) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Cache secret %s/%s\n\n", r.Namespace, r.CacheSecret)
+	writeEntries(tw, r.Entries)
+	if r.AccountSecret != "" {
+		fmt.Fprintf(tw, "\nAccount secret %s/%s\n\n", r.Namespace, r.AccountSecret)
+		writeEntries(tw, r.AccountEntries)
+	}
+	for _, s := range r.IngressSecrets {
+		fmt.Fprintf(tw, "\nIngress secret %s/%s\n", r.Namespace, s.Name)
+		if s.Type != "" {
+			fmt.Fprintf(tw, "  type:\t%s\n", s.Type)
+			fmt.Fprintf(tw, "  keys:\t%s\n", strings.Join(s.Keys, ", "))
+		}
+		if s.Error != "" {
+			fmt.Fprintf(tw, "  error:\t%s\n", s.Error)
+		}
+		if s.Cert == nil {
+			continue
+		}
+		fmt.Fprintf(tw, "  names:\t%s\n", strings.Join(s.Cert.DNSNames, ", "))
+		fmt.Fprintf(tw, "  issuer:\t%s\n", s.Cert.Issuer)
+		expires := s.Cert.NotAfter.UTC().Format(time.RFC3339)
+		if s.Cert.Expired {
+			expires += " (EXPIRED)"
+		}
+		fmt.Fprintf(tw, "  expires:\t%s\n", expires)
+		fmt.Fprintf(tw, "  key type:\t%s\n", s.Cert.KeyType)
+		fmt.Fprintf(tw, "  fingerprint:\t%s\n", s.Cert.Fingerprint)
+		if s.MatchesCacheKey != "" {
+			fmt.Fprintf(tw, "  cache:\tmatches %s\n", s.MatchesCacheKey)
+		} else {
+			fmt.Fprintf(tw, "  cache:\tDOES NOT MATCH any cached certificate\n")
+		}
+	}
+	return tw.Flush()
+}
+
+// writeEntries writes a table of secret entries.
+func writeEntries(tw *tabwriter.Writer, entries []cacheEntry) {
+	fmt.Fprintln(tw, "KEY\tDIRECTORY\tKIND\tNAMES\tISSUER\tEXPIRES\tKEY TYPE\tNOTES")
+	for _, e := range entries {
+		directory := e.Directory
+		if directory == "" {
+			directory = "(legacy)"
+		}
+		names, issuer, expires, keyType := "-", "-", "-", "-"
+		if e.Cert != nil {
+			names = strings.Join(e.Cert.DNSNames, ",")
+			issuer = e.Cert.Issuer
+			expires = e.Cert.NotAfter.UTC().Format("2006-01-02")
+			keyType = e.Cert.KeyType
+		}
+		var notes []string
+		if e.Orphaned != "" {
+			notes = append(notes, "orphaned: "+e.Orphaned)
+		}
+		if e.Error != "" {
+			notes = append(notes, e.Error)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Key, directory, e.Kind, names, issuer, expires, keyType, strings.Join(notes, "; "))
+	}
+}
+
+// runInspect implements the inspect subcommand.
+func runInspect(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	kubeconfigPath := fs.String("kubeconfig", defaultKubeconfigPath(), "Path to the kubeconfig file")
+	ns := fs.String("namespace", "", "Namespace of the secrets (default the kubeconfig context's namespace)")
+	cacheSecret := fs.String("secret", "acme.secret", "Secret used for cert storage")
+	accountSecret := fs.String("account-secret", "", "Name of the secret holding the account key, if it isn't the cache secret")
+	ingressSecrets := fs.String("ingress-secret", "acme.ingress.secret", "Comma separated secrets the certificate is published to")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	client, contextNamespace, err := commandClient(*kubeconfigPath)
+	if err != nil {
+		return err
+	}
+	if *ns == "" {
+		*ns = contextNamespace
+	}
+	*ns = defaultNamespace(*ns)
+
+	secrets := client.CoreV1().Secrets(*ns)
+	cache, err := secrets.Get(*cacheSecret, meta_v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("reading secret %s/%s: %v", *ns, *cacheSecret, err)
+	}
+	var account *v1.Secret
+	if *accountSecret != "" {
+		if account, err = secrets.Get(*accountSecret, meta_v1.GetOptions{}); err != nil {
+			return fmt.Errorf("reading secret %s/%s: %v", *ns, *accountSecret, err)
+		}
+	}
+	ingress := make(map[string]*v1.Secret)
+	for _, name := range strings.Split(*ingressSecrets, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		secret, err := secrets.Get(name, meta_v1.GetOptions{})
+		if errors.IsNotFound(err) {
+			secret = nil
+		} else if err != nil {
+			return fmt.Errorf("reading secret %s/%s: %v", *ns, name, err)
+		}
+		ingress[name] = secret
+	}
+
+	report := inspectSecrets(cache, account, ingress, time.Now())
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.writeText(out)
+}
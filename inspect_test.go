@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestParseCacheKey(t *testing.T) {
+	tests := []struct {
+		key, directory, name string
+	}{
+		{"example.com", "", "example.com"},
+		{"production__example.com", "production", "example.com"},
+		{"staging__example.com-__plus__-rsa", "staging", "example.com+rsa"},
+		{"acme_account-__plus__-key", "", "acme_account+key"},
+		{"production__acme_account-__plus__-key", "production", "acme_account+key"},
+		{"ca.internal-14000-dir__example.com", "ca.internal-14000-dir", "example.com"},
+	}
+	for _, tt := range tests {
+		directory, name := parseCacheKey(tt.key)
+		if directory != tt.directory || name != tt.name {
+			t.Errorf("parseCacheKey(%q): got %q, %q, want %q, %q", tt.key, directory, name, tt.directory, tt.name)
+		}
+	}
+}
+
+func TestInspectSecrets(t *testing.T) {
+	now := time.Now()
+	current := newTestBundle(t, "example.com", now.Add(60*24*time.Hour))
+	legacy := newTestBundle(t, "example.com", now.Add(10*24*time.Hour))
+	expired := newTestBundle(t, "old.example.com", now.Add(-time.Hour))
+	cache := &v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "acme.secret", Namespace: "default"},
+		Data: map[string][]byte{
+			"production__example.com":               current,
+			"example.com":                           legacy,
+			"production__old.example.com":           expired,
+			"production__acme_account-__plus__-key": []byte("key"),
+			"example.com-__plus__-token":            legacy,
+		},
+	}
+	currentBundle, err := parseCertBundle(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingress := map[string]*v1.Secret{
+		"acme.ingress.secret": {Data: map[string][]byte{"tls.crt": currentBundle.CertsPEM, "tls.key": currentBundle.KeyPEM}},
+		"missing":             nil,
+	}
+
+	r := inspectSecrets(cache, nil, ingress, now)
+	orphaned := make(map[string]string)
+	for _, e := range r.Entries {
+		orphaned[e.Key] = e.Orphaned
+	}
+	want := map[string]string{
+		"production__example.com":               "",
+		"example.com":                           "superseded by production__example.com",
+		"production__old.example.com":           "expired",
+		"production__acme_account-__plus__-key": "",
+		"example.com-__plus__-token":            "leftover challenge certificate",
+	}
+	for key, reason := range want {
+		if orphaned[key] != reason {
+			t.Errorf("%s: got orphaned %q, want %q", key, orphaned[key], reason)
+		}
+	}
+	if len(r.IngressSecrets) != 2 {
+		t.Fatalf("got %d ingress secrets, want 2", len(r.IngressSecrets))
+	}
+	if s := r.IngressSecrets[0]; s.Name != "acme.ingress.secret" || s.MatchesCacheKey != "production__example.com" {
+		t.Errorf("got %+v", s)
+	}
+	if s := r.IngressSecrets[1]; s.Error != "secret does not exist" {
+		t.Errorf("got %+v", s)
+	}
+
+	var buf bytes.Buffer
+	if err := r.writeText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "matches production__example.com") {
+		t.Errorf("text output missing match:\n%s", buf.String())
+	}
+}
+
+func TestInspectSecretsAccountSecret(t *testing.T) {
+	now := time.Now()
+	cache := &v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "acme.secret", Namespace: "default"},
+		Data: map[string][]byte{
+			"production__acme_account-__plus__-key": []byte("old key"),
+			"staging__acme_account-__plus__-key":    []byte("key"),
+		},
+	}
+	account := &v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "acme.account", Namespace: "default"},
+		Data:       map[string][]byte{"production__acme_account-__plus__-key": []byte("key")},
+	}
+
+	r := inspectSecrets(cache, account, nil, now)
+	if r.AccountSecret != "acme.account" || len(r.AccountEntries) != 1 || r.AccountEntries[0].Kind != "account-key" {
+		t.Fatalf("got account secret %q with entries %+v", r.AccountSecret, r.AccountEntries)
+	}
+	orphaned := make(map[string]string)
+	for _, e := range r.Entries {
+		orphaned[e.Key] = e.Orphaned
+	}
+	if got := orphaned["production__acme_account-__plus__-key"]; got != "superseded by the account secret" {
+		t.Errorf("production account key in the cache secret: got orphaned %q", got)
+	}
+	if got := orphaned["staging__acme_account-__plus__-key"]; got != "" {
+		t.Errorf("staging account key in the cache secret: got orphaned %q", got)
+	}
+
+	var buf bytes.Buffer
+	if err := r.writeText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Account secret default/acme.account") {
+		t.Errorf("text output missing the account secret:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// registry holds every metric exported on the metrics port.
+var registry = new(metricsRegistry)
+
+var (
+	certNotAfter = newGaugeVec(registry, "k8s_cert_generator_certificate_not_after_timestamp_seconds",
+		"Expiry time of the current certificate, in seconds since the epoch.", "domain")
+	certExpiry = newGaugeVec(registry, "k8s_cert_generator_certificate_expiry_seconds",
+		"Seconds until the current certificate expires.", "domain")
+
+	issuanceAttempts = newCounterVec(registry, "k8s_cert_generator_issuance_attempts_total",
+		"Certificate issuance attempts.", "domain")
+	issuanceFailures = newCounterVec(registry, "k8s_cert_generator_issuance_failures_total",
+		"Failed certificate issuance attempts, by reason.", "domain", "reason")
+	issuanceRefused = newCounterVec(registry, "k8s_cert_generator_issuance_refused_total",
+		"Requests to the CA we didn't send because the domain was backing off, by reason.", "domain", "reason")
+	backoffUntil = newGaugeVec(registry, "k8s_cert_generator_backoff_until_timestamp_seconds",
+		"Time until which we won't ask the CA for a certificate, in seconds since the epoch, by reason.", "domain", "reason")
+
+	acmeRequestDuration = newHistogramVec(registry, "k8s_cert_generator_acme_request_duration_seconds",
+		"Latency of requests to the ACME server.", defaultBuckets, "endpoint")
+	acmeRequestErrors = newCounterVec(registry, "k8s_cert_generator_acme_request_errors_total",
+		"Failed requests to the ACME server, by HTTP status or \"network\".", "endpoint", "status")
+
+	cacheDuration = newHistogramVec(registry, "k8s_cert_generator_cache_operation_duration_seconds",
+		"Latency of certificate cache operations against the Kubernetes API.", defaultBuckets, "op")
+	cacheErrors = newCounterVec(registry, "k8s_cert_generator_cache_operation_errors_total",
+		"Failed certificate cache operations. Cache misses are not counted.", "op")
+
+	tlsHandshakes = newCounterVec(registry, "k8s_cert_generator_tls_handshakes_total",
+		"TLS handshakes by SNI server name. Names we don't manage are reported as \"other\".", "sni")
+	challengeRequests = newCounterVec(registry, "k8s_cert_generator_challenge_requests_total",
+		"ACME challenge requests served, by challenge type.", "type")
+
+	configReloads = newCounterVec(registry, "k8s_cert_generator_config_reloads_total",
+		"Configuration file reloads, by result.", "result")
+	issuerChanges = newCounterVec(registry, "k8s_cert_generator_issuer_changes_total",
+		"Changes of the active issuer of certificates with fallback issuers, by the issuer changed to.", "domain", "issuer")
+
+	secretCertNotAfter = newGaugeVec(registry, "k8s_cert_generator_secret_certificate_not_after_timestamp_seconds",
+		"Expiry time of the certificate under a key of any TLS secret the watchdog scans, in seconds since the epoch.", "namespace", "secret", "key")
+	secretCertExpiry = newGaugeVec(registry, "k8s_cert_generator_secret_certificate_expiry_seconds",
+		"Seconds until the certificate under a key of any TLS secret the watchdog scans expires.", "namespace", "secret", "key")
+	secretCertWeakness = newGaugeVec(registry, "k8s_cert_generator_secret_certificate_weakness",
+		"1 for each weakness of a certificate the watchdog found: small-rsa-key, sha1-signature, md5-signature or no-san.", "namespace", "secret", "key", "weakness")
+	secretCertInvalid = newGaugeVec(registry, "k8s_cert_generator_secret_certificate_invalid",
+		"1 for each secret key the watchdog expected a certificate under but couldn't parse one.", "namespace", "secret", "key")
+	watchdogScans = newCounterVec(registry, "k8s_cert_generator_watchdog_scans_total",
+		"Scans of the cluster's TLS secrets, by result.", "result")
+	notificationsSent = newCounterVec(registry, "k8s_cert_generator_notifications_total",
+		"Notifications by sink, event and result: sent, failed, or suppressed as a repeat.", "sink", "event", "result")
+	watchdogLastScan = newGaugeVec(registry, "k8s_cert_generator_watchdog_last_scan_timestamp_seconds",
+		"Time of the last successful scan of the cluster's TLS secrets, in seconds since the epoch.")
+)
+
+func init() {
+	registry.OnCollect(func() {
+		now := time.Now()
+		certNotAfter.Each(func(labels []string, notAfter float64) {
+			certExpiry.Set(notAfter-float64(now.Unix()), labels...)
+		})
+		secretCertNotAfter.Each(func(labels []string, notAfter float64) {
+			secretCertExpiry.Set(notAfter-float64(now.Unix()), labels...)
+		})
+		backoffUntil.Each(func(labels []string, _ float64) {
+			backoffUntil.Delete(labels...)
+		})
+		backoffs.each(func(domain string, until time.Time, reason string) {
+			backoffUntil.Set(float64(until.Unix()), domain, reason)
+		})
+	})
+}
+
+// observeCacheOp records the latency and outcome of a kubernetesCache call.
+func observeCacheOp(op string, start time.Time, err error) {
+	cacheDuration.Since(start, op)
+	if err != nil && err != autocert.ErrCacheMiss {
+		cacheErrors.Inc(op)
+	}
+}
+
+// acmeTransport records the latency and errors of requests to the ACME
+// server, and logs each request with an ID so the lines for one request can
+// be found together. It also refuses to start an issuance for a domain that
+// is backing off, or while the issuer is standing by, and starts backing off
+// when the CA says we're rate limited.
+type acmeTransport struct {
+	base http.RoundTripper
+
+	// backoffScope keeps this CA's backoff state apart from the primary
+	// CA's, for fallback issuers. Empty for primary issuers.
+	backoffScope string
+	// standby, if set, reports whether the issuer is standing by while
+	// another CA is active, in which case no orders are started.
+	standby func() bool
+	// retired, if set, reports whether the certificate the requests are for
+	// is no longer managed by this client's Manager, in which case nothing
+	// is sent.
+	retired func() bool
+}
+
+func (t acmeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := acmeEndpoint(req)
+	l := logger.New("request_id", newRequestID(), "endpoint", endpoint)
+	l.Debug("acme request", "method", req.Method, "url", req.URL.String())
+	if t.retired != nil && t.retired() {
+		l.Info("not sending acme request: the certificate is no longer managed by this manager")
+		return nil, errCacheRetired
+	}
+	domain, err := checkBackoff(req, endpoint, t.backoffScope)
+	if err == nil && domain != "" && t.standby != nil && t.standby() {
+		err = fmt.Errorf("not ordering a certificate for %s: another issuer is active", domain)
+	}
+	if err != nil {
+		l.Info("not sending acme request", "domain", domain, "err", err)
+		return nil, err
+	}
+	if domain != "" {
+		pendingOrders.start(scopedBackoffDomain(t.backoffScope, domain))
+	}
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	duration := time.Since(start)
+	acmeRequestDuration.Observe(duration.Seconds(), endpoint)
+	if err != nil {
+		acmeRequestErrors.Inc(endpoint, "network")
+		l.Warn("acme request failed", "duration", duration, "err", err)
+		return res, err
+	}
+	if res.StatusCode >= 400 {
+		acmeRequestErrors.Inc(endpoint, strconv.Itoa(res.StatusCode))
+		l.Warn("acme error response", "status", res.StatusCode, "duration", duration)
+		if res.StatusCode == http.StatusTooManyRequests && domain != "" {
+			backoffs.recordRateLimit(scopedBackoffDomain(t.backoffScope, domain), parseRetryAfter(res.Header.Get("Retry-After"), time.Now()))
+		}
+	} else {
+		l.Debug("acme response", "status", res.StatusCode, "duration", duration)
+	}
+	return res, err
+}
+
+// orderTracker remembers which domains the CA was sent an order for whose
+// outcome hasn't been recorded yet. autocert remembers a failed order for a
+// minute and fails every handshake for the domain meanwhile without
+// contacting the CA, so only the first failure after an order is one.
+type orderTracker struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// pendingOrders tracks the orders of every issuer, by scoped backoff domain.
+var pendingOrders = &orderTracker{pending: make(map[string]bool)}
+
+// start notes that an order for domain was sent to the CA.
+func (o *orderTracker) start(domain string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending[domain] = true
+}
+
+// finish reports whether an order for domain was sent since the last call,
+// i.e. whether the outcome being recorded is that of a new attempt.
+func (o *orderTracker) finish(domain string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	started := o.pending[domain]
+	delete(o.pending, domain)
+	return started
+}
+
+// acmeEndpoint returns a low cardinality name for the ACME resource req is
+// for, e.g. "new-authz" or "challenge".
+func acmeEndpoint(req *http.Request) string {
+	if req.Method == "HEAD" {
+		return "nonce"
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) > 1 && parts[0] == "acme" {
+		parts = parts[1:]
+	}
+	if parts[0] == "" {
+		return "root"
+	}
+	return parts[0]
+}
+
+// newACMEHTTPClient returns an HTTP client for talking to the ACME server
+// that records request metrics.
+func newACMEHTTPClient() *http.Client {
+	return &http.Client{Transport: acmeTransport{base: http.DefaultTransport}}
+}
+
+// newCertificateACMEHTTPClient returns an HTTP client for the Manager of a
+// configured certificate, which stops sending requests once retired reports
+// true. See acmeTransport.
+func newCertificateACMEHTTPClient(retired func() bool) *http.Client {
+	return &http.Client{Transport: acmeTransport{base: http.DefaultTransport, retired: retired}}
+}
+
+// newFailoverACMEHTTPClient returns an HTTP client for one of the issuers of
+// a certificate with fallbacks. See acmeTransport.
+func newFailoverACMEHTTPClient(backoffScope string, standby, retired func() bool) *http.Client {
+	return &http.Client{Transport: acmeTransport{base: http.DefaultTransport, backoffScope: backoffScope, standby: standby, retired: retired}}
+}
+
+// issuanceFailureReason classifies an error returned while obtaining a
+// certificate.
+func issuanceFailureReason(err error) string {
+	if _, ok := acme.RateLimit(err); ok {
+		return "rate_limited"
+	}
+	switch err := err.(type) {
+	case *acme.AuthorizationError:
+		return "authorization"
+	case *acme.Error:
+		return "acme_error"
+	default:
+		if err == context.DeadlineExceeded || err == context.Canceled {
+			return "timeout"
+		}
+		if strings.Contains(err.Error(), "unable to authorize") {
+			return "authorization"
+		}
+		return "other"
+	}
+}
+
+// instrumentGetCertificate wraps a tls.Config.GetCertificate function,
+// counting handshakes, challenge requests and issuance failures. Handshakes
+// waiting for a ca or csr issuer's first certificate aren't failures, and
+// only the first handshake to fail after an order is sent records it. managed
+// reports whether we have a certificate for a name; handshakes for any other
+// SNI are counted as "other". scope returns the backoff scope failures for a
+// name are recorded under.
+func instrumentGetCertificate(managed func(name string) bool, scope func(name string) string, getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.TrimSuffix(hello.ServerName, ".")
+		if isChallengeHello(hello) {
+			challengeRequests.Inc("tls-alpn-01")
+			return getCert(hello)
+		}
+		isManaged := managed(name)
+		if isManaged {
+			tlsHandshakes.Inc(name)
+		} else {
+			tlsHandshakes.Inc("other")
+		}
+		cert, err := getCert(hello)
+		if _, pending := err.(notIssuedError); err != nil && isManaged && !pending {
+			if scope := scope(name); pendingOrders.finish(scopedBackoffDomain(scope, name)) {
+				recordIssuanceFailure(name, scope, err)
+			}
+		}
+		return cert, err
+	}
+}
+
+// isChallengeHello reports whether hello is from a CA validating a
+// tls-alpn-01 challenge.
+func isChallengeHello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// ecdsaHello returns a hello for domain from a client that supports ECDSA,
+// for asking an autocert.Manager for the certificate we publish. autocert
+// takes a hello that says nothing to be from an old client, and gets it an
+// RSA certificate.
+func ecdsaHello(domain string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:       domain,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+}
+
+// instrumentChallengeHandler counts http-01 challenge requests served by h.
+func instrumentChallengeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			challengeRequests.Inc("http-01")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
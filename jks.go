@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+	"unicode/utf16"
+)
+
+// A minimal encoder for Java's proprietary JKS keystore format, as read by
+// sun.security.provider.JavaKeyStore. Private keys are protected with the
+// "KeyProtector" scheme (SHA-1 keystream XOR), which is the only one JKS
+// supports.
+
+const (
+	jksMagic          = 0xfeedfeed
+	jksVersion        = 2
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+)
+
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+type jksEncryptedPrivateKeyInfo struct {
+	Algorithm     pkcs12AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type jksWriter struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (w *jksWriter) uint32(v uint32) {
+	if w.err == nil {
+		w.err = binary.Write(&w.buf, binary.BigEndian, v)
+	}
+}
+
+func (w *jksWriter) int64(v int64) {
+	if w.err == nil {
+		w.err = binary.Write(&w.buf, binary.BigEndian, v)
+	}
+}
+
+// utf writes s the way java.io.DataOutput.writeUTF does. We only ever write
+// aliases and the certificate type, so plain ASCII is enough.
+func (w *jksWriter) utf(s string) {
+	if w.err != nil {
+		return
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 || s[i] >= 0x80 {
+			w.err = errors.New("jks: only ASCII strings are supported")
+			return
+		}
+	}
+	if len(s) > 0xffff {
+		w.err = errors.New("jks: string too long")
+		return
+	}
+	w.err = binary.Write(&w.buf, binary.BigEndian, uint16(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *jksWriter) bytes(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *jksWriter) cert(cert *x509.Certificate) {
+	w.utf("X.509")
+	w.bytes(cert.Raw)
+}
+
+// finish appends the keystore integrity hash and returns the keystore.
+func (w *jksWriter) finish(password string) ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	h := sha1.New()
+	h.Write(jksPassword(password))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(w.buf.Bytes())
+	w.buf.Write(h.Sum(nil))
+	return w.buf.Bytes(), nil
+}
+
+func newJKSWriter(entries int) *jksWriter {
+	w := new(jksWriter)
+	w.uint32(jksMagic)
+	w.uint32(jksVersion)
+	w.uint32(uint32(entries))
+	return w
+}
+
+// encodeJKSKeystore returns a JKS keystore containing the bundle's private
+// key and certificate chain under alias. The key is protected with the
+// keystore password.
+func encodeJKSKeystore(b *certBundle, alias, password string, now time.Time) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(b.Key)
+	if err != nil {
+		return nil, err
+	}
+	protected, err := jksProtectKey(pkcs8, password)
+	if err != nil {
+		return nil, err
+	}
+	w := newJKSWriter(1)
+	w.uint32(jksPrivateKeyTag)
+	w.utf(alias)
+	w.int64(now.UnixNano() / int64(time.Millisecond))
+	w.bytes(protected)
+	w.uint32(uint32(len(b.Chain)))
+	for _, cert := range b.Chain {
+		w.cert(cert)
+	}
+	return w.finish(password)
+}
+
+// encodeJKSTruststore returns a JKS truststore containing the certificates
+// that issued the bundle's leaf. If the CA did not send any intermediates we
+// fall back to trusting the leaf itself.
+func encodeJKSTruststore(b *certBundle, alias, password string, now time.Time) ([]byte, error) {
+	certs := b.Intermediates()
+	if len(certs) == 0 {
+		certs = []*x509.Certificate{b.Leaf}
+	}
+	w := newJKSWriter(len(certs))
+	for i, cert := range certs {
+		w.uint32(jksTrustedCertTag)
+		if i == 0 {
+			w.utf(alias)
+		} else {
+			w.utf(alias + "-" + strconv.Itoa(i))
+		}
+		w.int64(now.UnixNano() / int64(time.Millisecond))
+		w.cert(cert)
+	}
+	return w.finish(password)
+}
+
+// jksProtectKey encrypts a PKCS#8 private key the way
+// sun.security.provider.KeyProtector does.
+func jksProtectKey(plain []byte, password string) ([]byte, error) {
+	const saltLen = sha1.Size
+	pw := jksPassword(password)
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	encrypted := make([]byte, saltLen+len(plain)+sha1.Size)
+	copy(encrypted, salt)
+	digest := salt
+	for i := 0; i < len(plain); i += sha1.Size {
+		h := sha1.New()
+		h.Write(pw)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(plain); j++ {
+			encrypted[saltLen+i+j] = plain[i+j] ^ digest[j]
+		}
+	}
+	h := sha1.New()
+	h.Write(pw)
+	h.Write(plain)
+	copy(encrypted[saltLen+len(plain):], h.Sum(nil))
+
+	return asn1.Marshal(jksEncryptedPrivateKeyInfo{
+		Algorithm:     pkcs12AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: encrypted,
+	})
+}
+
+// jksPassword returns password as big endian UTF-16 code units, the form
+// JKS mixes into its hashes.
+func jksPassword(password string) []byte {
+	var out []byte
+	for _, c := range utf16.Encode([]rune(password)) {
+		out = append(out, byte(c>>8), byte(c))
+	}
+	return out
+}
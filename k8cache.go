@@ -25,10 +25,13 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/acme/autocert"
+	"k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
@@ -39,47 +42,142 @@ type kubernetesCache struct {
 	Namespace string
 	// Secret name used by Autocert for storing the raw cert data.
 	SecretName string
+	// Secret name for the ACME account key, if it isn't kept in SecretName.
+	AccountSecretName string
 
 	// Secret name used by the Ingress to load TLS certificates from.
 	IngressSecretName string
 
 	Client kubernetes.Interface
 
-	// Domain to look for. At the moment we only support one domain, since we
-	// can only write one cert to the Ingress secret.
+	// Domain to look for. Each certificate has its own cache, since we can
+	// only write one cert to an Ingress secret.
 	domain            string
 	deleteGracePeriod int64
+
+	// URL of the ACME directory certificates come from. Cache entries are
+	// namespaced by directory, and certificates from any other CA are
+	// refused.
+	directoryURL string
+
+	// Extra encodings of the certificate to write to the Ingress secret.
+	outputs outputOptions
+
+	// Whether to trigger a rolling restart of workloads that consume the
+	// Ingress secret after it's updated.
+	restartWorkloads bool
+
+	// Key backoff state for certificates written here is scoped by; see
+	// scopedBackoffDomain. Empty for a certificate's primary issuer.
+	backoffScope string
+
+	// Set when the certificate is reconfigured or removed. See forward and
+	// retire.
+	mu      sync.Mutex
+	next    *kubernetesCache
+	retired bool
+}
+
+// errCacheRetired is returned by a cache whose certificate is no longer
+// managed through it.
+var errCacheRetired = fmt.Errorf("the certificate is no longer managed through this cache")
+
+// forward makes k hand every operation to next, which caches the same
+// certificate but publishes it differently. It's used to keep a certificate's
+// source, and the cache it writes through, when only how it's published
+// changes.
+func (k *kubernetesCache) forward(next *kubernetesCache) {
+	k.mu.Lock()
+	k.next = next
+	k.mu.Unlock()
+}
+
+// retire makes k refuse every operation, once its certificate is no longer
+// configured or has a new source. autocert has no way to stop a Manager's
+// renewal timers, so this is what keeps a retired Manager from publishing.
+func (k *kubernetesCache) retire() {
+	k.mu.Lock()
+	k.retired = true
+	k.mu.Unlock()
+}
+
+// current returns the cache operations on k should go to: k, or the cache it
+// forwards to.
+func (k *kubernetesCache) current() (*kubernetesCache, error) {
+	k.mu.Lock()
+	retired, next := k.retired, k.next
+	k.mu.Unlock()
+	switch {
+	case retired:
+		return nil, errCacheRetired
+	case next != nil:
+		return next.current()
+	}
+	return k, nil
+}
+
+// isRetired reports whether k, or the cache it forwards to, is retired.
+func (k *kubernetesCache) isRetired() bool {
+	_, err := k.current()
+	return err != nil
 }
 
 // KubernetesCache returns an autocert.Cache that will store the certificate as
-// a secret in Kubernetes. It accepts a secret name, namespace,
-// kubernetes.Clientset, and grace period (in seconds)
-func newKubernetesCache(secret, ingressSecret, namespace, domain string, client kubernetes.Interface, deleteGracePeriod int64) autocert.Cache {
+// a secret in Kubernetes. It accepts a secret name, namespace, the ACME
+// directory URL, kubernetes.Clientset, grace period (in seconds) and any extra
+// output formats to write to the ingress secret. If restart is true, workloads
+// that consume the ingress secret are restarted when it changes.
+func newKubernetesCache(secret, ingressSecret, namespace, domain, directoryURL string, client kubernetes.Interface, deleteGracePeriod int64, outputs outputOptions, restart bool) *kubernetesCache {
 	return &kubernetesCache{
 		Namespace:         namespace,
 		SecretName:        secret,
 		IngressSecretName: ingressSecret,
 		Client:            client,
 		domain:            domain,
+		directoryURL:      directoryURL,
 		deleteGracePeriod: deleteGracePeriod,
+		outputs:           outputs,
+		restartWorkloads:  restart,
 	}
 }
 
 func (k *kubernetesCache) Get(ctx context.Context, name string) ([]byte, error) {
+	k, err := k.current()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	data, err := k.get(ctx, name)
+	observeCacheOp("get", start, err)
+	return data, err
+}
+
+func (k *kubernetesCache) get(ctx context.Context, name string) ([]byte, error) {
 	done := make(chan struct{})
 	var err error
 	var data []byte
-	name = strings.Replace(name, "+", "-__plus__-", -1)
+	key := k.secretKey(name)
+	l := logger.New("domain", k.domain, "op", "get", "key", key)
 
 	go func() {
 		var secret *v1.Secret
-		secret, err = k.Client.CoreV1().Secrets(k.Namespace).Get(k.SecretName, meta_v1.GetOptions{})
+		secret, err = k.Client.CoreV1().Secrets(k.Namespace).Get(k.secretFor(name), meta_v1.GetOptions{})
 		defer close(done)
+		if k.secretFor(name) != k.SecretName && (errors.IsNotFound(err) || err == nil && secret.Data[key] == nil) {
+			data, err = k.moveAccountKey(key)
+			return
+		}
 		if err != nil {
 			return
 		}
 		var ok bool
-		data, ok = secret.Data[name]
+		data, ok = secret.Data[key]
+		if !ok && k.isPrivateCert(name) {
+			// Certificates stored before entries were namespaced by
+			// directory are still usable if they come from the right CA,
+			// which is checked below.
+			data, ok = secret.Data[legacySecretKey(name)]
+		}
 		if !ok {
 			err = autocert.ErrCacheMiss
 			return
@@ -88,18 +186,165 @@ func (k *kubernetesCache) Get(ctx context.Context, name string) ([]byte, error)
 
 	select {
 	case <-ctx.Done():
-		log.Printf("get %s: context error %v", name, ctx.Err())
+		l.Warn("context error", "err", ctx.Err())
 		return nil, ctx.Err()
 	case <-done:
 	}
 	if err != nil || len(data) == 0 {
-		log.Printf("get %s: cache miss, returning error", name)
+		l.Debug("cache miss", "err", err)
 		return nil, autocert.ErrCacheMiss
 	}
-	log.Printf("get %s: data size %d, err %v", name, len(data), err)
+	l.Debug("cache hit", "size", len(data))
+	if k.isPrivateCert(name) {
+		if bundle, perr := parseCertBundle(data); perr == nil {
+			if ierr := checkIssuer(bundle.Leaf, k.directoryURL); ierr != nil {
+				// Don't serve it; autocert will get a new one.
+				l.Warn("ignoring cached certificate", "err", ierr)
+				return nil, autocert.ErrCacheMiss
+			}
+			recordCertificate(k.domain, bundle)
+		}
+	}
 	return data, err
 }
 
+// accountKeyName is the autocert cache entry holding the ACME account key.
+const accountKeyName = "acme_account+key"
+
+// secretFor returns the name of the secret the cache entry name is kept in.
+func (k *kubernetesCache) secretFor(name string) string {
+	if name == accountKeyName && k.AccountSecretName != "" {
+		return k.AccountSecretName
+	}
+	return k.SecretName
+}
+
+// moveAccountKey moves the account key from the cache secret, where it was
+// kept before it had its own secret, to the account secret, and returns it.
+func (k *kubernetesCache) moveAccountKey(key string) ([]byte, error) {
+	secrets := k.Client.CoreV1().Secrets(k.Namespace)
+	cache, err := secrets.Get(k.SecretName, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data, ok := cache.Data[key]
+	if !ok {
+		// Another certificate's cache may have just moved it.
+		if account, err := secrets.Get(k.AccountSecretName, meta_v1.GetOptions{}); err == nil && account.Data[key] != nil {
+			return account.Data[key], nil
+		}
+		return nil, autocert.ErrCacheMiss
+	}
+	if err := putSecretKey(k.Client, k.Namespace, k.AccountSecretName, key, data); err != nil {
+		return nil, err
+	}
+	patch, err := generateDeletePatch(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := secrets.Patch(k.SecretName, types.JSONPatchType, patch); err != nil {
+		return nil, err
+	}
+	logger.Info("moved account key to its own secret", "key", key, "from", k.SecretName, "to", k.AccountSecretName)
+	return data, nil
+}
+
+// putSecretKey sets key in the secret namespace/name, creating the secret if
+// it doesn't exist.
+func putSecretKey(client kubernetes.Interface, namespace, name, key string, data []byte) error {
+	err := updateSecretKey(client, namespace, name, key, data)
+	if errors.IsNotFound(err) {
+		_, err = client.CoreV1().Secrets(namespace).Create(&v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: namespace},
+			Data:       map[string][]byte{key: data},
+		})
+	}
+	return err
+}
+
+// updateSecretKey sets key in the existing secret namespace/name.
+func updateSecretKey(client kubernetes.Interface, namespace, name, key string, data []byte) error {
+	return updateSecret(client, namespace, name, func(secretData map[string][]byte) error {
+		secretData[key] = data
+		return nil
+	})
+}
+
+// updateSecret changes the data of the existing secret namespace/name with
+// change. The cache secret is written by every certificate's cache and by
+// the backoff tracker, so when another writer updated the secret since it
+// was read, it reads it again and retries.
+func updateSecret(client kubernetes.Interface, namespace, name string, change func(data map[string][]byte) error) error {
+	secrets := client.CoreV1().Secrets(namespace)
+	for i := 0; ; i++ {
+		secret, err := secrets.Get(name, meta_v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		if err := change(secret.Data); err != nil {
+			return err
+		}
+		_, err = secrets.Update(secret)
+		if err == nil || !errors.IsConflict(err) || i >= 2 {
+			return err
+		}
+	}
+}
+
+// cached returns the certificate cached for the domain, or nil if there
+// isn't one from the right CA. Unlike Get, it doesn't record the certificate
+// as the current one.
+func (k *kubernetesCache) cached() (*certBundle, error) {
+	secret, err := k.Client.CoreV1().Secrets(k.Namespace).Get(k.SecretName, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data, ok := secret.Data[k.secretKey(k.domain)]
+	if !ok {
+		data = secret.Data[legacySecretKey(k.domain)]
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	bundle, err := parseCertBundle(data)
+	if err != nil || checkIssuer(bundle.Leaf, k.directoryURL) != nil {
+		return nil, nil
+	}
+	return bundle, nil
+}
+
+// names returns the autocert cache entries the cache secret holds for k's
+// directory.
+func (k *kubernetesCache) names() ([]string, error) {
+	secret, err := k.Client.CoreV1().Secrets(k.Namespace).Get(k.SecretName, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	prefix := directoryKeyPrefix(k.directoryURL)
+	var names []string
+	for key := range secret.Data {
+		if strings.HasPrefix(key, prefix) {
+			names = append(names, strings.Replace(strings.TrimPrefix(key, prefix), "-__plus__-", "+", -1))
+		}
+	}
+	return names, nil
+}
+
+// secretKey returns the key in the cache secret for the autocert cache entry
+// name.
+func (k *kubernetesCache) secretKey(name string) string {
+	return directoryKeyPrefix(k.directoryURL) + legacySecretKey(name)
+}
+
+// legacySecretKey returns the key used for name before entries were
+// namespaced by directory. Secret keys can't contain "+".
+func legacySecretKey(name string) string {
+	return strings.Replace(name, "+", "-__plus__-", -1)
+}
+
 // isPrivateCert returns true if acme/autocert is attempting to store the actual
 // certificate.
 func (k *kubernetesCache) isPrivateCert(keyName string) bool {
@@ -109,8 +354,20 @@ func (k *kubernetesCache) isPrivateCert(keyName string) bool {
 }
 
 func (k *kubernetesCache) Put(ctx context.Context, name string, data []byte) error {
-	name = strings.Replace(name, "+", "-__plus__-", -1)
-	log.Printf("put %s: data length %d", name, len(data))
+	k, err := k.current()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = k.put(ctx, name, data)
+	observeCacheOp("put", start, err)
+	return err
+}
+
+func (k *kubernetesCache) put(ctx context.Context, name string, data []byte) error {
+	key := k.secretKey(name)
+	l := logger.New("domain", k.domain, "op", "put", "key", key)
+	l.Debug("writing cache entry", "size", len(data))
 	done := make(chan struct{})
 	// data is something like this:
 	//
@@ -135,43 +392,54 @@ func (k *kubernetesCache) Put(ctx context.Context, name string, data []byte) err
 	// here.
 	//
 	// https://github.com/kubernetes/ingress-gce/blob/master/README.md#secret
-	var pub, priv []byte
+	var bundle *certBundle
 	var err error
 	if k.isPrivateCert(name) {
-		priv, pub, err = getPrivPubBytes(data)
+		bundle, err = parseCertBundle(data)
+		if err == nil {
+			err = checkIssuer(bundle.Leaf, k.directoryURL)
+		}
 		if err != nil {
-			log.Printf("put %s: returning err %v", name, err)
+			events.Eventf(v1.EventTypeWarning, reasonValidationFailed, "Certificate for %s failed validation: %v", k.domain, err)
+			l.Error("certificate failed validation", "err", err)
 			return err
 		}
 	}
 	go func() {
 		defer close(done)
 
-		var secret, ingressSecret *v1.Secret
-		secret, err = k.Client.CoreV1().Secrets(k.Namespace).Get(k.SecretName, meta_v1.GetOptions{})
-		if err != nil {
+		if secretName := k.secretFor(name); secretName != k.SecretName {
+			err = putSecretKey(k.Client, k.Namespace, secretName, key, data)
 			return
 		}
-		if secret.Data == nil {
-			secret.Data = make(map[string][]byte)
-		}
-		secret.Data[name] = data
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			_, err = k.Client.CoreV1().Secrets(k.Namespace).Update(secret)
-			if err == nil && k.isPrivateCert(name) {
-				ingressSecret, err = k.Client.CoreV1().Secrets(k.Namespace).Get(k.IngressSecretName, meta_v1.GetOptions{})
-				if err != nil {
-					return
-				}
-				if ingressSecret.Data == nil {
-					ingressSecret.Data = make(map[string][]byte)
-				}
-				ingressSecret.Data["tls.crt"] = pub
-				ingressSecret.Data["tls.key"] = priv
-				_, err = k.Client.CoreV1().Secrets(k.Namespace).Update(ingressSecret)
+		}
+		err = updateSecretKey(k.Client, k.Namespace, k.SecretName, key, data)
+		if err == nil && k.isPrivateCert(name) {
+			err = k.updateIngressSecret(bundle)
+			if err != nil {
+				events.Eventf(v1.EventTypeWarning, reasonPublishFailed, "Failed to update secret %s with certificate for %s: %v", k.IngressSecretName, k.domain, err)
+				notifications.notify(notification{
+					Event:       notifyPublishFailed,
+					Domain:      k.domain,
+					Message:     fmt.Sprintf("Failed to update secret %s with certificate for %s: %v", k.IngressSecretName, k.domain, err),
+					Fingerprint: bundle.Fingerprint(),
+					Secret:      k.IngressSecretName,
+					Error:       err.Error(),
+				})
+			} else {
+				events.Eventf(v1.EventTypeNormal, reasonPublished, "Updated secret %s with certificate for %s (SHA-256 %s)", k.IngressSecretName, k.domain, bundle.Fingerprint())
+				notifications.clear(k.domain, notifyPublishFailed)
+			}
+		}
+		if err == nil && bundle != nil && k.restartWorkloads {
+			// The certificate is published either way, so don't fail the
+			// Put if a restart fails.
+			if rerr := restartWorkloads(k.Client, k.Namespace, k.IngressSecretName, bundle.Fingerprint()); rerr != nil {
+				l.Error("restarting workloads", "secret", k.IngressSecretName, "err", rerr)
 			}
 		}
 	}()
@@ -180,10 +448,125 @@ func (k *kubernetesCache) Put(ctx context.Context, name string, data []byte) err
 		return ctx.Err()
 	case <-done:
 	}
-	log.Printf("put %s: return err %v", name, err)
+	if err != nil {
+		l.Error("writing cache entry", "err", err)
+	} else {
+		l.Info("wrote cache entry")
+	}
+	if err == nil && bundle != nil {
+		recordIssuance(k.domain, k.backoffScope, bundle)
+		if k.directoryURL == letsEncryptStagingURL {
+			if verr := k.recordStagingValidation(bundle); verr != nil {
+				l.Warn("could not record staging validation", "err", verr)
+			}
+		}
+	}
+	return err
+}
+
+// updateIngressSecret writes the certificate to the Ingress secret, creating
+// the secret if it doesn't exist yet.
+func (k *kubernetesCache) updateIngressSecret(bundle *certBundle) error {
+	if current, err := k.current(); err != nil {
+		return err
+	} else if current != k {
+		return current.updateIngressSecret(bundle)
+	}
+	existing, desired, err := k.desiredIngressSecret(bundle)
+	if err != nil {
+		return err
+	}
+	secrets := k.Client.CoreV1().Secrets(k.Namespace)
+	if existing == nil {
+		_, err = secrets.Create(desired)
+	} else {
+		_, err = secrets.Update(desired)
+	}
 	return err
 }
 
+// desiredIngressSecret returns the Ingress secret as it is now, or nil if it
+// doesn't exist, and as it should be with bundle published to it. Nothing is
+// written.
+func (k *kubernetesCache) desiredIngressSecret(bundle *certBundle) (existing, desired *v1.Secret, err error) {
+	existing, err = k.Client.CoreV1().Secrets(k.Namespace).Get(k.IngressSecretName, meta_v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		existing = nil
+		desired = &v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{Name: k.IngressSecretName, Namespace: k.Namespace},
+			Type:       k.outputs.secretType(),
+		}
+	} else if err != nil {
+		return nil, nil, err
+	} else {
+		if t := k.outputs.secretType(); existing.Type != t {
+			logger.Warn("ingress secret has the wrong type; secret types can't be changed, so leaving it", "domain", k.domain, "secret", k.IngressSecretName, "type", existing.Type, "want", t)
+		}
+		copied := *existing
+		copied.Data = make(map[string][]byte, len(existing.Data))
+		for key, val := range existing.Data {
+			copied.Data[key] = val
+		}
+		desired = &copied
+	}
+	if desired.Data == nil {
+		desired.Data = make(map[string][]byte)
+	}
+	desired.Data["tls.crt"] = bundle.CertsPEM
+	desired.Data["tls.key"] = bundle.KeyPEM
+	if err := k.addOutputs(desired.Data, bundle); err != nil {
+		return nil, nil, err
+	}
+	return existing, desired, nil
+}
+
+// addOutputs renders any extra output formats and templated keys for the
+// certificate and adds them to secretData.
+func (k *kubernetesCache) addOutputs(secretData map[string][]byte, bundle *certBundle) error {
+	if len(k.outputs.Formats) == 0 && k.outputs.Template == nil {
+		return nil
+	}
+	var err error
+	var password string
+	if k.outputs.needsPassword() {
+		password, err = k.keystorePassword()
+		if err != nil {
+			return err
+		}
+	}
+	outputs, err := renderOutputs(bundle, k.outputs.Formats, password, time.Now())
+	if err != nil {
+		return err
+	}
+	for key, val := range outputs {
+		secretData[key] = val
+	}
+	if k.outputs.Template != nil {
+		rendered, err := k.outputs.Template.render(bundle, k.domain)
+		if err != nil {
+			return err
+		}
+		for key, val := range rendered {
+			secretData[key] = val
+		}
+	}
+	return nil
+}
+
+// keystorePassword reads the PKCS#12/JKS keystore password from the secret
+// referenced by the output options.
+func (k *kubernetesCache) keystorePassword() (string, error) {
+	secret, err := k.Client.CoreV1().Secrets(k.Namespace).Get(k.outputs.PasswordSecret, meta_v1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("reading keystore password secret %q: %v", k.outputs.PasswordSecret, err)
+	}
+	password, ok := secret.Data[k.outputs.PasswordSecretKey]
+	if !ok || len(password) == 0 {
+		return "", fmt.Errorf("keystore password secret %q has no key %q", k.outputs.PasswordSecret, k.outputs.PasswordSecretKey)
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
 type deletePatchOp struct {
 	Op   string `json:"op"`
 	Path string `json:"path"`
@@ -196,9 +579,20 @@ func generateDeletePatch(name string) ([]byte, error) {
 	return json.Marshal(data)
 }
 
-func (k kubernetesCache) Delete(ctx context.Context, name string) error {
-	name = strings.Replace(name, "+", "-__plus__-", -1)
-	log.Printf("delete %s", name)
+func (k *kubernetesCache) Delete(ctx context.Context, name string) error {
+	k, err := k.current()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = k.delete(ctx, name)
+	observeCacheOp("delete", start, err)
+	return err
+}
+
+func (k *kubernetesCache) delete(ctx context.Context, name string) error {
+	key := k.secretKey(name)
+	l := logger.New("domain", k.domain, "op", "delete", "key", key)
 	done := make(chan struct{})
 	var err error
 	go func() {
@@ -209,11 +603,11 @@ func (k kubernetesCache) Delete(ctx context.Context, name string) error {
 			// Don't overwrite the secret if the context was canceled.
 		default:
 			var dataBytes []byte
-			dataBytes, err = generateDeletePatch(name)
+			dataBytes, err = generateDeletePatch(key)
 			if err != nil {
 				return
 			}
-			_, err = k.Client.CoreV1().Secrets(k.Namespace).Patch(k.SecretName, types.JSONPatchType, dataBytes)
+			_, err = k.Client.CoreV1().Secrets(k.Namespace).Patch(k.secretFor(name), types.JSONPatchType, dataBytes)
 		}
 	}()
 	select {
@@ -221,6 +615,10 @@ func (k kubernetesCache) Delete(ctx context.Context, name string) error {
 		return ctx.Err()
 	case <-done:
 	}
-	log.Printf("delete %s: return err %v", name, err)
+	if err != nil {
+		l.Error("deleting cache entry", "err", err)
+	} else {
+		l.Info("deleted cache entry")
+	}
 	return err
 }
@@ -1,11 +1,144 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	jsonpatch "github.com/evanphx/json-patch"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
 )
 
+// fakeSecretsAPI is a Kubernetes API server that only knows about secrets,
+// which it keeps by namespace/name.
+type fakeSecretsAPI struct {
+	mu      sync.Mutex
+	secrets map[string]*v1.Secret
+	// If set, called with the stored secret before the next update, as if
+	// another writer changed it after the updater read it.
+	interleave func(stored *v1.Secret)
+}
+
+func newFakeSecretsAPI(secrets ...*v1.Secret) *fakeSecretsAPI {
+	f := &fakeSecretsAPI{secrets: make(map[string]*v1.Secret)}
+	for _, s := range secrets {
+		f.secrets[s.Namespace+"/"+s.Name] = s
+	}
+	return f
+}
+
+// get returns the secret namespace/name, or nil.
+func (f *fakeSecretsAPI) get(namespace, name string) *v1.Secret {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.secrets[namespace+"/"+name]
+}
+
+func (f *fakeSecretsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /api/v1/namespaces/<namespace>/secrets[/<name>]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) < 2 || parts[1] != "secrets" {
+		http.NotFound(w, r)
+		return
+	}
+	ns, name := parts[0], ""
+	if len(parts) > 2 {
+		name = parts[2]
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var secret *v1.Secret
+	switch r.Method {
+	case "GET":
+		secret = f.secrets[ns+"/"+name]
+	case "POST", "PUT":
+		secret = new(v1.Secret)
+		if err := json.Unmarshal(body, secret); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		old := f.secrets[ns+"/"+secret.Name]
+		if r.Method == "PUT" && old != nil && f.interleave != nil {
+			f.interleave(old)
+			f.interleave = nil
+			n, _ := strconv.Atoi(old.ResourceVersion)
+			old.ResourceVersion = strconv.Itoa(n + 1)
+		}
+		switch {
+		case r.Method == "POST" && old != nil:
+			f.writeStatus(w, http.StatusConflict, meta_v1.StatusReasonAlreadyExists)
+			return
+		case r.Method == "PUT" && old == nil:
+			f.writeStatus(w, http.StatusNotFound, meta_v1.StatusReasonNotFound)
+			return
+		case r.Method == "PUT" && old.ResourceVersion != secret.ResourceVersion:
+			f.writeStatus(w, http.StatusConflict, meta_v1.StatusReasonConflict)
+			return
+		}
+		secret.Namespace = ns
+		n, _ := strconv.Atoi(secret.ResourceVersion)
+		secret.ResourceVersion = strconv.Itoa(n + 1)
+		f.secrets[ns+"/"+secret.Name] = secret
+	case "PATCH":
+		if old := f.secrets[ns+"/"+name]; old != nil {
+			patch, err := jsonpatch.DecodePatch(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			doc, _ := json.Marshal(old)
+			if doc, err = patch.Apply(doc); err != nil {
+				f.writeStatus(w, http.StatusUnprocessableEntity, meta_v1.StatusReasonInvalid)
+				return
+			}
+			secret = new(v1.Secret)
+			json.Unmarshal(doc, secret)
+			f.secrets[ns+"/"+name] = secret
+		}
+	}
+	if secret == nil {
+		f.writeStatus(w, http.StatusNotFound, meta_v1.StatusReasonNotFound)
+		return
+	}
+	secret.Kind, secret.APIVersion = "Secret", "v1"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secret)
+}
+
+// serve starts serving f, and returns a client for it and the server, which
+// the caller should close.
+func (f *fakeSecretsAPI) serve(t *testing.T) (kubernetes.Interface, *httptest.Server) {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return client, srv
+}
+
+func (f *fakeSecretsAPI) writeStatus(w http.ResponseWriter, code int, reason meta_v1.StatusReason) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(meta_v1.Status{
+		TypeMeta: meta_v1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   meta_v1.StatusFailure,
+		Reason:   reason,
+		Code:     int32(code),
+	})
+}
+
 func TestCanMarshalPatch(t *testing.T) {
 	patchBytes, err := generateDeletePatch("foo")
 	if err != nil {
@@ -15,3 +148,49 @@ func TestCanMarshalPatch(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRetiredCacheRefusesWrites(t *testing.T) {
+	set := newCertificateSet()
+	build := func(cc certificateConfig) (*managedCertificate, error) {
+		cache := newKubernetesCache("acme.secret", cc.IngressSecret, "default", cc.Domain, "", nil, 1, outputOptions{}, false)
+		return &managedCertificate{Config: cc, cache: cache, source: namedSource(cc.Domain)}, nil
+	}
+	set.apply([]certificateConfig{{Domain: "a.example.com", IngressSecret: "a"}, {Domain: "b.example.com", IngressSecret: "b"}}, build)
+	b := set.lookup("b.example.com")
+	changes, _ := set.apply([]certificateConfig{{Domain: "a.example.com", IngressSecret: "a"}}, build)
+	if len(changes.old) != 1 || changes.old[0] != b {
+		t.Fatalf("got changes %+v", changes)
+	}
+	for _, old := range changes.old {
+		old.stop()
+	}
+
+	// The cache has no client, so anything that got past the check would
+	// panic.
+	ctx := context.Background()
+	if err := b.cache.Put(ctx, "b.example.com", []byte("data")); err != errCacheRetired {
+		t.Errorf("Put: got %v, want errCacheRetired", err)
+	}
+	if err := b.cache.updateIngressSecret(nil); err != errCacheRetired {
+		t.Errorf("updateIngressSecret: got %v, want errCacheRetired", err)
+	}
+	if _, err := b.cache.Get(ctx, "b.example.com"); err != errCacheRetired {
+		t.Errorf("Get: got %v, want errCacheRetired", err)
+	}
+	if err := b.cache.Delete(ctx, "b.example.com"); err != errCacheRetired {
+		t.Errorf("Delete: got %v, want errCacheRetired", err)
+	}
+
+	// Nor does its Manager talk to the CA.
+	client := newCertificateACMEHTTPClient(b.cache.isRetired)
+	if _, err := client.Get("https://acme.invalid/directory"); err == nil || !strings.Contains(err.Error(), errCacheRetired.Error()) {
+		t.Error("retired certificate's ACME client sent a request")
+	}
+
+	// A cache that forwards to a retired one is retired too.
+	old := newKubernetesCache("acme.secret", "b-old", "default", "b.example.com", "", nil, 1, outputOptions{}, false)
+	old.forward(b.cache)
+	if !old.isRetired() {
+		t.Error("cache forwarding to a retired cache isn't retired")
+	}
+}
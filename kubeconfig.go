@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// kubeconfig is the subset of a kubeconfig file we understand. client-go's
+// clientcmd loader isn't vendored, so we read the file ourselves; exec and
+// auth-provider plugins aren't supported.
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string            `json:"name"`
+		Cluster kubeconfigCluster `json:"cluster"`
+	} `json:"clusters"`
+	Contexts []struct {
+		Name    string            `json:"name"`
+		Context kubeconfigContext `json:"context"`
+	} `json:"contexts"`
+	Users []struct {
+		Name string         `json:"name"`
+		User kubeconfigUser `json:"user"`
+	} `json:"users"`
+}
+
+type kubeconfigCluster struct {
+	Server                   string `json:"server"`
+	CertificateAuthority     string `json:"certificate-authority"`
+	CertificateAuthorityData []byte `json:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+}
+
+type kubeconfigContext struct {
+	Cluster   string `json:"cluster"`
+	User      string `json:"user"`
+	Namespace string `json:"namespace"`
+}
+
+type kubeconfigUser struct {
+	ClientCertificate     string `json:"client-certificate"`
+	ClientCertificateData []byte `json:"client-certificate-data"`
+	ClientKey             string `json:"client-key"`
+	ClientKeyData         []byte `json:"client-key-data"`
+	Token                 string `json:"token"`
+	TokenFile             string `json:"tokenFile"`
+	Username              string `json:"username"`
+	Password              string `json:"password"`
+}
+
+// defaultKubeconfigPath returns the first file in $KUBECONFIG, or
+// ~/.kube/config if that exists, or "".
+func defaultKubeconfigPath() string {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)[0]
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		path := filepath.Join(home, ".kube", "config")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// loadKubeconfig returns a client config for the named context in the
+// kubeconfig file at path, or its current context if contextName is empty.
+// It also returns the context's namespace, which may be empty.
+func loadKubeconfig(path, contextName string) (*rest.Config, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, "", fmt.Errorf("parsing kubeconfig %s: %v", path, err)
+	}
+	if contextName == "" {
+		contextName = kc.CurrentContext
+	}
+	if contextName == "" {
+		return nil, "", fmt.Errorf("kubeconfig %s has no current-context", path)
+	}
+	var ctx *kubeconfigContext
+	for i := range kc.Contexts {
+		if kc.Contexts[i].Name == contextName {
+			ctx = &kc.Contexts[i].Context
+		}
+	}
+	if ctx == nil {
+		return nil, "", fmt.Errorf("kubeconfig %s has no context %q", path, contextName)
+	}
+	var cluster *kubeconfigCluster
+	for i := range kc.Clusters {
+		if kc.Clusters[i].Name == ctx.Cluster {
+			cluster = &kc.Clusters[i].Cluster
+		}
+	}
+	if cluster == nil {
+		return nil, "", fmt.Errorf("kubeconfig %s has no cluster %q", path, ctx.Cluster)
+	}
+	var user kubeconfigUser
+	for i := range kc.Users {
+		if kc.Users[i].Name == ctx.User {
+			user = kc.Users[i].User
+		}
+	}
+
+	// Relative paths are relative to the kubeconfig file.
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	config := &rest.Config{
+		Host:     cluster.Server,
+		Username: user.Username,
+		Password: user.Password,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure: cluster.InsecureSkipTLSVerify,
+			CAFile:   resolve(cluster.CertificateAuthority),
+			CAData:   cluster.CertificateAuthorityData,
+			CertFile: resolve(user.ClientCertificate),
+			CertData: user.ClientCertificateData,
+			KeyFile:  resolve(user.ClientKey),
+			KeyData:  user.ClientKeyData,
+		},
+		BearerToken: user.Token,
+	}
+	if config.BearerToken == "" && user.TokenFile != "" {
+		token, err := ioutil.ReadFile(resolve(user.TokenFile))
+		if err != nil {
+			return nil, "", err
+		}
+		config.BearerToken = strings.TrimSpace(string(token))
+	}
+	return config, ctx.Namespace, nil
+}
+
+// clientConfig returns a client config from the kubeconfig at path, the
+// default kubeconfig, or the in-cluster config, in that order. contextName
+// picks a kubeconfig context other than the current one. It also returns the
+// context's namespace, if any.
+func clientConfig(path, contextName string) (*rest.Config, string, error) {
+	if path == "" {
+		path = defaultKubeconfigPath()
+	}
+	if path != "" {
+		return loadKubeconfig(path, contextName)
+	}
+	if contextName != "" {
+		return nil, "", fmt.Errorf("context %q requested but there is no kubeconfig file", contextName)
+	}
+	config, err := rest.InClusterConfig()
+	return config, "", err
+}
+
+// commandClient returns a client for subcommands, using the kubeconfig at
+// path, the default kubeconfig, or the in-cluster config, in that order. It
+// also returns the kubeconfig context's namespace, if any.
+func commandClient(path string) (kubernetes.Interface, string, error) {
+	config, ns, err := clientConfig(path, "")
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	return client, ns, err
+}
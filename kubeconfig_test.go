@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev-cluster
+  cluster:
+    server: https://dev.example.com
+    certificate-authority: ca.crt
+- name: prod-cluster
+  cluster:
+    server: https://prod.example.com
+    certificate-authority-data: Y2EgZGF0YQ==
+contexts:
+- name: dev
+  context:
+    cluster: dev-cluster
+    user: dev-user
+    namespace: certs
+- name: prod
+  context:
+    cluster: prod-cluster
+    user: prod-user
+users:
+- name: dev-user
+  user:
+    token: dev-token
+- name: prod-user
+  user:
+    client-certificate-data: Y2VydA==
+    client-key-data: a2V5
+`
+
+func TestLoadKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, ns, err := loadKubeconfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://dev.example.com" || config.BearerToken != "dev-token" || ns != "certs" {
+		t.Errorf("current context: got host %q, token %q, namespace %q", config.Host, config.BearerToken, ns)
+	}
+	if want := filepath.Join(dir, "ca.crt"); config.CAFile != want {
+		t.Errorf("got CA file %q, want %q", config.CAFile, want)
+	}
+
+	config, ns, err = loadKubeconfig(path, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://prod.example.com" || string(config.CAData) != "ca data" || string(config.CertData) != "cert" || string(config.KeyData) != "key" || ns != "" {
+		t.Errorf("prod context: got %+v, namespace %q", config, ns)
+	}
+
+	if _, _, err := loadKubeconfig(path, "staging"); err == nil {
+		t.Error("expected error for unknown context")
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("KUBECONFIG", os.Getenv("KUBECONFIG"))
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+
+	os.Setenv("KUBECONFIG", path)
+	config, ns, err := clientConfig("", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://prod.example.com" || ns != "" {
+		t.Errorf("$KUBECONFIG: got host %q, namespace %q", config.Host, ns)
+	}
+
+	os.Setenv("KUBECONFIG", "")
+	os.Setenv("HOME", dir) // no .kube/config here
+	if _, _, err := clientConfig("", "prod"); err == nil {
+		t.Error("expected error for a context without a kubeconfig")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+)
+
+// logger is the root logger. Everything in the program logs through it or a
+// child created with logger.New, so the format, level and redaction set up by
+// setupLogging apply everywhere.
+var logger = log15.New()
+
+func init() {
+	// Until flags are parsed, log at info level in text format.
+	setupLogging("text", "info")
+}
+
+// setupLogging configures the root logger. format is "text" (logfmt) or
+// "json"; level is one of debug, info, warn, error or crit.
+func setupLogging(format, level string) error {
+	lvl, err := log15.LvlFromString(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	var f log15.Format
+	switch format {
+	case "text":
+		f = log15.LogfmtFormat()
+	case "json":
+		f = log15.JsonFormat()
+	default:
+		return fmt.Errorf("invalid log format %q (expected text or json)", format)
+	}
+	h := log15.StreamHandler(os.Stderr, f)
+	logger.SetHandler(log15.LvlFilterHandler(lvl, redactHandler(h)))
+	return nil
+}
+
+// fatal logs msg at the critical level and exits.
+func fatal(msg string, ctx ...interface{}) {
+	logger.Crit(msg, ctx...)
+	os.Exit(1)
+}
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeyRx matches log context keys whose values must never be logged.
+var sensitiveKeyRx = regexp.MustCompile(`(?i)(password|passwd|token|hmac|eab|private|authorization|secret_data|key_pem)`)
+
+// pemPrivateKeyRx matches a PEM encoded private key anywhere in a string.
+var pemPrivateKeyRx = regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?(-----END [A-Z ]*PRIVATE KEY-----|$)`)
+
+// redactHandler scrubs key material, tokens and other secrets from log
+// records before passing them to h:
+//
+//   - values of keys that look sensitive (password, token, hmac, eab, ...)
+//     are replaced,
+//   - byte slices are never printed, only their length, since they are almost
+//     always certificate or key data,
+//   - PEM private keys are removed from the message and any string value.
+func redactHandler(h log15.Handler) log15.Handler {
+	return log15.FuncHandler(func(r *log15.Record) error {
+		r.Msg = redactString(r.Msg)
+		ctx := make([]interface{}, len(r.Ctx))
+		copy(ctx, r.Ctx)
+		for i := 0; i+1 < len(ctx); i += 2 {
+			key, _ := ctx[i].(string)
+			ctx[i+1] = redactValue(key, ctx[i+1])
+		}
+		r.Ctx = ctx
+		return h.Log(r)
+	})
+}
+
+func redactValue(key string, val interface{}) interface{} {
+	if sensitiveKeyRx.MatchString(key) {
+		return redacted
+	}
+	switch v := val.(type) {
+	case []byte:
+		return fmt.Sprintf("[%d bytes]", len(v))
+	case string:
+		return redactString(v)
+	case error:
+		return redactString(v.Error())
+	case fmt.Stringer:
+		return redactString(v.String())
+	}
+	return val
+}
+
+func redactString(s string) string {
+	if !strings.Contains(s, "PRIVATE KEY") {
+		return s
+	}
+	return pemPrivateKeyRx.ReplaceAllString(s, redacted)
+}
+
+// newRequestID returns a short random ID to correlate log lines for one
+// request.
+func newRequestID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
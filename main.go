@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -16,7 +17,6 @@ import (
 
 	"github.com/kevinburke/handlers"
 	"golang.org/x/crypto/acme"
-	"golang.org/x/crypto/acme/autocert"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -31,28 +31,75 @@ func getBoolEnv(varname string) bool {
 	}
 }
 
+var configPath = flag.String("config", "", "YAML or JSON file describing the issuers and certificates to manage, reloaded when it changes or on SIGHUP. Can't be combined with the per-certificate flags")
+
 var domain = flag.String("domain", "", "The domain to use")
 var email = flag.String("email", "", "The email registering the cert")
 var httpPort = flag.Int("http-port", 8442, "The HTTP port to listen on")
 var tlsPort = flag.Int("tls-port", 8443, "The TLS port to listen on")
+var healthPort = flag.Int("health-port", 8081, "The port to serve /healthz, /readyz and /status on. Set to 0 to disable")
+var criticalExpiry = flag.Duration("critical-expiry", 7*24*time.Hour, "Report not ready when a certificate expires within this window")
+var renewBefore = flag.String("renew-before", "", "How long before expiry to renew, as a duration like 720h or a share of the lifetime like 33% (default 720h for ACME, 33% for the ca and csr issuers)")
+var renewJitter = flag.Duration("renew-jitter", 0, "Renew up to this much earlier, chosen at random, so many generators don't renew at once")
+var watchdogInterval = flag.Duration("watchdog-interval", 0, "Scan every TLS secret in the cluster this often and export their expiry as metrics. Set to 0 to disable")
+var metricsPort = flag.Int("metrics-port", 9090, "The port to serve Prometheus metrics on. Set to 0 to disable")
 
 var staging = flag.Bool("staging", getBoolEnv("STAGING"), "Use the letsencrypt staging server")
+var promote = flag.Bool("promote", false, "Use the letsencrypt production server, if this configuration has been issued a certificate by the staging server. Overrides -staging")
+
+var kubeconfigPath = flag.String("kubeconfig", "", "Path to a kubeconfig file, to run outside the cluster (default $KUBECONFIG, or ~/.kube/config if it exists, or the in-cluster config)")
+var kubeContext = flag.String("context", "", "kubeconfig context to use (default the current context)")
+var kubeAPIQPS = flag.Float64("kube-api-qps", float64(rest.DefaultQPS), "Maximum sustained queries per second to the Kubernetes API")
+var kubeAPIBurst = flag.Int("kube-api-burst", rest.DefaultBurst, "Maximum burst of queries to the Kubernetes API")
+var kubeAPITimeout = flag.Duration("kube-api-timeout", 30*time.Second, "Timeout for each Kubernetes API request. Set to 0 to disable")
 
 var namespace = flag.String("namespace", "", "Namespace to use for cert storage.")
 var secretName = flag.String("secret", "acme.secret", "Secret to use for cert storage")
+var accountSecretName = flag.String("account-secret", "", "Secret to keep the ACME account key in, so access to it can be restricted more than -secret (default -secret)")
 var ingressSecretName = flag.String("ingress-secret", "acme.ingress.secret", "Secret to use for storing ingress certificate")
 
-func createInClusterClient() (*kubernetes.Clientset, error) {
-	config, err := rest.InClusterConfig()
+var outputFormats = flag.String("output-formats", "", "Comma separated extra formats to write to the ingress secret (pkcs12, jks, pem-combined, der)")
+var keystorePasswordSecret = flag.String("keystore-password-secret", "", "Secret holding the password for pkcs12 and jks keystores")
+var keystorePasswordKey = flag.String("keystore-password-key", "password", "Key in -keystore-password-secret holding the keystore password")
+var secretTemplatePath = flag.String("secret-template", "", "YAML or JSON file describing extra templated keys to write to the ingress secret")
+
+var eventsFor = flag.String("events-for", "", "Object to record Kubernetes Events against, as Kind/name (default the ingress secret)")
+
+var logFormat = flag.String("log-format", "text", "Log format, text (logfmt) or json")
+var logLevel = flag.String("log-level", "info", "Minimum level to log: debug, info, warn, error or crit")
+
+var dryRun = flag.Bool("dry-run", false, "Issue a certificate from the staging CA and report what would change in the ingress secret, without writing to any secret")
+
+var adoptSecret = flag.String("adopt-secret", "", "kubernetes.io/tls secret, as name or namespace/name, holding an existing certificate for -domain to import on startup if none is cached")
+
+var restartWorkloadsFlag = flag.Bool("restart-workloads", false, "Restart Deployments, StatefulSets and DaemonSets that use the ingress secret after it's updated")
+
+// createClient returns a client using -kubeconfig and -context, falling back
+// to the in-cluster config, and the kubeconfig context's namespace, if any.
+func createClient() (*kubernetes.Clientset, string, error) {
+	if *kubeAPIQPS <= 0 || *kubeAPIBurst <= 0 {
+		return nil, "", fmt.Errorf("-kube-api-qps and -kube-api-burst must be positive")
+	}
+	config, ns, err := clientConfig(*kubeconfigPath, *kubeContext)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	config.QPS = float32(*kubeAPIQPS)
+	config.Burst = *kubeAPIBurst
+	config.Timeout = *kubeAPITimeout
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, "", err
 	}
-	return kubernetes.NewForConfig(config)
+	logger.Info("created Kubernetes client", "host", config.Host, "context_namespace", ns)
+	return client, ns, nil
 }
 
-func getNamespace() string {
-	if len(*namespace) > 0 {
-		return *namespace
+// defaultNamespace returns ns, or if it's empty the namespace we're running
+// in, or "default".
+func defaultNamespace(ns string) string {
+	if len(ns) > 0 {
+		return ns
 	}
 	if data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
 		if ns := strings.TrimSpace(string(data)); len(ns) > 0 {
@@ -87,55 +134,226 @@ func shutdownServer(server *http.Server) {
 	shutdownCancel()
 }
 
+// serveHTTP serves plain HTTP on server.Addr until the server is shut down.
+// If the server fails, cancel is called to stop the program.
+func serveHTTP(server *http.Server, name string, cancel context.CancelFunc) {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		fatal("could not listen", "server", name, "addr", server.Addr, "err", err)
+	}
+	defer ln.Close()
+	logger.Info("started server", "server", name, "addr", server.Addr)
+	serveErr := server.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+	if serveErr != http.ErrServerClosed {
+		logger.Error("server failed", "server", name, "err", serveErr)
+		cancel()
+	}
+}
+
+// subcommands can be run instead of the generator by passing their name as
+// the first argument, e.g. "k8s-cert-generator inspect".
+var subcommands = map[string]func(args []string, out io.Writer) error{
+	"inspect": runInspect,
+	"import":  runImport,
+	"account": runAccount,
+	"revoke":  runRevoke,
+	"scan":    runScan,
+}
+
+// configFlags are the flags that -config replaces.
+var configFlags = []string{
+	"domain", "email", "http-port", "tls-port", "health-port", "metrics-port",
+	"critical-expiry", "staging", "namespace", "secret", "account-secret",
+	"ingress-secret", "output-formats", "keystore-password-secret",
+	"keystore-password-key", "secret-template", "events-for", "adopt-secret",
+	"restart-workloads", "renew-before", "renew-jitter", "watchdog-interval",
+}
+
+// configFromFlags returns the configuration described by the command line
+// flags, for when there's no -config.
+func configFromFlags() (*generatorConfig, error) {
+	window, err := parseRenewWindow(*renewBefore)
+	if err != nil {
+		return nil, fmt.Errorf("-renew-before: %v", err)
+	}
+	c := defaultConfig()
+	c.Namespace = *namespace
+	c.CacheSecret = *secretName
+	c.AccountSecret = *accountSecretName
+	c.EventsFor = *eventsFor
+	c.Listen = listenConfig{HTTPPort: *httpPort, TLSPort: *tlsPort, HealthPort: *healthPort, MetricsPort: *metricsPort}
+	c.Policies.CriticalExpiry = duration{*criticalExpiry}
+	c.Policies.RenewBefore = window
+	c.Policies.RenewJitter = duration{*renewJitter}
+	c.Watchdog.Interval = duration{*watchdogInterval}
+	c.ReloadInterval = duration{}
+	c.Issuers = map[string]*issuerConfig{
+		"letsencrypt": {Staging: *staging, Email: *email},
+	}
+	c.Certificates = []certificateConfig{{
+		Domain:                 *domain,
+		IngressSecret:          *ingressSecretName,
+		OutputFormats:          strings.Split(*outputFormats, ","),
+		KeystorePasswordSecret: *keystorePasswordSecret,
+		KeystorePasswordKey:    *keystorePasswordKey,
+		SecretTemplate:         *secretTemplatePath,
+		RestartWorkloads:       *restartWorkloadsFlag,
+		AdoptSecret:            *adoptSecret,
+	}}
+	return c, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:], os.Stdout); err != nil && err != flag.ErrHelp {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	flag.Parse()
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		fatal("could not configure logging", "err", err)
+	}
+	if *promote && *dryRun {
+		fatal("-promote and -dry-run can't be used together")
+	}
+	var cfg *generatorConfig
+	var err error
+	if *configPath != "" {
+		var set []string
+		flag.Visit(func(f *flag.Flag) {
+			for _, name := range configFlags {
+				if f.Name == name {
+					set = append(set, "-"+name)
+				}
+			}
+		})
+		if len(set) > 0 {
+			fatal("these flags can't be used with -config; set them in the file instead", "flags", strings.Join(set, " "))
+		}
+		cfg, err = loadConfig(*configPath)
+		if err != nil {
+			fatal("could not load config", "err", err)
+		}
+	} else {
+		if *domain == "" {
+			fatal("-domain or -config is required")
+		}
+		cfg, err = configFromFlags()
+		if err == nil {
+			err = cfg.validate()
+		}
+		if err != nil {
+			fatal("invalid flags", "err", err)
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGQUIT)
 	ctx, cancel := context.WithCancel(context.Background())
 
-	client, err := createInClusterClient()
+	client, contextNamespace, err := createClient()
 	if err != nil {
-		log.Fatal(err)
+		fatal("could not create Kubernetes client", "err", err)
+	}
+	g := &generator{
+		Client:           client,
+		ContextNamespace: contextNamespace,
+		DryRun:           *dryRun,
+		Promote:          *promote,
+		Out:              os.Stdout,
+	}
+	if err := g.prepare(cfg); err != nil {
+		fatal("can't use configuration", "err", err)
 	}
 
-	cache := newKubernetesCache(*secretName, *ingressSecretName, getNamespace(), *domain, client, 1)
-	var acmeClient *acme.Client
-	if *staging {
-		acmeClient = &acme.Client{DirectoryURL: "https://acme-staging.api.letsencrypt.org/directory"}
+	if !*dryRun {
+		// A dry run writes nothing, so it doesn't record events or persist
+		// backoff state either.
+		eventKind, eventName := cfg.eventObject()
+		events = newEventRecorder(client, cfg.Namespace, eventKind, eventName)
+		backoffs = newBackoffTracker(&secretBackoffStore{
+			Client:     client,
+			Namespace:  cfg.Namespace,
+			SecretName: cfg.CacheSecret,
+			Key:        cfg.backoffKey(),
+		})
+		if notifications, err = newNotifier(cfg, os.LookupEnv); err != nil {
+			fatal("could not set up notifications", "err", err)
+		}
+		if notifications != nil {
+			go notifications.run(ctx, certStatus)
+		}
+	} else {
+		logger.Info("dry run: no secrets will be written")
 	}
 
-	log.Printf("Creating cert manager for domain %s", *domain)
-	certManager := autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(*domain),
-		Cache:      cache,
-		Email:      *email,
-		Client:     acmeClient,
+	certs := newCertificateSet()
+	if err := g.sync(ctx, certs, cfg); err != nil {
+		fatal("could not set up certificates", "err", err)
+	}
+	if *configPath != "" {
+		current := cfg
+		go watchConfig(ctx, *configPath, cfg.ReloadInterval.Duration, func(reason string) {
+			next, err := loadConfig(*configPath)
+			if err == nil {
+				err = g.prepare(next)
+			}
+			if err != nil {
+				configReloads.Inc("failure")
+				logger.Error("not reloading config", "reason", reason, "err", err)
+				return
+			}
+			if changed := current.keepRestartSettings(next); len(changed) > 0 {
+				logger.Warn("ignoring config changes that need a restart", "settings", strings.Join(changed, ", "))
+			}
+			if err := g.sync(ctx, certs, next); err != nil {
+				configReloads.Inc("failure")
+				logger.Error("could not apply every config change", "reason", reason, "err", err)
+			} else {
+				configReloads.Inc("success")
+				logger.Info("reloaded config", "reason", reason, "certificates", len(next.Certificates))
+			}
+			current = next
+		})
+	}
+
+	if cfg.Watchdog.Interval.Duration > 0 {
+		go runWatchdog(ctx, client, cfg.Watchdog, cfg.Policies.CriticalExpiry.Duration)
 	}
 
 	tlsMux := http.NewServeMux()
 	tlsMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello world"))
-		log.Printf("Got request to %s", r.URL.String())
+		logger.Debug("got request", "protocol", "https", "url", r.URL.String())
 	})
-	tlsPortString := fmt.Sprintf(":%d", *tlsPort)
-	tlsLogger := handlers.Logger.New("protocol", "https")
+	tlsPortString := fmt.Sprintf(":%d", cfg.Listen.TLSPort)
+	tlsLogger := logger.New("protocol", "https")
 	server := &http.Server{
-		Addr:      tlsPortString,
-		Handler:   handlers.WithLogger(tlsMux, tlsLogger),
-		TLSConfig: certManager.TLSConfig(),
+		Addr:    tlsPortString,
+		Handler: handlers.WithLogger(tlsMux, tlsLogger),
+		TLSConfig: &tls.Config{
+			GetCertificate: instrumentGetCertificate(certs.managed, certs.backoffScope, certs.GetCertificate),
+			NextProtos: []string{
+				"h2", "http/1.1", // enable HTTP/2
+				acme.ALPNProto, // enable tls-alpn ACME challenges
+			},
+		},
 	}
 	go func() {
 		ln, err := net.Listen("tcp", server.Addr)
 		if err != nil {
-			log.Fatal(err)
+			fatal("could not listen", "server", "TLS", "addr", server.Addr, "err", err)
 		}
 		defer ln.Close()
-		log.Printf("Started TLS server on %s", server.Addr)
+		logger.Info("started server", "server", "TLS", "addr", server.Addr)
 		// key and cert are coming from Let's Encrypt
 		serveErr := server.ServeTLS(tcpKeepAliveListener{ln.(*net.TCPListener)}, "", "")
 		if serveErr != http.ErrServerClosed {
-			log.Printf("Error starting TLS server: %v", serveErr)
+			logger.Error("server failed", "server", "TLS", "err", serveErr)
 			cancel()
 		}
 	}()
@@ -143,32 +361,52 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello world"))
-		log.Printf("Fallback handler called over HTTP: %s %s", r.Method, r.URL.String())
+		logger.Debug("fallback handler called", "protocol", "http", "method", r.Method, "url", r.URL.String())
 	})
-	httpHandler := certManager.HTTPHandler(mux)
-	httpPortString := fmt.Sprintf(":%d", *httpPort)
-	httpLogger := handlers.Logger.New("protocol", "http")
+	httpHandler := instrumentChallengeHandler(certs.HTTPHandler(mux))
+	httpPortString := fmt.Sprintf(":%d", cfg.Listen.HTTPPort)
+	httpLogger := logger.New("protocol", "http")
 	httpServer := &http.Server{
 		Addr:    httpPortString,
 		Handler: handlers.WithLogger(httpHandler, httpLogger),
 	}
-	go func() {
-		ln, err := net.Listen("tcp", httpServer.Addr)
-		if err != nil {
-			log.Fatal(err)
+	go serveHTTP(httpServer, "HTTP", cancel)
+
+	var healthServer *http.Server
+	if cfg.Listen.HealthPort != 0 {
+		health := &healthChecker{
+			Client:         client,
+			Namespace:      cfg.Namespace,
+			SecretName:     cfg.CacheSecret,
+			Certificates:   certs,
+			CriticalWindow: cfg.Policies.CriticalExpiry.Duration,
 		}
-		defer ln.Close()
-		log.Printf("Started HTTP server on %s", httpServer.Addr)
-		serveErr := httpServer.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
-		if serveErr != http.ErrServerClosed {
-			log.Printf("Error starting http server: %v", serveErr)
-			cancel()
+		healthMux := http.NewServeMux()
+		healthMux.HandleFunc("/healthz", health.ServeHealthz)
+		healthMux.HandleFunc("/readyz", health.ServeReadyz)
+		healthMux.HandleFunc("/status", certStatus.ServeHTML)
+		healthMux.HandleFunc("/status.json", certStatus.ServeJSON)
+		healthServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.Listen.HealthPort),
+			Handler: healthMux,
 		}
-	}()
+		go serveHTTP(healthServer, "health", cancel)
+	}
+
+	var metricsServer *http.Server
+	if cfg.Listen.MetricsPort != 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", registry)
+		metricsServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.Listen.MetricsPort),
+			Handler: metricsMux,
+		}
+		go serveHTTP(metricsServer, "metrics", cancel)
+	}
 
 	select {
 	case sig := <-c:
-		fmt.Fprintf(os.Stderr, "Caught signal %v, shutting down...\n", sig)
+		logger.Info("caught signal, shutting down", "signal", sig)
 	case <-ctx.Done():
 	}
 
@@ -177,4 +415,10 @@ func main() {
 	// consecutively and there's enough concurrency in this program.
 	shutdownServer(server)
 	shutdownServer(httpServer)
+	if healthServer != nil {
+		shutdownServer(healthServer)
+	}
+	if metricsServer != nil {
+		shutdownServer(metricsServer)
+	}
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small implementation of the Prometheus text exposition format. The
+// Prometheus client library isn't vendored, and we only need counters, gauges
+// and histograms with labels.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type metricsRegistry struct {
+	mu        sync.Mutex
+	metrics   []metric
+	onCollect []func()
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// OnCollect registers fn to be run before every scrape, to update gauges
+// that depend on the current time.
+func (r *metricsRegistry) OnCollect(fn func()) {
+	r.mu.Lock()
+	r.onCollect = append(r.onCollect, fn)
+	r.mu.Unlock()
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	hooks := append([]func(){}, r.onCollect...)
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+// metricVec holds the per label set values of a metric.
+type metricVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labels []string
+	value  float64
+
+	// histograms only
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetricVec(typ, name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: typ, labels: labels, values: make(map[string]*metricValue)}
+}
+
+// get returns the value for the given label values, creating it if needed.
+// The caller must hold v.mu.
+func (v *metricVec) get(labels []string, buckets int) *metricValue {
+	if len(labels) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", v.name, len(labels), len(v.labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	val, ok := v.values[key]
+	if !ok {
+		val = &metricValue{labels: append([]string{}, labels...), counts: make([]uint64, buckets)}
+		v.values[key] = val
+	}
+	return val
+}
+
+func (v *metricVec) sortedValues() []*metricValue {
+	vals := make([]*metricValue, 0, len(v.values))
+	for _, val := range v.values {
+		vals = append(vals, val)
+	}
+	sort.Slice(vals, func(i, j int) bool {
+		return strings.Join(vals[i].labels, "\xff") < strings.Join(vals[j].labels, "\xff")
+	})
+	return vals
+}
+
+func (v *metricVec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.writeHeader(w)
+	for _, val := range v.sortedValues() {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, val.labels, "", ""), formatFloat(val.value))
+	}
+}
+
+type counterVec struct{ *metricVec }
+
+func newCounterVec(r *metricsRegistry, name, help string, labels ...string) *counterVec {
+	c := &counterVec{newMetricVec("counter", name, help, labels...)}
+	r.register(c)
+	return c
+}
+
+func (c *counterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *counterVec) Add(n float64, labels ...string) {
+	c.mu.Lock()
+	c.get(labels, 0).value += n
+	c.mu.Unlock()
+}
+
+type gaugeVec struct{ *metricVec }
+
+func newGaugeVec(r *metricsRegistry, name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{newMetricVec("gauge", name, help, labels...)}
+	r.register(g)
+	return g
+}
+
+func (g *gaugeVec) Set(n float64, labels ...string) {
+	g.mu.Lock()
+	g.get(labels, 0).value = n
+	g.mu.Unlock()
+}
+
+// Delete removes the value for the given labels, e.g. when a certificate is
+// no longer managed.
+func (g *gaugeVec) Delete(labels ...string) {
+	g.mu.Lock()
+	delete(g.values, strings.Join(labels, "\xff"))
+	g.mu.Unlock()
+}
+
+// Each calls fn with the label values and value of every series.
+func (g *gaugeVec) Each(fn func(labels []string, value float64)) {
+	g.mu.Lock()
+	vals := g.sortedValues()
+	g.mu.Unlock()
+	for _, val := range vals {
+		fn(val.labels, val.value)
+	}
+}
+
+type histogramVec struct {
+	*metricVec
+	buckets []float64
+}
+
+// defaultBuckets are the Prometheus client's default latency buckets, in
+// seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newHistogramVec(r *metricsRegistry, name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{newMetricVec("histogram", name, help, labels...), buckets}
+	r.register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(n float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	val := h.get(labels, len(h.buckets))
+	for i, upper := range h.buckets {
+		if n <= upper {
+			val.counts[i]++
+		}
+	}
+	val.sum += n
+	val.count++
+}
+
+// Since observes the time elapsed since start, in seconds.
+func (h *histogramVec) Since(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, val := range h.sortedValues() {
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, val.labels, "le", formatFloat(upper)), val.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, val.labels, "le", "+Inf"), val.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, val.labels, "", ""), formatFloat(val.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, val.labels, "", ""), val.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	r := new(metricsRegistry)
+	c := newCounterVec(r, "test_requests_total", "Requests.", "code")
+	g := newGaugeVec(r, "test_temperature", "Temperature.")
+	h := newHistogramVec(r, "test_latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc(`a"b`)
+	g.Set(1.5)
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	r.OnCollect(func() { g.Set(2.5) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{code="200"} 3` + "\n",
+		`test_requests_total{code="a\"b"} 1` + "\n",
+		"test_temperature 2.5\n",
+		`test_latency_seconds_bucket{op="get",le="0.1"} 1` + "\n",
+		`test_latency_seconds_bucket{op="get",le="1"} 2` + "\n",
+		`test_latency_seconds_bucket{op="get",le="+Inf"} 2` + "\n",
+		`test_latency_seconds_count{op="get"} 2` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("output missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification events, as named in webhook configuration and payloads.
+const (
+	notifyIssued         = "issued"
+	notifyRenewed        = "renewed"
+	notifyIssuanceFailed = "issuance-failed"
+	notifyPublishFailed  = "publish-failed"
+	notifyExpiring       = "expiring"
+)
+
+var notificationEvents = []string{notifyIssued, notifyRenewed, notifyIssuanceFailed, notifyPublishFailed, notifyExpiring}
+
+const (
+	defaultRepeatInterval     = 6 * time.Hour
+	defaultNotifyAttempts     = 5
+	defaultNotifyRetryDelay   = 2 * time.Second
+	notificationTimeout       = 10 * time.Second
+	expiryNotifyCheckInterval = 10 * time.Minute
+)
+
+// defaultExpiryThresholds are when certificates are notified as expiring:
+// two weeks, a week and a day before.
+var defaultExpiryThresholds = []duration{{14 * 24 * time.Hour}, {7 * 24 * time.Hour}, {24 * time.Hour}}
+
+// notification is something that happened to a certificate. It's the JSON
+// body of generic webhooks and the value webhook templates are executed
+// against.
+type notification struct {
+	Event     string    `json:"event"`
+	Severity  string    `json:"severity"` // "info", "warning" or "critical"
+	Domain    string    `json:"domain"`
+	Namespace string    `json:"namespace"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+
+	Issuer      string     `json:"issuer,omitempty"`
+	NotAfter    *time.Time `json:"notAfter,omitempty"`
+	Fingerprint string     `json:"fingerprintSHA256,omitempty"`
+	Secret      string     `json:"secret,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	// For expiring, the threshold the certificate crossed, e.g. "168h0m0s".
+	Threshold string `json:"threshold,omitempty"`
+}
+
+// Title returns a one line summary, e.g. "Renewed certificate for
+// example.com".
+func (n *notification) Title() string {
+	switch n.Event {
+	case notifyIssued:
+		return "Issued certificate for " + n.Domain
+	case notifyRenewed:
+		return "Renewed certificate for " + n.Domain
+	case notifyIssuanceFailed:
+		return "Failed to obtain certificate for " + n.Domain
+	case notifyPublishFailed:
+		return "Failed to publish certificate for " + n.Domain
+	case notifyExpiring:
+		return "Certificate for " + n.Domain + " expires soon"
+	}
+	return n.Event + ": " + n.Domain
+}
+
+// notificationKey identifies notifications that say the same thing, to
+// suppress repeats.
+type notificationKey struct {
+	event, domain, detail string
+}
+
+// key returns n's notificationKey, and false if n is never suppressed.
+func (n *notification) key() (notificationKey, bool) {
+	switch n.Event {
+	case notifyIssuanceFailed:
+		// Errors differ in their details from one attempt to the next, so
+		// any failure for the domain counts as the same one.
+		return notificationKey{n.Event, n.Domain, ""}, true
+	case notifyPublishFailed:
+		return notificationKey{n.Event, n.Domain, n.Secret}, true
+	case notifyExpiring:
+		return notificationKey{n.Event, n.Domain, n.Threshold}, true
+	}
+	return notificationKey{}, false
+}
+
+// notificationSink is somewhere notifications are delivered, e.g. a
+// webhook.
+type notificationSink interface {
+	name() string
+	// wants reports whether the sink takes n.
+	wants(n *notification) bool
+	send(ctx context.Context, n *notification) error
+}
+
+// periodicSink is a notificationSink that also sends something on a
+// schedule, like email digests.
+type periodicSink interface {
+	notificationSink
+	run(ctx context.Context, s *statusTracker, namespace string)
+}
+
+// permanentError is a delivery failure that retrying won't fix.
+type permanentError struct{ error }
+
+// notifier sends notifications to every sink that wants them, retrying
+// failed deliveries in the background.
+type notifier struct {
+	Namespace string
+	Sinks     []notificationSink
+
+	// An ongoing failure is notified again at most once per RepeatInterval.
+	// Expiry notifications are sent once per threshold.
+	RepeatInterval time.Duration
+	// Certificates are notified as expiring as they cross each threshold.
+	// Those expiring within CriticalWindow are critical.
+	ExpiryThresholds []time.Duration
+	CriticalWindow   time.Duration
+
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	mu   sync.Mutex
+	sent map[notificationKey]time.Time
+	// Extra email recipients by domain, from the certificates' notifyEmail.
+	recipients map[string][]string
+}
+
+// notifications is the process wide notifier. It is nil, and notifying is a
+// no-op, unless main sets it up.
+var notifications *notifier
+
+// newNotifier returns a notifier for c, or nil if c has no notification
+// sinks. lookupEnv resolves the environment variables sinks are configured
+// with.
+func newNotifier(c *generatorConfig, lookupEnv func(string) (string, bool)) (*notifier, error) {
+	nc := c.Notifications
+	n := &notifier{
+		Namespace:      c.Namespace,
+		RepeatInterval: nc.RepeatInterval.Duration,
+		CriticalWindow: c.Policies.CriticalExpiry.Duration,
+		MaxAttempts:    defaultNotifyAttempts,
+		RetryDelay:     defaultNotifyRetryDelay,
+		sent:           make(map[notificationKey]time.Time),
+	}
+	for _, t := range nc.ExpiryThresholds {
+		n.ExpiryThresholds = append(n.ExpiryThresholds, t.Duration)
+	}
+	sort.Slice(n.ExpiryThresholds, func(i, j int) bool { return n.ExpiryThresholds[i] < n.ExpiryThresholds[j] })
+	for _, wc := range nc.Webhooks {
+		w, err := newWebhookSink(wc, lookupEnv)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %v", wc.Name, err)
+		}
+		n.Sinks = append(n.Sinks, w)
+	}
+	if nc.Email.Host != "" {
+		e, err := newEmailSink(nc.Email, lookupEnv, n.recipientsFor)
+		if err != nil {
+			return nil, fmt.Errorf("email: %v", err)
+		}
+		n.Sinks = append(n.Sinks, e)
+	}
+	n.setRecipients(c)
+	if len(n.Sinks) == 0 {
+		return nil, nil
+	}
+	return n, nil
+}
+
+// notify sends note to every sink that wants it, unless it repeats one sent
+// recently. A certificate being issued or renewed resolves its failures and
+// expiry, so they're notified again if they recur. n may be nil.
+func (n *notifier) notify(note notification) {
+	if n == nil {
+		return
+	}
+	if note.Time.IsZero() {
+		note.Time = time.Now()
+	}
+	note.Namespace = n.Namespace
+	if note.Severity == "" {
+		note.Severity = "info"
+		if note.Event == notifyIssuanceFailed || note.Event == notifyPublishFailed {
+			note.Severity = "warning"
+		}
+	}
+	if note.Event == notifyIssued || note.Event == notifyRenewed {
+		n.clear(note.Domain, notifyIssuanceFailed, notifyPublishFailed, notifyExpiring)
+	}
+	if !n.firstSend(&note) {
+		for _, s := range n.Sinks {
+			if s.wants(&note) {
+				notificationsSent.Inc(s.name(), note.Event, "suppressed")
+			}
+		}
+		return
+	}
+	for _, s := range n.Sinks {
+		if s.wants(&note) {
+			go n.deliver(s, note)
+		}
+	}
+}
+
+// firstSend records that note is being sent, and reports whether it should
+// be: it isn't a repeat within RepeatInterval, or an expiry threshold that
+// was already notified.
+func (n *notifier) firstSend(note *notification) bool {
+	key, ok := note.key()
+	if !ok {
+		return true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if last, ok := n.sent[key]; ok {
+		if note.Event == notifyExpiring || n.RepeatInterval <= 0 || note.Time.Sub(last) < n.RepeatInterval {
+			return false
+		}
+	}
+	n.sent[key] = note.Time
+	return true
+}
+
+// setRecipients records the extra email recipients of c's certificates. n
+// may be nil.
+func (n *notifier) setRecipients(c *generatorConfig) {
+	if n == nil {
+		return
+	}
+	recipients := make(map[string][]string)
+	for _, cc := range c.Certificates {
+		if len(cc.NotifyEmail) > 0 {
+			recipients[cc.Domain] = cc.NotifyEmail
+		}
+	}
+	n.mu.Lock()
+	n.recipients = recipients
+	n.mu.Unlock()
+}
+
+// recipientsFor returns the extra email recipients for domain.
+func (n *notifier) recipientsFor(domain string) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.recipients[domain]
+}
+
+// clear forgets the given events for domain, so the next one is sent. n may
+// be nil.
+func (n *notifier) clear(domain string, events ...string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key := range n.sent {
+		if key.domain != domain {
+			continue
+		}
+		for _, event := range events {
+			if key.event == event {
+				delete(n.sent, key)
+			}
+		}
+	}
+}
+
+// deliver sends note to s, retrying with exponential backoff.
+func (n *notifier) deliver(s notificationSink, note notification) {
+	l := logger.New("sink", s.name(), "event", note.Event, "domain", note.Domain)
+	delay := n.RetryDelay
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+		err := s.send(ctx, &note)
+		cancel()
+		if err == nil {
+			notificationsSent.Inc(s.name(), note.Event, "sent")
+			l.Debug("sent notification")
+			return
+		}
+		if _, permanent := err.(permanentError); permanent || attempt >= n.MaxAttempts {
+			notificationsSent.Inc(s.name(), note.Event, "failed")
+			l.Error("could not send notification", "attempts", attempt, "err", err)
+			return
+		}
+		l.Warn("could not send notification, retrying", "attempt", attempt, "retry_in", delay, "err", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// checkExpiry notifies about every certificate in s that has crossed an
+// expiry threshold.
+func (n *notifier) checkExpiry(s *statusTracker, now time.Time) {
+	for _, st := range s.list() {
+		if st.NotAfter == nil {
+			continue
+		}
+		left := st.NotAfter.Sub(now)
+		// The smallest threshold crossed; thresholds are sorted.
+		i := sort.Search(len(n.ExpiryThresholds), func(i int) bool { return left < n.ExpiryThresholds[i] })
+		if i == len(n.ExpiryThresholds) {
+			continue
+		}
+		threshold := n.ExpiryThresholds[i]
+		severity := "warning"
+		if left < n.CriticalWindow {
+			severity = "critical"
+		}
+		message := fmt.Sprintf("Certificate for %s expires %s, in %s", st.Domain, st.NotAfter.UTC().Format(time.RFC3339), formatDays(left))
+		if left <= 0 {
+			message = fmt.Sprintf("Certificate for %s expired at %s", st.Domain, st.NotAfter.UTC().Format(time.RFC3339))
+		}
+		if st.LastError != "" {
+			message += ". The last attempt to renew it failed: " + st.LastError
+		}
+		n.notify(notification{
+			Event:       notifyExpiring,
+			Severity:    severity,
+			Domain:      st.Domain,
+			Message:     message,
+			Time:        now,
+			Issuer:      st.Issuer,
+			NotAfter:    st.NotAfter,
+			Fingerprint: st.Fingerprint,
+			Secret:      strings.Join(st.Secrets, ","),
+			Error:       st.LastError,
+			Threshold:   threshold.String(),
+		})
+	}
+}
+
+// run starts the sinks' periodic work and runs checkExpiry on s until ctx is
+// done.
+func (n *notifier) run(ctx context.Context, s *statusTracker) {
+	for _, sink := range n.Sinks {
+		if p, ok := sink.(periodicSink); ok {
+			go p.run(ctx, s, n.Namespace)
+		}
+	}
+	if len(n.ExpiryThresholds) == 0 {
+		return
+	}
+	for {
+		n.checkExpiry(s, time.Now())
+		t := time.NewTimer(expiryNotifyCheckInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// formatDays formats d as a whole number of days, or hours under two days.
+func formatDays(d time.Duration) string {
+	if d < 48*time.Hour {
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	}
+	return fmt.Sprintf("%d days", int(d.Hours()/24))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink remembers the notifications it was sent.
+type recordingSink struct {
+	mu   sync.Mutex
+	sent []notification
+	done chan struct{}
+}
+
+func (s *recordingSink) name() string               { return "recording" }
+func (s *recordingSink) wants(n *notification) bool { return true }
+
+func (s *recordingSink) send(ctx context.Context, n *notification) error {
+	s.mu.Lock()
+	s.sent = append(s.sent, *n)
+	s.mu.Unlock()
+	s.done <- struct{}{}
+	return nil
+}
+
+// wait returns the events of the next count notifications sent to s,
+// sorted.
+func (s *recordingSink) wait(t *testing.T, count int) []string {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		select {
+		case <-s.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d notifications, want %d", i, count)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []string
+	for _, n := range s.sent {
+		events = append(events, n.Event+" "+n.Threshold)
+	}
+	s.sent = nil
+	// Deliveries run concurrently, so they can arrive in any order.
+	sort.Strings(events)
+	return events
+}
+
+func TestNotifierSuppressesRepeats(t *testing.T) {
+	sink := &recordingSink{done: make(chan struct{}, 10)}
+	n := &notifier{
+		Sinks:            []notificationSink{sink},
+		RepeatInterval:   time.Hour,
+		ExpiryThresholds: []time.Duration{24 * time.Hour, 7 * 24 * time.Hour},
+		MaxAttempts:      1,
+		sent:             make(map[notificationKey]time.Time),
+	}
+	now := time.Now()
+	failure := notification{Event: notifyIssuanceFailed, Domain: "example.com", Time: now}
+	n.notify(failure)
+	failure.Time = now.Add(time.Minute)
+	n.notify(failure)
+	failure.Time = now.Add(2 * time.Hour)
+	n.notify(failure)
+	if got := sink.wait(t, 2); len(got) != 2 {
+		t.Errorf("got %v, want the first failure and one repeat", got)
+	}
+
+	s := newStatusTracker(defaultRenewBefore)
+	b, err := parseCertBundle(newTestBundle(t, "example.com", now.Add(5*24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setCertificate("example.com", b)
+	n.checkExpiry(s, now)
+	n.checkExpiry(s, now.Add(time.Hour))
+	n.checkExpiry(s, now.Add(4*24*time.Hour+time.Hour))
+	got := sink.wait(t, 2)
+	if len(got) != 2 || got[0] != "expiring 168h0m0s" || got[1] != "expiring 24h0m0s" {
+		t.Errorf("got %v, want one notification per threshold", got)
+	}
+
+	// Renewing resolves the failure, so the next one is sent at once.
+	n.notify(notification{Event: notifyRenewed, Domain: "example.com", Time: now})
+	n.notify(notification{Event: notifyIssuanceFailed, Domain: "example.com", Time: now})
+	if got := sink.wait(t, 2); len(got) != 2 {
+		t.Errorf("got %v, want renewed and a new failure", got)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	var signatures []string
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, body)
+		if r.Header.Get(webhookEventHeader) != notifyRenewed {
+			t.Errorf("got event header %q", r.Header.Get(webhookEventHeader))
+		}
+		signatures = append(signatures, r.Header.Get(webhookSignatureHeader))
+		if want := signWebhookBody([]byte("s3cret"), r.Header.Get(webhookTimestampHeader), body); signatures[len(signatures)-1] != want {
+			t.Errorf("got signature %q, want %q", signatures[len(signatures)-1], want)
+		}
+		w.WriteHeader(status)
+		status = http.StatusOK
+	}))
+	defer srv.Close()
+
+	env := map[string]string{"HOOK_URL": srv.URL, "HOOK_KEY": "s3cret"}
+	lookup := func(name string) (string, bool) { v, ok := env[name]; return v, ok }
+	w, err := newWebhookSink(webhookConfig{Name: "ops", URLEnv: "HOOK_URL", HMACKeyEnv: "HOOK_KEY", Format: webhookSlack}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &notifier{Sinks: []notificationSink{w}, MaxAttempts: 3, RetryDelay: time.Millisecond, sent: make(map[notificationKey]time.Time)}
+	note := notification{Event: notifyRenewed, Domain: "example.com", Severity: "info", Message: "Renewed certificate for example.com"}
+	n.deliver(w, note)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 {
+		t.Fatalf("got %d requests, want a retry after the 500", len(bodies))
+	}
+	var slack struct {
+		Text        string
+		Attachments []struct{ Color, Text string }
+	}
+	if err := json.Unmarshal(bodies[1], &slack); err != nil {
+		t.Fatal(err)
+	}
+	if slack.Text != "Renewed certificate for example.com" || len(slack.Attachments) != 1 || slack.Attachments[0].Color != "#2EB67D" {
+		t.Errorf("got Slack body %s", bodies[1])
+	}
+
+	if _, err := newWebhookSink(webhookConfig{Name: "ops", URLEnv: "UNSET"}, lookup); err == nil {
+		t.Error("expected an error for an unset urlEnv")
+	}
+}
+
+func TestWebhookBody(t *testing.T) {
+	notAfter := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	n := &notification{Event: notifyExpiring, Severity: "critical", Domain: "example.com", Message: "soon", NotAfter: &notAfter}
+	w := &webhookSink{Format: webhookTeams}
+	body, err := w.body(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var card map[string]interface{}
+	if err := json.Unmarshal(body, &card); err != nil {
+		t.Fatal(err)
+	}
+	if card["@type"] != "MessageCard" || card["themeColor"] != "E01E5A" || !strings.Contains(string(body), "2030-01-02T03:04:05Z") {
+		t.Errorf("got Teams body %s", body)
+	}
+
+	w.Template, err = parseWebhookTemplate("custom", `{"summary": {{ json .Title }}, "expires": "{{ .NotAfter.Format "2006-01-02" }}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = w.body(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"summary": "Certificate for example.com expires soon", "expires": "2030-01-02"}`; string(body) != want {
+		t.Errorf("got %s, want %s", body, want)
+	}
+}
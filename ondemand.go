@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for routes[].maxCertificates and policies.onDemandOrdersPerHour.
+const (
+	defaultOnDemandMaxCertificates = 100
+	defaultOnDemandOrdersPerHour   = 10
+)
+
+// onDemandSource is the certificate source for an on-demand route. Anyone
+// who can point a name matching the route at us can have a certificate
+// issued for it, so it only orders certificates for up to Max names, and
+// new orders from every route share Orders.
+type onDemandSource struct {
+	Route  routeConfig
+	Max    int
+	Orders *orderLimiter
+	Cache  *kubernetesCache
+
+	manager certificateSource
+
+	mu sync.Mutex
+	// The names the route has certificates for or has ordered them for.
+	// Loaded from the cache on the first handshake.
+	names map[string]bool
+}
+
+func (s *onDemandSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if isChallengeHello(hello) {
+		return s.manager.GetCertificate(hello)
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	ordering, err := s.admit(name, time.Now())
+	if err != nil {
+		logger.Debug("refusing certificate on demand", "domain", name, "err", err)
+		return nil, err
+	}
+	cert, err := s.manager.GetCertificate(hello)
+	if err != nil && ordering {
+		// Don't let names we can't get a certificate for use up the route's
+		// certificates.
+		s.release(name)
+	}
+	return cert, err
+}
+
+func (s *onDemandSource) HTTPHandler(fallback http.Handler) http.Handler {
+	return s.manager.HTTPHandler(fallback)
+}
+
+// admit returns an error if a handshake for name would order a certificate
+// the route's limits don't allow. Otherwise it reports whether name is new,
+// in which case it's counted until release is called.
+func (s *onDemandSource) admit(name string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.names == nil {
+		cached, err := s.Cache.names()
+		if err != nil {
+			return false, fmt.Errorf("reading the cache: %v", err)
+		}
+		s.names = make(map[string]bool)
+		for _, n := range cached {
+			if n = strings.TrimSuffix(n, "+rsa"); s.Route.matches(n) {
+				s.names[n] = true
+			}
+		}
+	}
+	if s.names[name] {
+		return false, nil
+	}
+	if len(s.names) >= s.Max {
+		return false, fmt.Errorf("the route for %s already has %d certificates", strings.Join(s.Route.Hosts, ", "), s.Max)
+	}
+	if !s.Orders.allow(now) {
+		return false, fmt.Errorf("more than %d certificates were ordered on demand in the last hour", s.Orders.PerHour)
+	}
+	s.names[name] = true
+	return true, nil
+}
+
+// release stops counting name, which admit let order a certificate, after
+// the order failed.
+func (s *onDemandSource) release(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.names, name)
+}
+
+// orderLimiter limits how many certificates are ordered per hour.
+type orderLimiter struct {
+	PerHour int
+
+	mu     sync.Mutex
+	orders []time.Time
+}
+
+// allow reports whether an order can be started at now, and counts it if
+// so.
+func (l *orderLimiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := l.orders[:0]
+	for _, t := range l.orders {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	l.orders = recent
+	if len(l.orders) >= l.PerHour {
+		return false
+	}
+	l.orders = append(l.orders, now)
+	return true
+}
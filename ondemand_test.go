@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestOnDemandLimits(t *testing.T) {
+	directory := "https://acme.example.com/directory"
+	k := newKubernetesCache("acme.secret", "", "certs", "", directory, nil, 1, outputOptions{}, false)
+	api := newFakeSecretsAPI(&v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "acme.secret", Namespace: "certs"},
+		Data: map[string][]byte{
+			k.secretKey("a.internal"):     []byte("cert"),
+			k.secretKey("a.internal+rsa"): []byte("cert"),
+			k.secretKey("example.com"):    []byte("cert"),
+			"production__b.internal":      []byte("cert"),
+		},
+	})
+	client, srv := api.serve(t)
+	defer srv.Close()
+	k.Client = client
+
+	s := &onDemandSource{
+		Route:   routeConfig{Hosts: []string{"*.internal"}, OnDemand: true},
+		Max:     3,
+		Orders:  &orderLimiter{PerHour: 1},
+		Cache:   k,
+		manager: namedSource("manager"),
+	}
+	now := time.Now()
+	for _, tt := range []struct {
+		name string
+		at   time.Duration
+		ok   bool
+	}{
+		{"a.internal", 0, true},            // cached, so not an order
+		{"b.internal", 0, true},            // from another directory, so a new order
+		{"c.internal", time.Minute, false}, // over the rate limit
+		{"c.internal", 61 * time.Minute, true},
+		{"d.internal", 3 * time.Hour, false}, // over the cap
+		{"b.internal", 3 * time.Hour, true},
+	} {
+		if _, err := s.admit(tt.name, now.Add(tt.at)); (err == nil) != tt.ok {
+			t.Errorf("%s at +%v: got %v", tt.name, tt.at, err)
+		}
+	}
+
+	if _, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "D.internal."}); err == nil {
+		t.Error("handshake over the cap reached the manager")
+	}
+	if _, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "c.internal"}); err != nil {
+		t.Error(err)
+	}
+
+	// A name whose order fails doesn't keep counting against the cap.
+	s.Max = 4
+	s.Orders = &orderLimiter{PerHour: 10}
+	s.manager = errorSource{errors.New("acme: authorization failed")}
+	if _, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "bogus.internal"}); err == nil {
+		t.Fatal("expected the order to fail")
+	}
+	if _, err := s.admit("d.internal", now.Add(3*time.Hour)); err != nil {
+		t.Errorf("d.internal after a failed order: %v", err)
+	}
+}
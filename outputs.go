@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// outputFormat is an extra encoding of the certificate written to the ingress
+// secret, for consumers that can't read the PEM tls.crt/tls.key pair.
+type outputFormat string
+
+const (
+	outputPKCS12      outputFormat = "pkcs12"
+	outputJKS         outputFormat = "jks"
+	outputCombinedPEM outputFormat = "pem-combined"
+	outputDER         outputFormat = "der"
+)
+
+// Keys written to the ingress secret for each output format.
+const (
+	pkcs12Key      = "keystore.p12"
+	jksKeystoreKey = "keystore.jks"
+	jksTruststore  = "truststore.jks"
+	combinedPEMKey = "tls-combined.pem"
+	derCertKey     = "tls.crt.der"
+	derKeyKey      = "tls.key.der"
+)
+
+// keystoreAlias is the alias/friendly name the key and chain are stored under
+// in the PKCS#12 and JKS keystores.
+const keystoreAlias = "tls"
+
+func (f outputFormat) needsPassword() bool {
+	return f == outputPKCS12 || f == outputJKS
+}
+
+// parseOutputFormats parses a comma separated list of output formats, as
+// passed to the -output-formats flag.
+func parseOutputFormats(s string) ([]outputFormat, error) {
+	var formats []outputFormat
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		f := outputFormat(strings.ToLower(part))
+		switch f {
+		case outputPKCS12, outputJKS, outputCombinedPEM, outputDER:
+			formats = append(formats, f)
+		default:
+			return nil, fmt.Errorf("unknown output format %q (expected one of pkcs12, jks, pem-combined, der)", part)
+		}
+	}
+	return formats, nil
+}
+
+// outputOptions configures the extra encodings written alongside tls.crt and
+// tls.key.
+type outputOptions struct {
+	Formats []outputFormat
+
+	// Name of the secret, and the key within it, holding the password used to
+	// protect PKCS#12 and JKS keystores.
+	PasswordSecret    string
+	PasswordSecretKey string
+
+	// Template renders additional, arbitrarily named keys. May be nil.
+	Template *secretTemplate
+}
+
+// secretType returns the type to give the ingress secret if we have to
+// create it.
+func (o outputOptions) secretType() v1.SecretType {
+	if o.Template != nil && o.Template.Type != "" {
+		return v1.SecretType(o.Template.Type)
+	}
+	return v1.SecretTypeTLS
+}
+
+func (o outputOptions) needsPassword() bool {
+	for _, f := range o.Formats {
+		if f.needsPassword() {
+			return true
+		}
+	}
+	return false
+}
+
+func (o outputOptions) validate() error {
+	if o.needsPassword() && o.PasswordSecret == "" {
+		return fmt.Errorf("output formats %v require a keystore password secret (-keystore-password-secret, or keystorePasswordSecret in the config file)", o.Formats)
+	}
+	return nil
+}
+
+// renderOutputs returns the secret data for every configured output format.
+// password is only used for keystore formats.
+func renderOutputs(b *certBundle, formats []outputFormat, password string, now time.Time) (map[string][]byte, error) {
+	data := make(map[string][]byte)
+	for _, f := range formats {
+		switch f {
+		case outputPKCS12:
+			p12, err := encodePKCS12(b, keystoreAlias, password)
+			if err != nil {
+				return nil, fmt.Errorf("encoding PKCS#12 keystore: %v", err)
+			}
+			data[pkcs12Key] = p12
+		case outputJKS:
+			ks, err := encodeJKSKeystore(b, keystoreAlias, password, now)
+			if err != nil {
+				return nil, fmt.Errorf("encoding JKS keystore: %v", err)
+			}
+			ts, err := encodeJKSTruststore(b, keystoreAlias, password, now)
+			if err != nil {
+				return nil, fmt.Errorf("encoding JKS truststore: %v", err)
+			}
+			data[jksKeystoreKey] = ks
+			data[jksTruststore] = ts
+		case outputCombinedPEM:
+			// HAProxy wants the full chain and the key in one file.
+			buf := new(bytes.Buffer)
+			buf.Write(b.CertsPEM)
+			buf.Write(b.KeyPEM)
+			data[combinedPEMKey] = buf.Bytes()
+		case outputDER:
+			der, err := x509.MarshalPKCS8PrivateKey(b.Key)
+			if err != nil {
+				return nil, err
+			}
+			data[derCertKey] = b.Leaf.Raw
+			data[derKeyKey] = der
+		default:
+			return nil, fmt.Errorf("unknown output format %q", f)
+		}
+	}
+	return data, nil
+}
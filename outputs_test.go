@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestBundle returns autocert-formatted cache data for a leaf certificate
+// for domain, signed by a throwaway CA.
+func newTestBundle(t *testing.T, domain string, notAfter time.Time) []byte {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	pem.Encode(buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return buf.Bytes()
+}
+
+func TestParseOutputFormats(t *testing.T) {
+	formats, err := parseOutputFormats("pkcs12, JKS,,der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(formats) != 3 || formats[1] != outputJKS {
+		t.Errorf("got formats %v", formats)
+	}
+	if _, err := parseOutputFormats("pfx"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestRenderOutputs(t *testing.T) {
+	b, err := parseCertBundle(newTestBundle(t, "example.com", time.Now().Add(24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	formats := []outputFormat{outputPKCS12, outputJKS, outputCombinedPEM, outputDER}
+	data, err := renderOutputs(b, formats, "s3cret", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{pkcs12Key, jksKeystoreKey, jksTruststore, combinedPEMKey, derCertKey, derKeyKey} {
+		if len(data[key]) == 0 {
+			t.Errorf("missing output %q", key)
+		}
+	}
+	if !bytes.Equal(data[derCertKey], b.Leaf.Raw) {
+		t.Error("DER certificate does not match leaf")
+	}
+
+	ks := data[jksKeystoreKey]
+	if magic := binary.BigEndian.Uint32(ks); magic != jksMagic {
+		t.Errorf("bad JKS magic %x", magic)
+	}
+	h := sha1.New()
+	h.Write(jksPassword("s3cret"))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(ks[:len(ks)-sha1.Size])
+	if !bytes.Equal(h.Sum(nil), ks[len(ks)-sha1.Size:]) {
+		t.Error("JKS integrity hash does not verify")
+	}
+}
+
+// pkcs12Decrypt reverses pkcs12Encrypt.
+func pkcs12Decrypt(t *testing.T, algo pkcs12AlgorithmIdentifier, data, pw []byte) []byte {
+	t.Helper()
+	if !algo.Algorithm.Equal(oidPBEWithSHAAnd3KeyTDES) {
+		t.Fatalf("got algorithm %v", algo.Algorithm)
+	}
+	var params pkcs12PBEParams
+	if _, err := asn1.Unmarshal(algo.Parameters.FullBytes, &params); err != nil {
+		t.Fatal(err)
+	}
+	key := pkcs12KDF(pw, params.Salt, 1, params.Iterations, 24)
+	iv := pkcs12KDF(pw, params.Salt, 2, params.Iterations, 8)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		t.Fatalf("encrypted data is %d bytes", len(data))
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	padLen := int(out[len(out)-1])
+	if padLen == 0 || padLen > block.BlockSize() {
+		t.Fatalf("bad padding %d", padLen)
+	}
+	return out[:len(out)-padLen]
+}
+
+func TestPKCS12Structure(t *testing.T) {
+	// The KDF against a known answer, so the checks below aren't circular.
+	sesame, _ := bmpString("sesame")
+	if got, want := pkcs12KDF(sesame, []byte("\xff\xff\xff\xff\xff\xff\xff\xff"), 1, 2048, 24), []byte("\x7c\xd9\xfd\x3e\x2b\x3b\xe7\x69\x1a\x44\xe3\xbe\xf0\xf9\xea\x0f\xb9\xb8\x97\xd4\xe3\x25\xd9\xd1"); !bytes.Equal(got, want) {
+		t.Errorf("pkcs12KDF: got %x, want %x", got, want)
+	}
+
+	b, err := parseCertBundle(newTestBundle(t, "example.com", time.Now().Add(24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := encodePKCS12(b, "example.com", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := bmpString("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pfx pkcs12PFX
+	if rest, err := asn1.Unmarshal(der, &pfx); err != nil || len(rest) > 0 {
+		t.Fatalf("parsing PFX: %v (%d trailing bytes)", err, len(rest))
+	}
+	if pfx.Version != 3 || !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		t.Fatalf("got version %d, content type %v", pfx.Version, pfx.AuthSafe.ContentType)
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		t.Fatal(err)
+	}
+
+	// The MAC verifies with the password, and not without it.
+	macKey := pkcs12KDF(pw, pfx.MacData.MacSalt, 3, pfx.MacData.Iterations, 20)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authSafe)
+	if !bytes.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Error("MAC does not verify with the password")
+	}
+	wrong, _ := bmpString("wrong")
+	mac = hmac.New(sha1.New, pkcs12KDF(wrong, pfx.MacData.MacSalt, 3, pfx.MacData.Iterations, 20))
+	mac.Write(authSafe)
+	if bytes.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Error("MAC verifies with the wrong password")
+	}
+
+	var contents []pkcs12ContentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) != 2 || !contents[0].ContentType.Equal(oidEncryptedDataContentType) || !contents[1].ContentType.Equal(oidDataContentType) {
+		t.Fatalf("got content infos %v", contents)
+	}
+
+	// The certificate chain, encrypted.
+	var ed pkcs12EncryptedData
+	if _, err := asn1.Unmarshal(contents[0].Content.Bytes, &ed); err != nil {
+		t.Fatal(err)
+	}
+	eci := ed.EncryptedContentInfo
+	var certBags []pkcs12SafeBag
+	if _, err := asn1.Unmarshal(pkcs12Decrypt(t, eci.ContentEncryptionAlgorithm, eci.EncryptedContent, pw), &certBags); err != nil {
+		t.Fatal(err)
+	}
+	if len(certBags) != len(b.Chain) {
+		t.Fatalf("got %d certificates, want %d", len(certBags), len(b.Chain))
+	}
+	for i, bag := range certBags {
+		var cb pkcs12CertBag
+		if !bag.ID.Equal(oidCertBag) {
+			t.Errorf("bag %d has type %v", i, bag.ID)
+		}
+		if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cb.Data, b.Chain[i].Raw) {
+			t.Errorf("certificate %d does not match the chain", i)
+		}
+	}
+
+	// The shrouded private key decrypts back to the original.
+	var keyBags []pkcs12SafeBag
+	var keyData []byte
+	if _, err := asn1.Unmarshal(contents[1].Content.Bytes, &keyData); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(keyData, &keyBags); err != nil {
+		t.Fatal(err)
+	}
+	if len(keyBags) != 1 || !keyBags[0].ID.Equal(oidPKCS8ShroudedKeyBag) {
+		t.Fatalf("got key bags %v", keyBags)
+	}
+	if len(keyBags[0].Attributes) != 2 {
+		t.Errorf("got %d key bag attributes, want friendly name and local key ID", len(keyBags[0].Attributes))
+	}
+	var epki pkcs12EncryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(keyBags[0].Value.Bytes, &epki); err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := pkcs12Decrypt(t, epki.AlgorithmIdentifier, epki.EncryptedData, pw)
+	key, err := x509.ParsePKCS8PrivateKey(pkcs8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := x509.MarshalPKCS8PrivateKey(b.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("decrypted key does not match the original")
+	}
+}
+
+func TestSecretTemplate(t *testing.T) {
+	tmpl, err := parseSecretTemplate([]byte(`
+type: Opaque
+data:
+  fullchain.pem: '{{ .FullChainPEM }}'
+  privkey.pem: '{{ .KeyPEM }}'
+  info.json: '{{ json . }}'
+  domains.txt: '{{ join .DNSNames "," }}'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := parseCertBundle(newTestBundle(t, "example.com", time.Now().Add(24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := tmpl.render(b, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data["privkey.pem"], b.KeyPEM) {
+		t.Errorf("privkey.pem: got %q", data["privkey.pem"])
+	}
+	if string(data["domains.txt"]) != "example.com" {
+		t.Errorf("domains.txt: got %q", data["domains.txt"])
+	}
+	if bytes.Contains(data["info.json"], []byte("PRIVATE KEY")) {
+		t.Error("info.json contains the private key")
+	}
+	if n := bytes.Count(data["fullchain.pem"], []byte("BEGIN CERTIFICATE")); n != 2 {
+		t.Errorf("fullchain.pem: got %d certificates, want 2", n)
+	}
+
+	if _, err := parseSecretTemplate([]byte("data:\n  'bad/key': x\n")); err == nil {
+		t.Error("expected error for invalid secret key")
+	}
+}
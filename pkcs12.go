@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// A minimal PKCS#12 (RFC 7292) encoder. Nothing in the vendor directory can
+// write PKCS#12 files, so this implements just enough to produce a keystore
+// Java and OpenSSL will both read: a single private key shrouded with
+// pbeWithSHAAnd3-KeyTripleDES-CBC, the certificate chain encrypted with the
+// same algorithm, and a SHA-1 HMAC over the whole thing.
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidPKCS8ShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509Certificate  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3KeyTDES    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                     = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+const pkcs12Iterations = 2048
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT, see pkcs12Explicit
+}
+
+type pkcs12EncryptedData struct {
+	Version              int
+	EncryptedContentInfo pkcs12EncryptedContentInfo
+}
+
+type pkcs12EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkcs12AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type pkcs12AlgorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pkcs12EncryptedPrivateKeyInfo struct {
+	AlgorithmIdentifier pkcs12AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     // [0] EXPLICIT, see pkcs12Explicit
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue // SET OF values
+}
+
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkcs12AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData `asn1:"optional"`
+}
+
+// encodePKCS12 returns a password protected PKCS#12 keystore containing the
+// bundle's private key and certificate chain, under the given friendly name.
+func encodePKCS12(b *certBundle, alias, password string) ([]byte, error) {
+	pw, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+	localKeyID := sha1.Sum(b.Leaf.Raw)
+	attrs, err := pkcs12BagAttributes(alias, localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// certificates
+	var certBags []pkcs12SafeBag
+	for i, cert := range b.Chain {
+		bag, err := pkcs12MarshalCertBag(cert)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			bag.Attributes = attrs
+		}
+		certBags = append(certBags, bag)
+	}
+	certContents, err := asn1.Marshal(certBags)
+	if err != nil {
+		return nil, err
+	}
+	certInfo, err := pkcs12EncryptedContent(certContents, pw)
+	if err != nil {
+		return nil, err
+	}
+
+	// private key
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(b.Key)
+	if err != nil {
+		return nil, err
+	}
+	algo, encrypted, err := pkcs12Encrypt(pkcs8, pw)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := asn1.Marshal(pkcs12EncryptedPrivateKeyInfo{
+		AlgorithmIdentifier: algo,
+		EncryptedData:       encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keyContents, err := asn1.Marshal([]pkcs12SafeBag{{
+		ID:         oidPKCS8ShroudedKeyBag,
+		Value:      pkcs12Explicit(keyInfo),
+		Attributes: attrs,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	keyContentInfo, err := pkcs12DataContent(keyContents)
+	if err != nil {
+		return nil, err
+	}
+
+	authSafe, err := asn1.Marshal([]pkcs12ContentInfo{certInfo, keyContentInfo})
+	if err != nil {
+		return nil, err
+	}
+	pfx := pkcs12PFX{Version: 3}
+	if pfx.AuthSafe, err = pkcs12DataContent(authSafe); err != nil {
+		return nil, err
+	}
+
+	// MAC over the authenticated safe
+	macSalt := make([]byte, 8)
+	if _, err := rand.Read(macSalt); err != nil {
+		return nil, err
+	}
+	macKey := pkcs12KDF(pw, macSalt, 3, pkcs12Iterations, 20)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authSafe)
+	pfx.MacData = pkcs12MacData{
+		Mac: pkcs12DigestInfo{
+			Algorithm: pkcs12AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+			Digest:    mac.Sum(nil),
+		},
+		MacSalt:    macSalt,
+		Iterations: pkcs12Iterations,
+	}
+	return asn1.Marshal(pfx)
+}
+
+func pkcs12BagAttributes(alias string, localKeyID []byte) ([]pkcs12Attribute, error) {
+	name, err := bmpString(alias)
+	if err != nil {
+		return nil, err
+	}
+	// bmpString is NUL terminated for the KDF, but the friendly name is not.
+	nameBytes, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Class: asn1.ClassUniversal, Bytes: name[:len(name)-2]})
+	if err != nil {
+		return nil, err
+	}
+	idBytes, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: asn1.RawValue{Tag: asn1.TagSet, Class: asn1.ClassUniversal, IsCompound: true, Bytes: nameBytes}},
+		{ID: oidLocalKeyID, Value: asn1.RawValue{Tag: asn1.TagSet, Class: asn1.ClassUniversal, IsCompound: true, Bytes: idBytes}},
+	}, nil
+}
+
+func pkcs12MarshalCertBag(cert *x509.Certificate) (pkcs12SafeBag, error) {
+	data, err := asn1.Marshal(pkcs12CertBag{ID: oidCertTypeX509Certificate, Data: cert.Raw})
+	if err != nil {
+		return pkcs12SafeBag{}, err
+	}
+	return pkcs12SafeBag{ID: oidCertBag, Value: pkcs12Explicit(data)}, nil
+}
+
+// pkcs12Explicit wraps DER encoded data in an explicit [0] tag. encoding/asn1
+// ignores struct tags on RawValue fields, so we have to build it ourselves.
+func pkcs12Explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func pkcs12DataContent(data []byte) (pkcs12ContentInfo, error) {
+	octets, err := asn1.Marshal(data)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	return pkcs12ContentInfo{
+		ContentType: oidDataContentType,
+		Content:     pkcs12Explicit(octets),
+	}, nil
+}
+
+func pkcs12EncryptedContent(data, pw []byte) (pkcs12ContentInfo, error) {
+	algo, encrypted, err := pkcs12Encrypt(data, pw)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	ed, err := asn1.Marshal(pkcs12EncryptedData{
+		EncryptedContentInfo: pkcs12EncryptedContentInfo{
+			ContentType:                oidDataContentType,
+			ContentEncryptionAlgorithm: algo,
+			EncryptedContent:           encrypted,
+		},
+	})
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	return pkcs12ContentInfo{
+		ContentType: oidEncryptedDataContentType,
+		Content:     pkcs12Explicit(ed),
+	}, nil
+}
+
+// pkcs12Encrypt encrypts data with pbeWithSHAAnd3-KeyTripleDES-CBC and a
+// random salt.
+func pkcs12Encrypt(data, pw []byte) (pkcs12AlgorithmIdentifier, []byte, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return pkcs12AlgorithmIdentifier{}, nil, err
+	}
+	params, err := asn1.Marshal(pkcs12PBEParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return pkcs12AlgorithmIdentifier{}, nil, err
+	}
+	key := pkcs12KDF(pw, salt, 1, pkcs12Iterations, 24)
+	iv := pkcs12KDF(pw, salt, 2, pkcs12Iterations, 8)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return pkcs12AlgorithmIdentifier{}, nil, err
+	}
+	padLen := block.BlockSize() - len(data)%block.BlockSize()
+	padded := make([]byte, len(data)+padLen)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = byte(padLen)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	algo := pkcs12AlgorithmIdentifier{
+		Algorithm:  oidPBEWithSHAAnd3KeyTDES,
+		Parameters: asn1.RawValue{FullBytes: params},
+	}
+	return algo, padded, nil
+}
+
+// pkcs12KDF implements the key derivation function in RFC 7292, appendix B.2,
+// using SHA-1.
+func pkcs12KDF(password, salt []byte, id byte, iterations, size int) []byte {
+	const u, v = 20, 64
+
+	fill := func(in []byte) []byte {
+		if len(in) == 0 {
+			return nil
+		}
+		n := v * ((len(in) + v - 1) / v)
+		out := make([]byte, n)
+		for i := range out {
+			out[i] = in[i%len(in)]
+		}
+		return out
+	}
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = id
+	}
+	I := append(fill(salt), fill(password)...)
+
+	one := big.NewInt(1)
+	var out []byte
+	for len(out) < size {
+		h := sha1.New()
+		h.Write(D)
+		h.Write(I)
+		A := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(A)
+			A = sum[:]
+		}
+		out = append(out, A...)
+		if len(out) >= size {
+			break
+		}
+		B := fill(A)[:v]
+		Bn := new(big.Int).SetBytes(B)
+		for j := 0; j < len(I); j += v {
+			// I_j = (I_j + B + 1) mod 2^(8v)
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			Ij.Add(Ij, Bn)
+			Ij.Add(Ij, one)
+			b := Ij.Bytes()
+			if len(b) > v {
+				b = b[len(b)-v:]
+			}
+			chunk := I[j : j+v]
+			for k := range chunk {
+				chunk[k] = 0
+			}
+			copy(chunk[v-len(b):], b)
+		}
+	}
+	return out[:size]
+}
+
+// bmpString returns s encoded as a NUL terminated, big endian UCS-2 string,
+// as PKCS#12 expects passwords to be formatted.
+func bmpString(s string) ([]byte, error) {
+	out := make([]byte, 0, 2*len(s)+2)
+	for _, r := range s {
+		if r > 0xffff {
+			return nil, errors.New("pkcs12: string contains characters that cannot be encoded in UCS-2")
+		}
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return append(out, 0, 0), nil
+}
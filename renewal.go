@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default renewal windows: autocert's for ACME issuers, and a third of the
+// lifetime for certificates we sign directly.
+var (
+	defaultACMERenewBefore   = renewWindow{Duration: defaultRenewBefore}
+	defaultSignedRenewBefore = renewWindow{Fraction: 1.0 / 3}
+)
+
+// assumedACMELifetime is the lifetime renewal windows given as fractions are
+// applied to for ACME certificates, until one has been issued: Let's
+// Encrypt's.
+const assumedACMELifetime = 90 * 24 * time.Hour
+
+// maxRenewFraction is the most of a certificate's lifetime it can be renewed
+// before expiry, jitter and stagger included, so a new certificate is never
+// due for renewal as soon as it's issued.
+const maxRenewFraction = 0.9
+
+// renewWindow is how long before expiry a certificate is renewed: either a
+// duration, or a fraction of the certificate's lifetime. In config files it's
+// a duration string like "720h", a percentage like "33%", or a number like
+// 0.33.
+type renewWindow struct {
+	Duration time.Duration
+	Fraction float64
+}
+
+// parseRenewWindow parses a duration or a percentage.
+func parseRenewWindow(s string) (renewWindow, error) {
+	if s == "" {
+		return renewWindow{}, nil
+	}
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			return renewWindow{}, fmt.Errorf("invalid percentage %q", s)
+		}
+		return renewWindow{Fraction: pct / 100}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return renewWindow{}, fmt.Errorf("%q is neither a duration like \"720h\" nor a percentage like \"33%%\"", s)
+	}
+	return renewWindow{Duration: d}, nil
+}
+
+func (w *renewWindow) UnmarshalJSON(data []byte) error {
+	var f float64
+	if err := json.Unmarshal(data, &f); err == nil {
+		*w = renewWindow{Fraction: f}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("renewal windows must be durations like \"720h\" or fractions like \"33%%\", got %s", data)
+	}
+	v, err := parseRenewWindow(s)
+	if err != nil {
+		return err
+	}
+	*w = v
+	return nil
+}
+
+func (w renewWindow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.String())
+}
+
+func (w renewWindow) String() string {
+	if w.Fraction != 0 {
+		return strconv.FormatFloat(w.Fraction*100, 'f', -1, 64) + "%"
+	}
+	return w.Duration.String()
+}
+
+func (w renewWindow) isZero() bool {
+	return w == renewWindow{}
+}
+
+// validate returns an error if w can't be used.
+func (w renewWindow) validate() error {
+	switch {
+	case w.Fraction != 0 && (w.Fraction < 0 || w.Fraction > maxRenewFraction):
+		return fmt.Errorf("must be between 0%% and %v%% of the lifetime", maxRenewFraction*100)
+	case w.Fraction == 0 && w.Duration <= time.Hour:
+		// autocert ignores RenewBefore of an hour or less.
+		return fmt.Errorf("must be more than 1h")
+	}
+	return nil
+}
+
+// before returns how long before expiry a certificate valid for lifetime is
+// renewed.
+func (w renewWindow) before(lifetime time.Duration) time.Duration {
+	if w.Fraction != 0 {
+		return time.Duration(w.Fraction * float64(lifetime))
+	}
+	return w.Duration
+}
+
+// renewalSchedule is when one certificate is renewed: Window before expiry,
+// and a little earlier by its share of jitter and stagger, so certificates
+// issued together aren't renewed together.
+type renewalSchedule struct {
+	Window  renewWindow
+	Jitter  time.Duration
+	Stagger time.Duration
+}
+
+// lead returns how long before expiry a certificate valid for lifetime is
+// renewed.
+func (s renewalSchedule) lead(lifetime time.Duration) time.Duration {
+	lead := s.Window.before(lifetime) + s.Jitter + s.Stagger
+	if max := time.Duration(maxRenewFraction * float64(lifetime)); lead > max {
+		lead = max
+	}
+	return lead
+}
+
+// renewAt returns when leaf is renewed.
+func (s renewalSchedule) renewAt(leaf *x509.Certificate) time.Time {
+	return leaf.NotAfter.Add(-s.lead(leaf.NotAfter.Sub(leaf.NotBefore)))
+}
+
+func (s renewalSchedule) String() string {
+	desc := s.Window.String() + " before expiry"
+	if s.Window.Fraction != 0 {
+		desc = s.Window.String() + " of the lifetime before expiry"
+	}
+	if s.Jitter > 0 {
+		desc += fmt.Sprintf(", %v jitter", s.Jitter.Round(time.Second))
+	}
+	if s.Stagger > 0 {
+		desc += fmt.Sprintf(", %v stagger", s.Stagger.Round(time.Second))
+	}
+	return desc
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// randomJitter returns a random duration less than max.
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// staggerOffset returns domain's offset within c's renewStagger. It's taken
+// from a hash of the domain, so certificates are spread over the stagger
+// and each keeps its offset when others are added or removed, which would
+// otherwise rebuild their managers.
+func (c *generatorConfig) staggerOffset(domain string) time.Duration {
+	stagger := c.Policies.RenewStagger.Duration
+	if stagger <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(domain))
+	return time.Duration(h.Sum64() % uint64(stagger))
+}
+
+// renewWindow returns the renewal window for cc.
+func (c *generatorConfig) renewWindow(cc certificateConfig) renewWindow {
+	switch {
+	case !cc.RenewBefore.isZero():
+		return cc.RenewBefore
+	case !c.Policies.RenewBefore.isZero():
+		return c.Policies.RenewBefore
+	case c.issuer(cc).Type == issuerACME:
+		return defaultACMERenewBefore
+	default:
+		return defaultSignedRenewBefore
+	}
+}
+
+// newRenewalSchedule returns the schedule for cc, with its jitter chosen at
+// random.
+func (c *generatorConfig) newRenewalSchedule(cc certificateConfig) renewalSchedule {
+	return renewalSchedule{
+		Window:  c.renewWindow(cc),
+		Jitter:  randomJitter(c.Policies.RenewJitter.Duration),
+		Stagger: c.staggerOffset(cc.Domain),
+	}
+}
+
+// acmeRenewBefore returns the autocert.Manager RenewBefore for a certificate
+// renewed on s. Fractions are of the lifetime of the cached certificate, if
+// there's one.
+func acmeRenewBefore(s renewalSchedule, cache *kubernetesCache) time.Duration {
+	lifetime := assumedACMELifetime
+	if s.Window.Fraction != 0 && cache != nil {
+		if b, err := cache.cached(); err == nil && b != nil {
+			lifetime = b.Leaf.NotAfter.Sub(b.Leaf.NotBefore)
+		}
+	}
+	lead := s.lead(lifetime)
+	if lead <= time.Hour {
+		lead = time.Hour + time.Minute
+	}
+	return lead
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseRenewWindow(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want renewWindow
+	}{
+		{"720h", renewWindow{Duration: 720 * time.Hour}},
+		{"33%", renewWindow{Fraction: 0.33}},
+		{"", renewWindow{}},
+	} {
+		got, err := parseRenewWindow(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("parseRenewWindow(%q) = %v, %v; want %v", tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{"30 days", "a%"} {
+		if _, err := parseRenewWindow(in); err == nil {
+			t.Errorf("parseRenewWindow(%q): expected an error", in)
+		}
+	}
+
+	var v struct{ A, B, C renewWindow }
+	if err := json.Unmarshal([]byte(`{"A": "48h", "B": "25%", "C": 0.5}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.A.Duration != 48*time.Hour || v.B.Fraction != 0.25 || v.C.Fraction != 0.5 {
+		t.Errorf("got %+v", v)
+	}
+	data, _ := json.Marshal(v)
+	if string(data) != `{"A":"48h0m0s","B":"25%","C":"50%"}` {
+		t.Errorf("got %s", data)
+	}
+}
+
+func TestRenewalSchedule(t *testing.T) {
+	day := 24 * time.Hour
+	now := time.Now()
+	leaf := &x509.Certificate{NotBefore: now, NotAfter: now.Add(90 * day)}
+
+	s := renewalSchedule{Window: renewWindow{Duration: 30 * day}, Jitter: time.Hour, Stagger: 2 * time.Hour}
+	if got, want := s.renewAt(leaf), leaf.NotAfter.Add(-30*day-3*time.Hour); !got.Equal(want) {
+		t.Errorf("got renewal at %v, want %v", got, want)
+	}
+	s = renewalSchedule{Window: renewWindow{Fraction: 1.0 / 3}}
+	if got, want := s.renewAt(leaf), leaf.NotAfter.Add(-30*day); !got.Equal(want) {
+		t.Errorf("got renewal at %v, want %v", got, want)
+	}
+	// Never due as soon as it's issued, however big the window.
+	s = renewalSchedule{Window: renewWindow{Duration: 89 * day}, Stagger: 5 * day}
+	if got, want := s.lead(90*day), 81*day; got != want {
+		t.Errorf("got lead %v, want %v", got, want)
+	}
+	if got := acmeRenewBefore(renewalSchedule{Window: renewWindow{Fraction: 0.001}}, nil); got <= time.Hour {
+		t.Errorf("got RenewBefore %v, which autocert would ignore", got)
+	}
+}
+
+func TestRenewalPolicy(t *testing.T) {
+	c, err := parseConfig([]byte(`
+issuers:
+  letsencrypt: {}
+  internal: {type: ca, caSecret: internal-ca}
+certificates:
+- {domain: d.example.com, issuer: letsencrypt, ingressSecret: d}
+- {domain: a.example.com, issuer: letsencrypt, ingressSecret: a, renewBefore: 10%}
+- {domain: c.example.com, issuer: internal, ingressSecret: c}
+- {domain: b.example.com, issuer: internal, ingressSecret: b}
+policies:
+  renewStagger: 4h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []renewWindow{defaultACMERenewBefore, {Fraction: 0.1}, defaultSignedRenewBefore, defaultSignedRenewBefore} {
+		if got := c.renewWindow(c.Certificates[i]); got != want {
+			t.Errorf("%s: got window %v, want %v", c.Certificates[i].Domain, got, want)
+		}
+	}
+	// Offsets are spread over the stagger, and don't move when the other
+	// certificates change.
+	offsets := make(map[time.Duration]bool)
+	fewer := *c
+	fewer.Certificates = c.Certificates[:1]
+	for _, cc := range c.Certificates {
+		got := c.staggerOffset(cc.Domain)
+		if got < 0 || got >= 4*time.Hour {
+			t.Errorf("%s: got stagger %v, want less than 4h", cc.Domain, got)
+		}
+		if again := fewer.staggerOffset(cc.Domain); again != got {
+			t.Errorf("%s: stagger changed from %v to %v when certificates were removed", cc.Domain, got, again)
+		}
+		offsets[got] = true
+	}
+	if len(offsets) != len(c.Certificates) {
+		t.Errorf("got the same stagger for different certificates: %v", offsets)
+	}
+}
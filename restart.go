@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// restartAnnotation can be set on a Deployment, StatefulSet or DaemonSet
+	// to control whether it is restarted when a certificate is renewed. Set it
+	// to a comma separated list of secret names to opt in to restarts for
+	// those secrets even if the workload doesn't mount them directly, or to
+	// "false" to opt out.
+	restartAnnotation = "k8s-cert-generator/restart-on-renewal"
+
+	// fingerprintAnnotation is set on the pod template of restarted workloads.
+	// Changing it is what triggers the rolling restart.
+	fingerprintAnnotation = "k8s-cert-generator/cert-fingerprint"
+)
+
+// workload is the subset of a Deployment, StatefulSet or DaemonSet we need
+// to decide whether to restart it.
+type workload struct {
+	Kind        string
+	Name        string
+	Annotations map[string]string
+	Template    v1.PodTemplateSpec
+
+	patch func(data []byte) error
+}
+
+// wantsRestart reports whether w should be restarted when secretName is
+// updated.
+func (w *workload) wantsRestart(secretName string) bool {
+	if val, ok := w.Annotations[restartAnnotation]; ok {
+		if val == "false" {
+			return false
+		}
+		for _, name := range strings.Split(val, ",") {
+			if strings.TrimSpace(name) == secretName {
+				return true
+			}
+		}
+	}
+	return podSpecReferencesSecret(&w.Template.Spec, secretName)
+}
+
+// podSpecReferencesSecret reports whether any volume or container
+// environment in spec reads from the named secret.
+func podSpecReferencesSecret(spec *v1.PodSpec, secretName string) bool {
+	for _, vol := range spec.Volumes {
+		if vol.Secret != nil && vol.Secret.SecretName == secretName {
+			return true
+		}
+		if vol.Projected != nil {
+			for _, src := range vol.Projected.Sources {
+				if src.Secret != nil && src.Secret.Name == secretName {
+					return true
+				}
+			}
+		}
+	}
+	containers := append(append([]v1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, env := range c.EnvFrom {
+			if env.SecretRef != nil && env.SecretRef.Name == secretName {
+				return true
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == secretName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restartPatch returns a strategic merge patch that sets the fingerprint
+// annotation on a pod template.
+func restartPatch(fingerprint string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						fingerprintAnnotation: fingerprint,
+					},
+				},
+			},
+		},
+	})
+}
+
+// listWorkloads returns every Deployment, StatefulSet and DaemonSet in the
+// namespace.
+func listWorkloads(client kubernetes.Interface, namespace string) ([]*workload, error) {
+	var workloads []*workload
+	deployments, err := client.AppsV1beta1().Deployments(namespace).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing deployments: %v", err)
+	}
+	for i := range deployments.Items {
+		d := &deployments.Items[i]
+		workloads = append(workloads, &workload{
+			Kind: "Deployment", Name: d.Name, Annotations: d.Annotations, Template: d.Spec.Template,
+			patch: func(data []byte) error {
+				_, err := client.AppsV1beta1().Deployments(namespace).Patch(d.Name, types.StrategicMergePatchType, data)
+				return err
+			},
+		})
+	}
+	statefulSets, err := client.AppsV1beta1().StatefulSets(namespace).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing statefulsets: %v", err)
+	}
+	for i := range statefulSets.Items {
+		s := &statefulSets.Items[i]
+		workloads = append(workloads, &workload{
+			Kind: "StatefulSet", Name: s.Name, Annotations: s.Annotations, Template: s.Spec.Template,
+			patch: func(data []byte) error {
+				_, err := client.AppsV1beta1().StatefulSets(namespace).Patch(s.Name, types.StrategicMergePatchType, data)
+				return err
+			},
+		})
+	}
+	daemonSets, err := client.ExtensionsV1beta1().DaemonSets(namespace).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing daemonsets: %v", err)
+	}
+	for i := range daemonSets.Items {
+		ds := &daemonSets.Items[i]
+		workloads = append(workloads, &workload{
+			Kind: "DaemonSet", Name: ds.Name, Annotations: ds.Annotations, Template: ds.Spec.Template,
+			patch: func(data []byte) error {
+				_, err := client.ExtensionsV1beta1().DaemonSets(namespace).Patch(ds.Name, types.StrategicMergePatchType, data)
+				return err
+			},
+		})
+	}
+	return workloads, nil
+}
+
+// restartWorkloads triggers a rolling restart of every workload in the
+// namespace that consumes secretName, by setting the new certificate's
+// fingerprint on its pod template. Workloads already running with this
+// fingerprint are left alone.
+func restartWorkloads(client kubernetes.Interface, namespace, secretName, fingerprint string) error {
+	workloads, err := listWorkloads(client, namespace)
+	if err != nil {
+		return err
+	}
+	patch, err := restartPatch(fingerprint)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, w := range workloads {
+		if !w.wantsRestart(secretName) || w.Template.Annotations[fingerprintAnnotation] == fingerprint {
+			continue
+		}
+		if err := w.patch(patch); err != nil {
+			logger.Error("restarting workload", "kind", w.Kind, "name", w.Name, "err", err)
+			failed = append(failed, w.Kind+"/"+w.Name)
+			continue
+		}
+		logger.Info("started rolling restart for new certificate", "kind", w.Kind, "name", w.Name, "secret", secretName)
+		events.Eventf(v1.EventTypeNormal, reasonRestarted, "Started rolling restart of %s/%s for new certificate in %s", w.Kind, w.Name, secretName)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not restart %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
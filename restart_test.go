@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestWorkloadWantsRestart(t *testing.T) {
+	mounted := v1.PodTemplateSpec{Spec: v1.PodSpec{
+		Volumes: []v1.Volume{{
+			Name:         "tls",
+			VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "acme.ingress.secret"}},
+		}},
+	}}
+	env := v1.PodTemplateSpec{Spec: v1.PodSpec{
+		Containers: []v1.Container{{
+			EnvFrom: []v1.EnvFromSource{{
+				SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "acme.ingress.secret"}},
+			}},
+		}},
+	}}
+	tests := []struct {
+		name string
+		w    workload
+		want bool
+	}{
+		{"volume", workload{Template: mounted}, true},
+		{"envFrom", workload{Template: env}, true},
+		{"unrelated", workload{}, false},
+		{"opt-in", workload{Annotations: map[string]string{restartAnnotation: "other, acme.ingress.secret"}}, true},
+		{"opt-out", workload{Annotations: map[string]string{restartAnnotation: "false"}, Template: mounted}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.w.wantsRestart("acme.ingress.secret"); got != tt.want {
+			t.Errorf("%s: wantsRestart = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// crlReasons maps the names accepted by revoke -reason to RFC 5280 reason
+// codes.
+var crlReasons = map[string]acme.CRLReasonCode{
+	"unspecified":          acme.CRLReasonUnspecified,
+	"keyCompromise":        acme.CRLReasonKeyCompromise,
+	"affiliationChanged":   acme.CRLReasonAffiliationChanged,
+	"superseded":           acme.CRLReasonSuperseded,
+	"cessationOfOperation": acme.CRLReasonCessationOfOperation,
+	"privilegeWithdrawn":   acme.CRLReasonPrivilegeWithdrawn,
+}
+
+// parseCRLReason returns the reason code named s, ignoring case.
+func parseCRLReason(s string) (acme.CRLReasonCode, error) {
+	for name, code := range crlReasons {
+		if strings.EqualFold(name, s) {
+			return code, nil
+		}
+	}
+	var names []string
+	for name := range crlReasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("unknown revocation reason %q (have %s)", s, strings.Join(names, ", "))
+}
+
+// revokeCertificate revokes the certificate cached under name in k. The
+// request is signed by the account key if useAccountKey is set, or else by
+// the certificate's own key, which works even if the account is lost.
+func revokeCertificate(ctx context.Context, k *kubernetesCache, name string, reason acme.CRLReasonCode, useAccountKey bool) (*certBundle, error) {
+	data, err := k.Get(ctx, name)
+	if err == autocert.ErrCacheMiss {
+		return nil, fmt.Errorf("the cache has no certificate for %s from %s", name, k.directoryURL)
+	} else if err != nil {
+		return nil, err
+	}
+	b, err := parseCertBundle(data)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{DirectoryURL: k.directoryURL, HTTPClient: newACMEHTTPClient()}
+	var key crypto.Signer
+	if useAccountKey {
+		if client.Key, err = cachedAccountKey(ctx, k); err != nil {
+			return nil, err
+		}
+	} else {
+		key = b.Key
+	}
+	if err := client.RevokeCert(ctx, key, b.Leaf.Raw, reason); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// replaceCertificate removes the certificate cached under name in k and
+// orders a new one, with a new key. k publishes ECDSA certificates to the
+// Ingress secret. The http-01 challenge token is written to the cache, so the
+// generator running in the cluster answers the challenge.
+func replaceCertificate(ctx context.Context, k *kubernetesCache, name, email string) (*certBundle, error) {
+	if err := k.Delete(ctx, name); err != nil {
+		return nil, err
+	}
+	m := newACMEManager(&issuerConfig{DirectoryURL: k.directoryURL, Email: email}, autocert.HostWhitelist(k.domain), k, newACMEHTTPClient(), 0)
+	m.HTTPHandler(nil)
+	hello := ecdsaHello(k.domain)
+	if name != k.domain {
+		// Ask for RSA the way a client without ECDSA support would.
+		hello = &tls.ClientHelloInfo{ServerName: k.domain}
+	}
+	if _, err := m.GetCertificate(hello); err != nil {
+		return nil, err
+	}
+	data, err := k.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertBundle(data)
+}
+
+// checkPlainIngressSecret returns an error if k's Ingress secret holds keys
+// besides tls.crt and tls.key. Without the certificate's configuration, a
+// replacement would only update those two, leaving the revoked certificate
+// in keystores and templated keys.
+func checkPlainIngressSecret(k *kubernetesCache) error {
+	secret, err := k.Client.CoreV1().Secrets(k.Namespace).Get(k.IngressSecretName, meta_v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var extra []string
+	for key := range secret.Data {
+		if key != "tls.crt" && key != "tls.key" {
+			extra = append(extra, key)
+		}
+	}
+	if len(extra) > 0 {
+		sort.Strings(extra)
+		return fmt.Errorf("%s/%s also holds %s; pass -config so the replacement is published in every format", k.Namespace, k.IngressSecretName, strings.Join(extra, ", "))
+	}
+	return nil
+}
+
+func runRevoke(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	fs.SetOutput(out)
+	kubeconfigPath := fs.String("kubeconfig", defaultKubeconfigPath(), "Path to the kubeconfig file")
+	ns := fs.String("namespace", "", "Namespace of the cache secret. Defaults to the kubeconfig context's namespace")
+	domainName := fs.String("domain", "", "Domain of the certificate to revoke")
+	cacheSecret := fs.String("secret", "acme.secret", "Name of the cache secret")
+	accountSecret := fs.String("account-secret", "", "Name of the secret holding the account key, if it isn't the cache secret")
+	ingressSecret := fs.String("ingress-secret", "", "Name of the Ingress secret to publish the replacement to")
+	useStaging := fs.Bool("staging", false, "Revoke a certificate from the letsencrypt staging server")
+	directoryURL := fs.String("directory", "", "ACME directory the certificate came from, if not Let's Encrypt")
+	rsaCert := fs.Bool("rsa", false, "Revoke the RSA certificate kept for clients without ECDSA support")
+	reasonName := fs.String("reason", "unspecified", "Revocation reason, e.g. keyCompromise or superseded")
+	signWith := fs.String("sign-with", "account", "Key to sign the revocation with: account, or certificate if the account key is lost")
+	replace := fs.Bool("replace", false, "Order a replacement with a new key and publish it to -ingress-secret")
+	email := fs.String("email", "", "Contact email for the ACME account, if it has to be registered")
+	configPath := fs.String("config", "", "Generator config file to take the certificate's secrets, issuer, output formats and workload restarts from")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *domainName == "" {
+		return fmt.Errorf("-domain is required")
+	}
+	var outputs outputOptions
+	var restart bool
+	if *configPath != "" {
+		var set []string
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "namespace", "secret", "account-secret", "ingress-secret":
+				set = append(set, "-"+f.Name)
+			}
+		})
+		if len(set) > 0 {
+			return fmt.Errorf("%s can't be used with -config", strings.Join(set, " "))
+		}
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		var cc *certificateConfig
+		for i := range cfg.Certificates {
+			if cfg.Certificates[i].Domain == strings.ToLower(strings.TrimSuffix(*domainName, ".")) {
+				cc = &cfg.Certificates[i]
+			}
+		}
+		if cc == nil {
+			return fmt.Errorf("%s has no certificate for %s", *configPath, *domainName)
+		}
+		issuer := cfg.issuer(*cc)
+		if !issuer.isACME() {
+			return fmt.Errorf("the certificate for %s doesn't come from an ACME issuer", *domainName)
+		}
+		if outputs, err = cc.outputOptions(); err != nil {
+			return fmt.Errorf("%s: %v", cc.Domain, err)
+		}
+		restart = cc.RestartWorkloads
+		*domainName = cc.Domain
+		*ns, *cacheSecret, *accountSecret, *ingressSecret = cfg.Namespace, cfg.CacheSecret, cfg.AccountSecret, cc.IngressSecret
+		if *directoryURL == "" && !*useStaging {
+			*directoryURL = issuer.directoryURL()
+		}
+		if *email == "" {
+			*email = issuer.Email
+		}
+	}
+	reason, err := parseCRLReason(*reasonName)
+	if err != nil {
+		return err
+	}
+	if *signWith != "account" && *signWith != "certificate" {
+		return fmt.Errorf("-sign-with must be account or certificate, not %q", *signWith)
+	}
+	if *replace && *ingressSecret == "" {
+		return fmt.Errorf("-ingress-secret is required with -replace")
+	}
+
+	client, contextNamespace, err := commandClient(*kubeconfigPath)
+	if err != nil {
+		return err
+	}
+	if *ns == "" {
+		*ns = contextNamespace
+	}
+	*ns = defaultNamespace(*ns)
+
+	if *directoryURL == "" {
+		*directoryURL = acme.LetsEncryptURL
+		if *useStaging {
+			*directoryURL = letsEncryptStagingURL
+		}
+	}
+	name := *domainName
+	if *rsaCert {
+		name += "+rsa"
+	}
+	k := newKubernetesCache(*cacheSecret, *ingressSecret, *ns, *domainName, *directoryURL, client, 1, outputs, restart)
+	k.AccountSecretName = *accountSecret
+	if *replace && *configPath == "" {
+		if err := checkPlainIngressSecret(k); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	b, err := revokeCertificate(ctx, k, name, reason, *signWith == "account")
+	if err != nil {
+		return fmt.Errorf("could not revoke the certificate for %s: %v", *domainName, err)
+	}
+	fmt.Fprintf(out, "Revoked certificate for %s\n  serial:      %x\n  fingerprint: %s\n  reason:      %s\n",
+		*domainName, b.Leaf.SerialNumber, b.Fingerprint(), *reasonName)
+	if !*replace {
+		fmt.Fprintf(out, "The revoked certificate is still cached and published. Delete %s from\n%s/%s to get a new one.\n", k.secretKey(name), *ns, *cacheSecret)
+		return nil
+	}
+
+	nb, err := replaceCertificate(ctx, k, name, *email)
+	if err != nil {
+		return fmt.Errorf("could not issue a replacement for %s: %v", *domainName, err)
+	}
+	fmt.Fprintf(out, "Issued a replacement with a new key and published it to %s/%s\n  expires:     %s\n  fingerprint: %s\n",
+		*ns, *ingressSecret, nb.Leaf.NotAfter.UTC().Format(time.RFC3339), nb.Fingerprint())
+	if restart {
+		fmt.Fprintf(out, "Restarted the workloads that use %s/%s.\n", *ns, *ingressSecret)
+	}
+	fmt.Fprintf(out, "Running generators keep serving the revoked certificate on their TLS port until they restart.\n")
+	return nil
+}
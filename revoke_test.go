@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestParseCRLReason(t *testing.T) {
+	for s, want := range map[string]acme.CRLReasonCode{
+		"keyCompromise": acme.CRLReasonKeyCompromise,
+		"KEYCOMPROMISE": acme.CRLReasonKeyCompromise,
+		"superseded":    acme.CRLReasonSuperseded,
+		"unspecified":   acme.CRLReasonUnspecified,
+	} {
+		if got, err := parseCRLReason(s); err != nil || got != want {
+			t.Errorf("%s: got %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := parseCRLReason("caCompromise"); err == nil {
+		t.Error("expected an error for a reason subscribers can't use")
+	}
+}
+
+// writeTestKubeconfig writes a kubeconfig for the API server at url, with
+// the namespace certs, and returns its path.
+func writeTestKubeconfig(t *testing.T, dir, url string) string {
+	t.Helper()
+	path := filepath.Join(dir, "config")
+	kubeconfig := fmt.Sprintf(`current-context: test
+contexts:
+- name: test
+  context: {cluster: test, namespace: certs}
+clusters:
+- name: test
+  cluster: {server: %q}
+`, url)
+	if err := ioutil.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunRevokeAccountSecret(t *testing.T) {
+	f := &fakeACME{t: t}
+	acmeSrv := httptest.NewServer(f)
+	defer acmeSrv.Close()
+	f.url = acmeSrv.URL
+	directory := acmeSrv.URL + "/directory"
+
+	accountKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	accountData, err := encodeAccountKey(accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newKubernetesCache("acme.secret", "", "certs", "example.com", directory, nil, 1, outputOptions{}, false)
+	api := newFakeSecretsAPI(
+		&v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "acme.secret", Namespace: "certs"},
+			Data:       map[string][]byte{k.secretKey("example.com"): newTestBundle(t, "example.com", time.Now().Add(90*24*time.Hour))},
+		},
+		&v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "acme.account", Namespace: "certs"},
+			Data:       map[string][]byte{k.secretKey(accountKeyName): accountData},
+		},
+	)
+	apiSrv := httptest.NewServer(api)
+	defer apiSrv.Close()
+	dir, err := ioutil.TempDir("", "revoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := writeTestKubeconfig(t, dir, apiSrv.URL)
+
+	args := []string{"-kubeconfig", kubeconfig, "-directory", directory, "-domain", "example.com"}
+	var out bytes.Buffer
+	if err := runRevoke(args, &out); err == nil {
+		t.Error("expected an error without the account key's secret")
+	}
+	if err := runRevoke(append(args, "-account-secret", "acme.account"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.revoked) != 1 || !publicKeysEqual(f.revoked[0].key, accountKey.Public()) {
+		t.Errorf("revocation wasn't signed with the key from the account secret: %+v", f.revoked)
+	}
+}
+
+// newRevokeFixture returns a cache for example.com whose secret holds a
+// certificate and the account key, and the fake servers behind it. The
+// caller should call done.
+func newRevokeFixture(t *testing.T) (f *fakeACME, api *fakeSecretsAPI, k *kubernetesCache, accountKey *ecdsa.PrivateKey, done func()) {
+	f = &fakeACME{t: t}
+	acmeSrv := httptest.NewServer(f)
+	f.url = acmeSrv.URL
+
+	accountKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	accountData, err := encodeAccountKey(accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k = newKubernetesCache("acme.secret", "example-tls", "certs", "example.com", acmeSrv.URL+"/directory", nil, 1, outputOptions{}, false)
+	api = newFakeSecretsAPI(&v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "acme.secret", Namespace: "certs"},
+		Data: map[string][]byte{
+			k.secretKey("example.com"):  newTestBundle(t, "example.com", time.Now().Add(90*24*time.Hour)),
+			k.secretKey(accountKeyName): accountData,
+		},
+	})
+	client, apiSrv := api.serve(t)
+	k.Client = client
+	return f, api, k, accountKey, func() {
+		acmeSrv.Close()
+		apiSrv.Close()
+	}
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	f, _, k, accountKey, done := newRevokeFixture(t)
+	defer done()
+	for _, useAccountKey := range []bool{true, false} {
+		b, err := revokeCertificate(context.Background(), k, "example.com", acme.CRLReasonKeyCompromise, useAccountKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f.revoked) == 0 {
+			t.Fatal("no revocation request")
+		}
+		got := f.revoked[len(f.revoked)-1]
+		want, signer := accountKey.Public(), "account"
+		if !useAccountKey {
+			want, signer = b.Key.Public(), "certificate"
+		}
+		if !publicKeysEqual(got.key, want) {
+			t.Errorf("revocation wasn't signed with the %s key", signer)
+		}
+		if !bytes.Equal(got.cert, b.Leaf.Raw) || got.reason != int(acme.CRLReasonKeyCompromise) {
+			t.Errorf("got revocation of %x for reason %d", got.cert, got.reason)
+		}
+	}
+}
+
+func TestReplaceCertificate(t *testing.T) {
+	f, api, k, _, done := newRevokeFixture(t)
+	defer done()
+	ca := newTestCA(t, time.Now().Add(365*24*time.Hour))
+	f.ca, f.caKey = ca.Leaf, ca.Key
+	old, err := k.cached()
+	if err != nil || old == nil {
+		t.Fatalf("got cached certificate %v, %v", old, err)
+	}
+
+	b, err := replaceCertificate(context.Background(), k, "example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicKeysEqual(b.Key.Public(), old.Key.Public()) {
+		t.Error("the replacement has the old key")
+	}
+	if _, ok := b.Key.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("got a %T key, want ECDSA", b.Key)
+	}
+	if cached, err := k.cached(); err != nil || cached == nil || cached.Fingerprint() != b.Fingerprint() {
+		t.Errorf("the cache doesn't hold the replacement: %v, %v", cached, err)
+	}
+	if ingress := api.get("certs", "example-tls"); ingress == nil || !bytes.Equal(ingress.Data["tls.crt"], b.CertsPEM) {
+		t.Error("the replacement wasn't published to the ingress secret")
+	}
+}
+
+func TestRunRevokeReplaceOutputs(t *testing.T) {
+	f := &fakeACME{t: t}
+	acmeSrv := httptest.NewServer(f)
+	defer acmeSrv.Close()
+	f.url = acmeSrv.URL
+	ca := newTestCA(t, time.Now().Add(365*24*time.Hour))
+	f.ca, f.caKey = ca.Leaf, ca.Key
+	directory := acmeSrv.URL + "/directory"
+
+	accountKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	accountData, err := encodeAccountKey(accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := parseCertBundle(newTestBundle(t, "example.com", time.Now().Add(90*24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newKubernetesCache("acme.secret", "example-tls", "web", "example.com", directory, nil, 1, outputOptions{}, false)
+	api := newFakeSecretsAPI(
+		&v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "acme.secret", Namespace: "web"},
+			Data: map[string][]byte{
+				k.secretKey("example.com"):  append(append([]byte{}, old.KeyPEM...), old.CertsPEM...),
+				k.secretKey(accountKeyName): accountData,
+			},
+		},
+		&v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "example-tls", Namespace: "web"},
+			Data: map[string][]byte{
+				"tls.crt":      old.CertsPEM,
+				"tls.key":      old.KeyPEM,
+				combinedPEMKey: append(append([]byte{}, old.KeyPEM...), old.CertsPEM...),
+			},
+		},
+	)
+	apiSrv := httptest.NewServer(api)
+	defer apiSrv.Close()
+	dir, err := ioutil.TempDir("", "revoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := writeTestKubeconfig(t, dir, apiSrv.URL)
+	configPath := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`namespace: web
+issuers:
+  internal:
+    directoryURL: %s
+certificates:
+- domain: example.com
+  issuer: internal
+  ingressSecret: example-tls
+  outputFormats: [pem-combined]
+`, directory)
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the config only tls.crt and tls.key would be replaced, so
+	// nothing is revoked.
+	args := []string{"-kubeconfig", kubeconfig, "-domain", "example.com", "-replace"}
+	var out bytes.Buffer
+	if err := runRevoke(append(args, "-namespace", "web", "-directory", directory, "-ingress-secret", "example-tls"), &out); err == nil {
+		t.Error("expected -replace to be refused without -config")
+	}
+	if len(f.revoked) != 0 {
+		t.Fatalf("revoked %d certificates", len(f.revoked))
+	}
+
+	if err := runRevoke(append(args, "-config", configPath), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.revoked) != 1 || !bytes.Equal(f.revoked[0].cert, old.Leaf.Raw) {
+		t.Fatalf("got revocations %+v", f.revoked)
+	}
+	ingress := api.get("web", "example-tls")
+	if ingress == nil || bytes.Equal(ingress.Data["tls.crt"], old.CertsPEM) {
+		t.Fatal("the replacement wasn't published")
+	}
+	if combined := ingress.Data[combinedPEMKey]; bytes.Contains(combined, old.CertsPEM) || !bytes.Contains(combined, ingress.Data["tls.crt"]) {
+		t.Errorf("%s wasn't replaced:\n%s", combinedPEMKey, combined)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Retry delays after a signed certificate couldn't be obtained.
+const (
+	signedRetryMin = time.Minute
+	signedRetryMax = time.Hour
+)
+
+// certificateSource obtains the certificates for a managedCertificate.
+// autocert.Manager is one.
+type certificateSource interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+// renewingSource is a certificateSource that obtains and renews certificates
+// on its own schedule, rather than when a client asks for one.
+type renewingSource interface {
+	certificateSource
+	// run keeps the certificate current until ctx is done.
+	run(ctx context.Context)
+}
+
+// certificateSigner signs certificates without ACME.
+type certificateSigner interface {
+	// sign returns the DER encoded certificate chain, leaf first, for key
+	// and the names and usages in cc.
+	sign(ctx context.Context, cc certificateConfig, key crypto.Signer) ([][]byte, error)
+}
+
+// signedSource obtains certificates from a certificateSigner as soon as it
+// starts, rather than on the first TLS handshake as autocert does, and renews
+// them on Schedule, by default once two thirds of their lifetime has passed.
+// Certificates are kept in the cache under the domain name, like autocert's,
+// so they're published to the ingress secret the same way.
+type signedSource struct {
+	Config   certificateConfig
+	Signer   certificateSigner
+	Cache    autocert.Cache
+	Schedule renewalSchedule
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// notIssuedError is returned for handshakes before a signedSource has
+// obtained its first certificate, which can take until a csr issuer's
+// approvalTimeout. It's not an issuance failure; run records those.
+type notIssuedError string
+
+func (e notIssuedError) Error() string {
+	return "no certificate has been issued for " + string(e) + " yet"
+}
+
+func (s *signedSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, notIssuedError(s.Config.Domain)
+	}
+	return s.cert, nil
+}
+
+// HTTPHandler returns fallback; there are no challenges to answer.
+func (s *signedSource) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+func (s *signedSource) run(ctx context.Context) {
+	retry := signedRetryMin
+	for {
+		next, err := s.ensure(ctx, time.Now())
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Error("could not obtain certificate", "domain", s.Config.Domain, "err", err, "retry_in", retry)
+			next = time.Now().Add(retry)
+			if retry *= 2; retry > signedRetryMax {
+				retry = signedRetryMax
+			}
+		} else {
+			retry = signedRetryMin
+			logger.Debug("next renewal", "domain", s.Config.Domain, "at", next)
+		}
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// ensure loads the cached certificate, or issues a new one if there isn't a
+// usable one, and returns when it should be renewed.
+func (s *signedSource) ensure(ctx context.Context, now time.Time) (time.Time, error) {
+	data, err := s.Cache.Get(ctx, s.Config.Domain)
+	if err != nil && err != autocert.ErrCacheMiss {
+		return time.Time{}, err
+	}
+	var b *certBundle
+	if err == nil {
+		if cached, perr := parseCertBundle(data); perr == nil && s.usable(cached, now) {
+			b = cached
+		}
+	}
+	if b == nil {
+		logger.Info("requesting certificate", "domain", s.Config.Domain)
+		b, err = s.issue(ctx)
+		if err != nil {
+			recordIssuanceFailure(s.Config.Domain, "", err)
+			return time.Time{}, err
+		}
+	}
+	cert, err := tls.X509KeyPair(b.CertsPEM, b.KeyPEM)
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert.Leaf = b.Leaf
+	s.mu.Lock()
+	s.cert = &cert
+	s.mu.Unlock()
+	return s.renewalTime(b.Leaf), nil
+}
+
+// usable reports whether b is valid, not yet due for renewal, and has the
+// names and usages the configuration asks for.
+func (s *signedSource) usable(b *certBundle, now time.Time) bool {
+	if checkCertificate(b, s.Config.Domain, now, 0) != nil || !now.Before(s.renewalTime(b.Leaf)) {
+		return false
+	}
+	var ips []string
+	for _, ip := range b.Leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	var wantIPs []string
+	for _, ip := range s.Config.ipAddresses() {
+		wantIPs = append(wantIPs, ip.String())
+	}
+	return sameStrings(b.Leaf.DNSNames, s.Config.dnsNames()) &&
+		sameStrings(ips, wantIPs) &&
+		sameStrings(extKeyUsageNames(b.Leaf.ExtKeyUsage), s.Config.usages())
+}
+
+// issue generates a key, has it signed and stores the result in the cache.
+func (s *signedSource) issue(ctx context.Context) (*certBundle, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := s.Signer.sign(ctx, s.Config, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// The same layout autocert stores: the key, then the chain.
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	b, err := parseCertBundle(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Cache.Put(ctx, s.Config.Domain, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// renewalTime returns when leaf should be renewed.
+func (s *signedSource) renewalTime(leaf *x509.Certificate) time.Time {
+	schedule := s.Schedule
+	if schedule.Window.isZero() {
+		schedule.Window = defaultSignedRenewBefore
+	}
+	return schedule.renewAt(leaf)
+}
+
+// sameStrings reports whether a and b hold the same strings, in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsNames returns the DNS names to put in a directly signed certificate:
+// the domain, then any extra names.
+func (cc *certificateConfig) dnsNames() []string {
+	names := []string{cc.Domain}
+	seen := map[string]bool{cc.Domain: true}
+	for _, name := range cc.DNSNames {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ipAddresses returns the IP addresses to put in a directly signed
+// certificate. The configuration must have been validated.
+func (cc *certificateConfig) ipAddresses() []net.IP {
+	var ips []net.IP
+	for _, s := range cc.IPAddresses {
+		ips = append(ips, net.ParseIP(s))
+	}
+	return ips
+}
+
+// usages returns the extended key usages for a directly signed certificate.
+func (cc *certificateConfig) usages() []string {
+	if len(cc.Usages) == 0 {
+		return []string{"server"}
+	}
+	return cc.Usages
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// defaultRenewBefore is how long before expiry acme/autocert renews a
+// certificate when Manager.RenewBefore is not set.
+const defaultRenewBefore = 30 * 24 * time.Hour
+
+// certificateStatus is what we know about one managed certificate.
+type certificateStatus struct {
+	Domain  string   `json:"domain"`
+	Secrets []string `json:"secrets"`
+
+	// Details of the current certificate, if we have one.
+	DNSNames    []string   `json:"dnsNames,omitempty"`
+	Issuer      string     `json:"issuer,omitempty"`
+	KeyType     string     `json:"keyType,omitempty"`
+	Fingerprint string     `json:"fingerprintSHA256,omitempty"`
+	NotBefore   *time.Time `json:"notBefore,omitempty"`
+	NotAfter    *time.Time `json:"notAfter,omitempty"`
+	NextRenewal *time.Time `json:"nextRenewal,omitempty"`
+
+	// How the certificate is renewed, e.g. "720h0m0s before expiry, 12m
+	// jitter", if it has its own schedule.
+	Renewal  string `json:"renewal,omitempty"`
+	schedule *renewalSchedule
+
+	// For certificates with fallback issuers, the configured issuer in use.
+	ActiveIssuer string `json:"activeIssuer,omitempty"`
+
+	// The most recent issuance attempt.
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	LastOutcome string     `json:"lastOutcome,omitempty"` // "success" or "failure"
+	LastError   string     `json:"lastError,omitempty"`
+
+	// Set while we're refusing to contact the CA for this domain.
+	BackoffUntil  *time.Time `json:"backoffUntil,omitempty"`
+	BackoffReason string     `json:"backoffReason,omitempty"`
+
+	// The outcome of a dry run, if one was done.
+	DryRun *dryRunStatus `json:"dryRun,omitempty"`
+}
+
+// dryRunStatus is the outcome of a dry run issuance.
+type dryRunStatus struct {
+	Time   time.Time     `json:"time"`
+	Change *secretChange `json:"change,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// statusTracker records the state of every managed certificate, for the
+// status endpoints.
+type statusTracker struct {
+	mu          sync.Mutex
+	certs       map[string]*certificateStatus
+	renewBefore time.Duration
+}
+
+// certStatus is the process wide status tracker.
+var certStatus = newStatusTracker(defaultRenewBefore)
+
+func newStatusTracker(renewBefore time.Duration) *statusTracker {
+	return &statusTracker{certs: make(map[string]*certificateStatus), renewBefore: renewBefore}
+}
+
+// add starts tracking domain, whose certificate is written to secrets.
+func (s *statusTracker) add(domain string, secrets ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(domain).Secrets = secrets
+}
+
+// remove stops tracking domain.
+func (s *statusTracker) remove(domain string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.certs, domain)
+}
+
+// get returns the status for domain, adding it if needed. The caller must
+// hold s.mu.
+func (s *statusTracker) get(domain string) *certificateStatus {
+	st, ok := s.certs[domain]
+	if !ok {
+		st = &certificateStatus{Domain: domain}
+		s.certs[domain] = st
+	}
+	return st
+}
+
+// setSchedule records how domain's certificate is renewed.
+func (s *statusTracker) setSchedule(domain string, schedule renewalSchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.get(domain)
+	st.schedule = &schedule
+	st.Renewal = schedule.String()
+	if st.NotAfter != nil {
+		renewal := schedule.renewAt(&x509.Certificate{NotBefore: *st.NotBefore, NotAfter: *st.NotAfter})
+		st.NextRenewal = &renewal
+	}
+}
+
+// setCertificate records b as the current certificate for domain.
+func (s *statusTracker) setCertificate(domain string, b *certBundle) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.get(domain)
+	notBefore, notAfter := b.Leaf.NotBefore, b.Leaf.NotAfter
+	renewal := notAfter.Add(-s.renewBefore)
+	if st.schedule != nil {
+		renewal = st.schedule.renewAt(b.Leaf)
+	}
+	st.DNSNames = b.Leaf.DNSNames
+	st.Issuer = b.Leaf.Issuer.CommonName
+	st.KeyType = b.KeyType()
+	st.Fingerprint = b.Fingerprint()
+	st.NotBefore = &notBefore
+	st.NotAfter = &notAfter
+	st.NextRenewal = &renewal
+}
+
+// setActiveIssuer records which of a certificate's issuers is in use.
+func (s *statusTracker) setActiveIssuer(domain, issuer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(domain).ActiveIssuer = issuer
+}
+
+// setAttempt records the outcome of an issuance attempt for domain. err is
+// nil on success. It reports whether the previous attempt failed with the
+// same error.
+func (s *statusTracker) setAttempt(domain string, err error) (repeated bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.get(domain)
+	now := time.Now()
+	st.LastAttempt = &now
+	if err != nil {
+		repeated = st.LastOutcome == "failure" && st.LastError == err.Error()
+		st.LastOutcome = "failure"
+		st.LastError = err.Error()
+	} else {
+		st.LastOutcome = "success"
+		st.LastError = ""
+	}
+	return repeated
+}
+
+// setDryRun records the outcome of a dry run for domain: the change that
+// would have been made, or the error that stopped it.
+func (s *statusTracker) setDryRun(domain string, change *secretChange, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dr := &dryRunStatus{Time: time.Now(), Change: change}
+	if err != nil {
+		dr.Error = err.Error()
+	}
+	s.get(domain).DryRun = dr
+}
+
+// hasCertificate reports whether we have seen a certificate for domain.
+func (s *statusTracker) hasCertificate(domain string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.certs[domain]
+	return ok && st.NotAfter != nil
+}
+
+// list returns a copy of every certificate's status, sorted by domain.
+func (s *statusTracker) list() []certificateStatus {
+	s.mu.Lock()
+	out := make([]certificateStatus, 0, len(s.certs))
+	for _, st := range s.certs {
+		out = append(out, *st)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Domain < out[j].Domain })
+	for i := range out {
+		if until, reason := backoffs.active(out[i].Domain); !until.IsZero() {
+			out[i].BackoffUntil = &until
+			out[i].BackoffReason = reason
+		}
+	}
+	return out
+}
+
+// recordCertificate notes that b is the current certificate for domain,
+// e.g. after loading it from the cache.
+func recordCertificate(domain string, b *certBundle) {
+	certNotAfter.Set(float64(b.Leaf.NotAfter.Unix()), domain)
+	certStatus.setCertificate(domain, b)
+}
+
+// recordIssuance notes that a new certificate was issued for domain, by the
+// issuer whose backoff state is kept under scope.
+func recordIssuance(domain, scope string, b *certBundle) {
+	reason, verb, event := reasonIssued, "Issued", notifyIssued
+	if certStatus.hasCertificate(domain) {
+		reason, verb, event = reasonRenewed, "Renewed", notifyRenewed
+	}
+	pendingOrders.finish(scopedBackoffDomain(scope, domain))
+	issuanceAttempts.Inc(domain)
+	recordCertificate(domain, b)
+	certStatus.setAttempt(domain, nil)
+	backoffs.recordSuccess(scopedBackoffDomain(scope, domain))
+	message := fmt.Sprintf("%s certificate for %s, issued by %s, expires %s",
+		verb, domain, b.Leaf.Issuer.CommonName, b.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	events.Eventf(v1.EventTypeNormal, reason, "%s", message)
+	notAfter := b.Leaf.NotAfter
+	notifications.notify(notification{
+		Event:       event,
+		Domain:      domain,
+		Message:     message,
+		Issuer:      b.Leaf.Issuer.CommonName,
+		NotAfter:    &notAfter,
+		Fingerprint: b.Fingerprint(),
+	})
+}
+
+// recordIssuanceFailure notes that obtaining a certificate for domain from
+// the issuer whose backoff state is kept under scope failed. If it failed
+// because we're backing off, the CA wasn't contacted, so it doesn't count as
+// an attempt. An Event is only recorded when the error differs from the last
+// attempt's; the notifier suppresses repeated notifications itself.
+func recordIssuanceFailure(domain, scope string, err error) {
+	if _, ok := asBackoffError(err); ok {
+		return
+	}
+	backoffs.recordFailure(scopedBackoffDomain(scope, domain), err)
+	issuanceAttempts.Inc(domain)
+	issuanceFailures.Inc(domain, issuanceFailureReason(err))
+	message := fmt.Sprintf("Failed to obtain certificate for %s: %v", domain, err)
+	if !certStatus.setAttempt(domain, err) {
+		events.Eventf(v1.EventTypeWarning, reasonIssuanceFailed, "%s", message)
+	}
+	notifications.notify(notification{
+		Event:   notifyIssuanceFailed,
+		Domain:  domain,
+		Message: message,
+		Error:   err.Error(),
+	})
+}
+
+type statusResponse struct {
+	Certificates []certificateStatus `json:"certificates"`
+	Now          time.Time           `json:"now"`
+}
+
+// ServeJSON serves the status of every certificate as JSON.
+func (s *statusTracker) ServeJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(statusResponse{Certificates: s.list(), Now: time.Now().UTC()}); err != nil {
+		logger.Error("encoding status JSON", "err", err)
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"time": func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.UTC().Format("2006-01-02 15:04 MST")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>k8s-cert-generator status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+.failure { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Managed certificates</h1>
+<p>As of {{ time .Now }}. Also available as <a href="status.json">JSON</a>.</p>
+<table>
+<tr><th>Domain</th><th>Names</th><th>Secrets</th><th>Key type</th><th>Issuer</th><th>Not after</th><th>Next renewal</th><th>Last attempt</th><th>Last error</th></tr>
+{{- range .Certificates }}
+<tr>
+<td>{{ .Domain }}</td>
+<td>{{ range .DNSNames }}{{ . }}<br>{{ end }}</td>
+<td>{{ range .Secrets }}{{ . }}<br>{{ end }}</td>
+<td>{{ or .KeyType "-" }}</td>
+<td>{{ or .Issuer "-" }}{{ with .ActiveIssuer }} (via {{ . }}){{ end }}</td>
+<td>{{ time .NotAfter }}</td>
+<td>{{ time .NextRenewal }}{{ with .Renewal }}<br><small>{{ . }}</small>{{ end }}</td>
+<td class="{{ .LastOutcome }}">{{ time .LastAttempt }} {{ .LastOutcome }}</td>
+<td class="failure">{{ .LastError }}{{ if .BackoffUntil }}<br>Backing off until {{ time .BackoffUntil }} ({{ .BackoffReason }}){{ end }}</td>
+</tr>
+{{- end }}
+</table>
+{{- range .Certificates }}{{ if .DryRun }}
+<h2>Dry run for {{ .Domain }}, {{ .DryRun.Time.UTC.Format "2006-01-02 15:04 MST" }}</h2>
+{{- if .DryRun.Error }}
+<p class="failure">{{ .DryRun.Error }}</p>
+{{- end }}
+{{- with .DryRun.Change }}
+<pre>{{ .String }}</pre>
+{{- end }}
+{{- end }}{{ end }}
+</body>
+</html>
+`))
+
+// ServeHTML serves a human readable status page.
+func (s *statusTracker) ServeHTML(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, map[string]interface{}{
+		"Certificates": s.list(),
+		"Now":          &now,
+	}); err != nil {
+		logger.Error("rendering status page", "err", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusTracker(t *testing.T) {
+	s := newStatusTracker(24 * time.Hour)
+	s.add("example.com", "acme.ingress.secret")
+	s.setAttempt("example.com", errors.New("rate limited"))
+
+	notAfter := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+	b, err := parseCertBundle(newTestBundle(t, "example.com", notAfter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setCertificate("example.com", b)
+
+	w := httptest.NewRecorder()
+	s.ServeJSON(w, httptest.NewRequest("GET", "/status.json", nil))
+	var resp statusResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Certificates) != 1 {
+		t.Fatalf("got %d certificates, want 1", len(resp.Certificates))
+	}
+	st := resp.Certificates[0]
+	if st.LastOutcome != "failure" || st.LastError != "rate limited" {
+		t.Errorf("got outcome %q, error %q", st.LastOutcome, st.LastError)
+	}
+	if st.NextRenewal == nil || !st.NextRenewal.Equal(notAfter.Add(-24*time.Hour)) {
+		t.Errorf("got next renewal %v, want %v", st.NextRenewal, notAfter.Add(-24*time.Hour))
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTML(w, httptest.NewRequest("GET", "/status", nil))
+	if body := w.Body.String(); !strings.Contains(body, "<td>example.com</td>") || !strings.Contains(body, "rate limited") {
+		t.Errorf("unexpected HTML:\n%s", body)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// secretTemplate describes extra keys to render into the ingress secret, for
+// consumers that expect their own key names. It's loaded from a YAML or JSON
+// file like this:
+//
+//	type: Opaque
+//	data:
+//	  fullchain.pem: '{{ .FullChainPEM }}'
+//	  privkey.pem: '{{ .KeyPEM }}'
+//	  cert.json: '{{ json . }}'
+//
+// Each data value is a text/template executed against a bundleTemplateData.
+type secretTemplate struct {
+	// Type is the Kubernetes secret type to use when the generator creates the
+	// secret. Secret types are immutable, so an existing secret keeps its type.
+	Type string            `json:"type"`
+	Data map[string]string `json:"data"`
+
+	templates map[string]*template.Template
+}
+
+// bundleTemplateData is the value templates are executed against.
+type bundleTemplateData struct {
+	Domain            string    `json:"domain"`
+	CommonName        string    `json:"commonName"`
+	DNSNames          []string  `json:"dnsNames"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serialNumber"`
+	NotBefore         time.Time `json:"notBefore"`
+	NotAfter          time.Time `json:"notAfter"`
+	FingerprintSHA256 string    `json:"fingerprintSHA256"`
+	KeyType           string    `json:"keyType"`
+
+	// PEM encodings. CertPEM is just the leaf, ChainPEM the intermediates and
+	// FullChainPEM both. The private key is left out of JSON output so that
+	// `{{ json . }}` can't leak it by accident.
+	KeyPEM       string `json:"-"`
+	CertPEM      string `json:"certPEM"`
+	ChainPEM     string `json:"chainPEM"`
+	FullChainPEM string `json:"fullChainPEM"`
+}
+
+var secretKeyRx = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"base64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"join": strings.Join,
+}
+
+// loadSecretTemplate reads and parses the secret template at path.
+func loadSecretTemplate(path string) (*secretTemplate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseSecretTemplate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+func parseSecretTemplate(data []byte) (*secretTemplate, error) {
+	t := new(secretTemplate)
+	if err := yaml.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	if len(t.Data) == 0 {
+		return nil, fmt.Errorf("secret template has no data keys")
+	}
+	t.templates = make(map[string]*template.Template, len(t.Data))
+	for key, text := range t.Data {
+		if !secretKeyRx.MatchString(key) {
+			return nil, fmt.Errorf("invalid secret key %q: must match %s", key, secretKeyRx)
+		}
+		tmpl, err := template.New(key).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		t.templates[key] = tmpl
+	}
+	return t, nil
+}
+
+// render executes every data template against b, returning the secret data.
+func (t *secretTemplate) render(b *certBundle, domain string) (map[string][]byte, error) {
+	td := newBundleTemplateData(b, domain)
+	keys := make([]string, 0, len(t.templates))
+	for key := range t.templates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		buf := new(bytes.Buffer)
+		if err := t.templates[key].Execute(buf, td); err != nil {
+			return nil, fmt.Errorf("rendering secret key %q: %v", key, err)
+		}
+		data[key] = buf.Bytes()
+	}
+	return data, nil
+}
+
+func newBundleTemplateData(b *certBundle, domain string) *bundleTemplateData {
+	td := &bundleTemplateData{
+		Domain:            domain,
+		CommonName:        b.Leaf.Subject.CommonName,
+		DNSNames:          b.Leaf.DNSNames,
+		Issuer:            b.Leaf.Issuer.CommonName,
+		SerialNumber:      b.Leaf.SerialNumber.String(),
+		NotBefore:         b.Leaf.NotBefore,
+		NotAfter:          b.Leaf.NotAfter,
+		FingerprintSHA256: b.Fingerprint(),
+		KeyType:           b.KeyType(),
+		KeyPEM:            string(b.KeyPEM),
+	}
+	var leaf, chain bytes.Buffer
+	for i, cert := range b.Chain {
+		w := &chain
+		if i == 0 {
+			w = &leaf
+		}
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	td.CertPEM = leaf.String()
+	td.ChainPEM = chain.String()
+	td.FullChainPEM = td.CertPEM + td.ChainPEM
+	return td
+}
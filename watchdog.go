@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// The watchdog scans every kubernetes.io/tls secret in the cluster, and
+// optionally some Opaque ones, whoever issued the certificates in them, and
+// exports their expiry and weaknesses as metrics. The scan subcommand prints
+// the same report.
+
+const (
+	defaultMinRSABits = 2048
+	// defaultExpiryWarning is how soon a certificate has to expire for scan to
+	// flag it.
+	defaultExpiryWarning = 30 * 24 * time.Hour
+)
+
+// defaultOpaqueKeys are the keys of Opaque secrets searched for certificates.
+var defaultOpaqueKeys = []string{"*.crt", "*.pem"}
+
+// Weaknesses reported for a certificate.
+const (
+	weaknessSmallRSAKey   = "small-rsa-key"
+	weaknessSHA1Signature = "sha1-signature"
+	weaknessMD5Signature  = "md5-signature"
+	weaknessNoSAN         = "no-san"
+)
+
+// secretCertificate is what the watchdog found under one key of a secret.
+type secretCertificate struct {
+	Namespace string `json:"namespace"`
+	Secret    string `json:"secret"`
+	Key       string `json:"key"`
+
+	Subject            string     `json:"subject,omitempty"`
+	DNSNames           []string   `json:"dnsNames,omitempty"`
+	Issuer             string     `json:"issuer,omitempty"`
+	KeyType            string     `json:"keyType,omitempty"`
+	SignatureAlgorithm string     `json:"signatureAlgorithm,omitempty"`
+	NotAfter           *time.Time `json:"notAfter,omitempty"`
+	Weaknesses         []string   `json:"weaknesses,omitempty"`
+	// Set if the key doesn't hold a certificate we can parse.
+	Error string `json:"error,omitempty"`
+}
+
+// expiresWithin reports whether c expires within d of now, or has expired.
+func (c *secretCertificate) expiresWithin(d time.Duration, now time.Time) bool {
+	return c.NotAfter != nil && c.NotAfter.Sub(now) < d
+}
+
+// certificateWeaknesses returns what's wrong with chain, whose first
+// certificate is the one the secret is for.
+func certificateWeaknesses(chain []*x509.Certificate, minRSABits int) []string {
+	var found []string
+	leaf := chain[0]
+	if pub, ok := leaf.PublicKey.(*rsa.PublicKey); ok && pub.N.BitLen() < minRSABits {
+		found = append(found, weaknessSmallRSAKey)
+	}
+	var sha1, md5 bool
+	for _, cert := range chain {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			// Nobody checks the signature on a root.
+			continue
+		}
+		switch cert.SignatureAlgorithm {
+		case x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+			sha1 = true
+		case x509.MD5WithRSA, x509.MD2WithRSA:
+			md5 = true
+		}
+	}
+	if sha1 {
+		found = append(found, weaknessSHA1Signature)
+	}
+	if md5 {
+		found = append(found, weaknessMD5Signature)
+	}
+	// CA certificates, e.g. in ca.crt, don't need names.
+	if !leaf.IsCA && len(leaf.DNSNames)+len(leaf.IPAddresses)+len(leaf.EmailAddresses)+len(leaf.URIs) == 0 {
+		found = append(found, weaknessNoSAN)
+	}
+	return found
+}
+
+// certificateKeys returns the keys of secret to look for certificates under,
+// and whether a key without one is an error.
+func certificateKeys(secret *v1.Secret, opaqueKeys []string) ([]string, bool) {
+	if secret.Type == v1.SecretTypeTLS {
+		keys := []string{v1.TLSCertKey}
+		if _, ok := secret.Data["ca.crt"]; ok {
+			keys = append(keys, "ca.crt")
+		}
+		return keys, true
+	}
+	var keys []string
+	for key := range secret.Data {
+		for _, pattern := range opaqueKeys {
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, false
+}
+
+// inspectSecretCertificates describes the certificates in secret.
+func inspectSecretCertificates(secret *v1.Secret, opaqueKeys []string, minRSABits int) []secretCertificate {
+	keys, required := certificateKeys(secret, opaqueKeys)
+	var found []secretCertificate
+	for _, key := range keys {
+		c := secretCertificate{Namespace: secret.Namespace, Secret: secret.Name, Key: key}
+		chain, err := parseCertificates(secret.Data[key])
+		if err == errNoCertificates && !required {
+			// Probably a key or some other PEM file.
+			continue
+		}
+		if err != nil {
+			c.Error = err.Error()
+			found = append(found, c)
+			continue
+		}
+		leaf := chain[0]
+		notAfter := leaf.NotAfter
+		c.Subject = leaf.Subject.CommonName
+		c.DNSNames = leaf.DNSNames
+		c.Issuer = leaf.Issuer.CommonName
+		c.KeyType = keyType(leaf.PublicKey)
+		c.SignatureAlgorithm = leaf.SignatureAlgorithm.String()
+		c.NotAfter = &notAfter
+		c.Weaknesses = certificateWeaknesses(chain, minRSABits)
+		found = append(found, c)
+	}
+	return found
+}
+
+// scanSecrets lists the secrets cfg covers and describes their certificates,
+// sorted by namespace, secret and key.
+func scanSecrets(client kubernetes.Interface, cfg watchdogConfig) ([]secretCertificate, error) {
+	namespaces := cfg.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{v1.NamespaceAll}
+	}
+	var found []secretCertificate
+	for _, ns := range namespaces {
+		lists := []meta_v1.ListOptions{{FieldSelector: "type=" + string(v1.SecretTypeTLS)}}
+		if cfg.OpaqueSelector != "" {
+			lists = append(lists, meta_v1.ListOptions{LabelSelector: cfg.OpaqueSelector, FieldSelector: "type=" + string(v1.SecretTypeOpaque)})
+		}
+		for _, opts := range lists {
+			secrets, err := client.CoreV1().Secrets(ns).List(opts)
+			if err != nil {
+				return nil, fmt.Errorf("listing secrets (%s): %v", opts.FieldSelector, err)
+			}
+			for i := range secrets.Items {
+				found = append(found, inspectSecretCertificates(&secrets.Items[i], cfg.OpaqueKeys, cfg.MinRSABits)...)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Secret != b.Secret {
+			return a.Secret < b.Secret
+		}
+		return a.Key < b.Key
+	})
+	return found, nil
+}
+
+// recordSecretCertificates replaces the watchdog metrics with found.
+func recordSecretCertificates(found []secretCertificate) {
+	seen := make(map[string]bool)
+	weak := make(map[string]bool)
+	invalid := make(map[string]bool)
+	for _, c := range found {
+		labels := []string{c.Namespace, c.Secret, c.Key}
+		id := strings.Join(labels, "\xff")
+		if c.Error != "" {
+			invalid[id] = true
+			secretCertInvalid.Set(1, labels...)
+			continue
+		}
+		seen[id] = true
+		secretCertNotAfter.Set(float64(c.NotAfter.Unix()), labels...)
+		for _, w := range c.Weaknesses {
+			weak[id+"\xff"+w] = true
+			secretCertWeakness.Set(1, append(labels, w)...)
+		}
+	}
+	deleteStale := func(g *gaugeVec, keep map[string]bool) {
+		g.Each(func(labels []string, _ float64) {
+			if !keep[strings.Join(labels, "\xff")] {
+				g.Delete(labels...)
+			}
+		})
+	}
+	deleteStale(secretCertNotAfter, seen)
+	deleteStale(secretCertExpiry, seen)
+	deleteStale(secretCertWeakness, weak)
+	deleteStale(secretCertInvalid, invalid)
+}
+
+// runWatchdog scans the cluster's TLS secrets every cfg.Interval until ctx is
+// done, logging certificates that expire within warnWithin.
+func runWatchdog(ctx context.Context, client kubernetes.Interface, cfg watchdogConfig, warnWithin time.Duration) {
+	logger.Info("watching TLS secrets", "namespaces", strings.Join(cfg.Namespaces, ","), "interval", cfg.Interval.Duration)
+	for {
+		found, err := scanSecrets(client, cfg)
+		if err != nil {
+			watchdogScans.Inc("failure")
+			logger.Error("could not scan TLS secrets", "err", err)
+		} else {
+			watchdogScans.Inc("success")
+			watchdogLastScan.Set(float64(time.Now().Unix()))
+			recordSecretCertificates(found)
+			now := time.Now()
+			var expiring, weak, invalid int
+			for _, c := range found {
+				switch {
+				case c.Error != "":
+					invalid++
+				case c.expiresWithin(warnWithin, now):
+					expiring++
+					logger.Warn("certificate in secret expires soon", "namespace", c.Namespace, "secret", c.Secret, "key", c.Key, "names", strings.Join(c.DNSNames, ","), "not_after", c.NotAfter)
+				}
+				if len(c.Weaknesses) > 0 {
+					weak++
+				}
+			}
+			logger.Info("scanned TLS secrets", "certificates", len(found), "expiring", expiring, "weak", weak, "invalid", invalid)
+		}
+		t := time.NewTimer(cfg.Interval.Duration)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// writeScanReport writes found in a form meant for people. Certificates that
+// expire within warnWithin are flagged.
+func writeScanReport(w io.Writer, found []secretCertificate, warnWithin time.Duration, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tSECRET\tKEY\tNAMES\tISSUER\tEXPIRES\tDAYS\tKEY TYPE\tNOTES")
+	for _, c := range found {
+		if c.Error != "" {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\t-\t-\t%s\n", c.Namespace, c.Secret, c.Key, c.Error)
+			continue
+		}
+		names := strings.Join(c.DNSNames, ",")
+		if names == "" {
+			names = c.Subject
+		}
+		notes := append([]string{}, c.Weaknesses...)
+		switch {
+		case !now.Before(*c.NotAfter):
+			notes = append([]string{"EXPIRED"}, notes...)
+		case c.expiresWithin(warnWithin, now):
+			notes = append([]string{"EXPIRING"}, notes...)
+		}
+		days := int(c.NotAfter.Sub(now).Hours() / 24)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", c.Namespace, c.Secret, c.Key, names, c.Issuer,
+			c.NotAfter.UTC().Format("2006-01-02"), days, c.KeyType, strings.Join(notes, ", "))
+	}
+	return tw.Flush()
+}
+
+// runScan implements the scan subcommand.
+func runScan(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.SetOutput(out)
+	kubeconfigPath := fs.String("kubeconfig", "", "Path to a kubeconfig file (default $KUBECONFIG, ~/.kube/config, or the in-cluster config)")
+	namespaces := fs.String("namespace", "", "Comma separated namespaces to scan (default every namespace)")
+	opaqueSelector := fs.String("opaque-selector", "", "Label selector of Opaque secrets to scan too")
+	opaqueKeys := fs.String("opaque-keys", strings.Join(defaultOpaqueKeys, ","), "Comma separated patterns of Opaque secret keys holding certificates")
+	minRSABits := fs.Int("min-rsa-bits", defaultMinRSABits, "Report RSA keys smaller than this")
+	warn := fs.Duration("warn", defaultExpiryWarning, "Flag certificates that expire within this window")
+	problems := fs.Bool("problems", false, "Only list certificates that are expiring, weak or can't be parsed")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg := watchdogConfig{OpaqueSelector: *opaqueSelector, MinRSABits: *minRSABits}
+	for _, ns := range strings.Split(*namespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			cfg.Namespaces = append(cfg.Namespaces, ns)
+		}
+	}
+	for _, pattern := range strings.Split(*opaqueKeys, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("-opaque-keys: %q: %v", pattern, err)
+			}
+			cfg.OpaqueKeys = append(cfg.OpaqueKeys, pattern)
+		}
+	}
+	client, _, err := commandClient(*kubeconfigPath)
+	if err != nil {
+		return err
+	}
+	found, err := scanSecrets(client, cfg)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if *problems {
+		var keep []secretCertificate
+		for _, c := range found {
+			if c.Error != "" || len(c.Weaknesses) > 0 || c.expiresWithin(*warn, now) {
+				keep = append(keep, c)
+			}
+		}
+		found = keep
+	}
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(found)
+	}
+	return writeScanReport(out, found, *warn, now)
+}
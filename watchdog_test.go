@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestCertificateWeaknesses(t *testing.T) {
+	smallKey := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023), E: 65537}
+	bigKey := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 2047), E: 65537}
+	root := &x509.Certificate{RawIssuer: []byte("root"), RawSubject: []byte("root"), SignatureAlgorithm: x509.SHA1WithRSA, IsCA: true}
+	tests := []struct {
+		name  string
+		chain []*x509.Certificate
+		want  []string
+	}{
+		{"fine", []*x509.Certificate{{PublicKey: bigKey, SignatureAlgorithm: x509.SHA256WithRSA, DNSNames: []string{"a"}}, root}, nil},
+		{"small key", []*x509.Certificate{{PublicKey: smallKey, DNSNames: []string{"a"}}}, []string{weaknessSmallRSAKey}},
+		{"sha1 intermediate", []*x509.Certificate{
+			{PublicKey: bigKey, SignatureAlgorithm: x509.SHA256WithRSA, DNSNames: []string{"a"}},
+			{RawIssuer: []byte("root"), RawSubject: []byte("ca"), SignatureAlgorithm: x509.SHA1WithRSA, IsCA: true},
+		}, []string{weaknessSHA1Signature}},
+		{"no names", []*x509.Certificate{{RawIssuer: []byte("ca"), PublicKey: bigKey, SignatureAlgorithm: x509.MD5WithRSA}}, []string{weaknessMD5Signature, weaknessNoSAN}},
+		{"ca without names", []*x509.Certificate{root}, nil},
+	}
+	for _, tt := range tests {
+		if got := certificateWeaknesses(tt.chain, defaultMinRSABits); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newNamelessCertificate returns a PEM certificate without subject
+// alternative names.
+func newNamelessCertificate(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "legacy.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(5 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestInspectSecretCertificates(t *testing.T) {
+	now := time.Now()
+	b, err := parseCertBundle(newTestBundle(t, "example.com", now.Add(60*24*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := newNamelessCertificate(t)
+
+	tlsSecret := &v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: "web", Name: "example-tls"},
+		Type:       v1.SecretTypeTLS,
+		Data:       map[string][]byte{"tls.crt": b.CertsPEM, "tls.key": b.KeyPEM, "ca.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b.Chain[1].Raw})},
+	}
+	found := inspectSecretCertificates(tlsSecret, defaultOpaqueKeys, defaultMinRSABits)
+	if len(found) != 2 {
+		t.Fatalf("got %+v, want tls.crt and ca.crt", found)
+	}
+	if c := found[0]; c.Key != "tls.crt" || !reflect.DeepEqual(c.DNSNames, []string{"example.com"}) || !c.NotAfter.Equal(b.Leaf.NotAfter) || len(c.Weaknesses) > 0 {
+		t.Errorf("tls.crt: got %+v", c)
+	}
+	if c := found[1]; c.Key != "ca.crt" || c.Subject != "Test CA" || len(c.Weaknesses) > 0 {
+		t.Errorf("ca.crt: got %+v", c)
+	}
+
+	broken := &v1.Secret{Type: v1.SecretTypeTLS, Data: map[string][]byte{"tls.crt": []byte("garbage")}}
+	if found := inspectSecretCertificates(broken, defaultOpaqueKeys, defaultMinRSABits); len(found) != 1 || found[0].Error == "" {
+		t.Errorf("broken secret: got %+v", found)
+	}
+
+	opaque := &v1.Secret{
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{"cert.pem": legacy, "key.pem": b.KeyPEM, "password": []byte("x"), "legacy.crt": legacy},
+	}
+	found = inspectSecretCertificates(opaque, defaultOpaqueKeys, defaultMinRSABits)
+	var keys []string
+	for _, c := range found {
+		keys = append(keys, c.Key)
+		if !reflect.DeepEqual(c.Weaknesses, []string{weaknessNoSAN}) {
+			t.Errorf("%s: got weaknesses %v", c.Key, c.Weaknesses)
+		}
+	}
+	if want := []string{"cert.pem", "legacy.crt"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("opaque secret: got keys %v, want %v", keys, want)
+	}
+
+	var buf bytes.Buffer
+	if err := writeScanReport(&buf, found, defaultExpiryWarning, now); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "EXPIRING, no-san") {
+		t.Errorf("report doesn't flag the expiring certificate:\n%s", buf.String())
+	}
+}
+
+func TestParseCertificatesDER(t *testing.T) {
+	block, _ := pem.Decode(newNamelessCertificate(t))
+	certs, err := parseCertificates(block.Bytes)
+	if err != nil || len(certs) != 1 {
+		t.Errorf("got %d certificates, %v", len(certs), err)
+	}
+	if _, err := parseCertificates([]byte("password")); err != errNoCertificates {
+		t.Errorf("got %v, want errNoCertificates", err)
+	}
+}
+
+func TestRecordSecretCertificates(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour)
+	recordSecretCertificates([]secretCertificate{
+		{Namespace: "a", Secret: "s", Key: "tls.crt", NotAfter: &notAfter, Weaknesses: []string{weaknessNoSAN}},
+		{Namespace: "b", Secret: "s", Key: "tls.crt", NotAfter: &notAfter},
+	})
+	recordSecretCertificates([]secretCertificate{
+		{Namespace: "b", Secret: "s", Key: "tls.crt", NotAfter: &notAfter},
+	})
+	var series []string
+	for _, g := range []*gaugeVec{secretCertNotAfter, secretCertWeakness} {
+		g.Each(func(labels []string, _ float64) {
+			series = append(series, strings.Join(labels, "/"))
+		})
+	}
+	if want := []string{"b/s/tls.crt"}; !reflect.DeepEqual(series, want) {
+		t.Errorf("got series %v, want %v", series, want)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// Webhook payload formats.
+const (
+	webhookGeneric = "generic"
+	webhookSlack   = "slack"
+	webhookTeams   = "teams"
+)
+
+// Headers on every webhook request. The signature is only sent if the
+// webhook has an HMAC key.
+const (
+	webhookEventHeader     = "X-Cert-Generator-Event"
+	webhookTimestampHeader = "X-Cert-Generator-Timestamp"
+	webhookSignatureHeader = "X-Cert-Generator-Signature"
+)
+
+// severityColors are the Slack attachment and Teams card colors for each
+// severity.
+var severityColors = map[string]string{
+	"info":     "2EB67D",
+	"warning":  "ECB22E",
+	"critical": "E01E5A",
+}
+
+// webhookSink posts notifications to an HTTP endpoint.
+type webhookSink struct {
+	Name   string
+	URL    string
+	Format string
+	// Template, if set, renders the body instead of Format.
+	Template *template.Template
+	// Events the webhook wants. Nil means all of them.
+	Events map[string]bool
+	// HMACKey signs the body, if set.
+	HMACKey []byte
+	Headers map[string]string
+	Client  *http.Client
+}
+
+// newWebhookSink returns the webhook wc describes. lookupEnv resolves urlEnv
+// and hmacKeyEnv.
+func newWebhookSink(wc webhookConfig, lookupEnv func(string) (string, bool)) (*webhookSink, error) {
+	w := &webhookSink{
+		Name:    wc.Name,
+		URL:     wc.URL,
+		Format:  wc.Format,
+		Headers: wc.Headers,
+		Client:  &http.Client{Timeout: notificationTimeout},
+	}
+	if wc.URLEnv != "" {
+		v, ok := lookupEnv(wc.URLEnv)
+		if !ok || v == "" {
+			return nil, fmt.Errorf("urlEnv: $%s is not set", wc.URLEnv)
+		}
+		w.URL = v
+	}
+	if wc.HMACKeyEnv != "" {
+		v, ok := lookupEnv(wc.HMACKeyEnv)
+		if !ok || v == "" {
+			return nil, fmt.Errorf("hmacKeyEnv: $%s is not set", wc.HMACKeyEnv)
+		}
+		w.HMACKey = []byte(v)
+	}
+	if wc.Template != "" {
+		t, err := parseWebhookTemplate(wc.Name, wc.Template)
+		if err != nil {
+			return nil, err
+		}
+		w.Template = t
+	}
+	if len(wc.Events) > 0 {
+		w.Events = make(map[string]bool)
+		for _, e := range wc.Events {
+			w.Events[e] = true
+		}
+	}
+	return w, nil
+}
+
+func parseWebhookTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+func (w *webhookSink) name() string {
+	return "webhook/" + w.Name
+}
+
+func (w *webhookSink) wants(n *notification) bool {
+	return w.Events == nil || w.Events[n.Event]
+}
+
+// body renders n in the webhook's format.
+func (w *webhookSink) body(n *notification) ([]byte, error) {
+	if w.Template != nil {
+		var buf bytes.Buffer
+		if err := w.Template.Execute(&buf, n); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	color := severityColors[n.Severity]
+	switch w.Format {
+	case webhookSlack:
+		return json.Marshal(map[string]interface{}{
+			"text": n.Title(),
+			"attachments": []map[string]interface{}{{
+				"color":    "#" + color,
+				"fallback": n.Message,
+				"text":     n.Message,
+				"footer":   "k8s-cert-generator, namespace " + n.Namespace,
+				"ts":       n.Time.Unix(),
+			}},
+		})
+	case webhookTeams:
+		facts := []map[string]string{{"name": "Domain", "value": n.Domain}, {"name": "Namespace", "value": n.Namespace}}
+		if n.NotAfter != nil {
+			facts = append(facts, map[string]string{"name": "Expires", "value": n.NotAfter.UTC().Format(time.RFC3339)})
+		}
+		if n.Issuer != "" {
+			facts = append(facts, map[string]string{"name": "Issuer", "value": n.Issuer})
+		}
+		return json.Marshal(map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    n.Title(),
+			"title":      n.Title(),
+			"themeColor": color,
+			"text":       n.Message,
+			"sections":   []map[string]interface{}{{"facts": facts}},
+		})
+	default:
+		return json.Marshal(n)
+	}
+}
+
+// signWebhookBody returns the signature header for body sent at timestamp: the hex
+// HMAC-SHA256 of "<timestamp>.<body>", so a captured request can't be
+// replayed later with a new timestamp.
+func signWebhookBody(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhookSink) send(ctx context.Context, n *notification) error {
+	body, err := w.body(n)
+	if err != nil {
+		return permanentError{fmt.Errorf("rendering body: %v", err)}
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", eventComponent)
+	req.Header.Set(webhookEventHeader, n.Event)
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.HMACKey != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, signWebhookBody(w.HMACKey, timestamp, body))
+	}
+	resp, err := w.Client.Do(req)
+	if uerr, ok := err.(*url.Error); ok {
+		// Leave out the URL, which for Slack and Teams is a secret.
+		return fmt.Errorf("%s: %v", uerr.Op, uerr.Err)
+	} else if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(snippet))
+	default:
+		return permanentError{fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(snippet))}
+	}
+}